@@ -3,48 +3,260 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/radiatus-ai/package-provisioner/internal/admin"
+	"github.com/radiatus-ai/package-provisioner/internal/auth"
 	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/deadletter"
+	"github.com/radiatus-ai/package-provisioner/internal/dedup"
 	"github.com/radiatus-ai/package-provisioner/internal/deployer"
+	"github.com/radiatus-ai/package-provisioner/internal/envelope"
+	"github.com/radiatus-ai/package-provisioner/internal/health"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/metrics"
+	"github.com/radiatus-ai/package-provisioner/internal/notify"
+	"github.com/radiatus-ai/package-provisioner/internal/orchestrator"
+	"github.com/radiatus-ai/package-provisioner/internal/outbox"
 	"github.com/radiatus-ai/package-provisioner/internal/pubsub"
+	"github.com/radiatus-ai/package-provisioner/internal/report"
+	"github.com/radiatus-ai/package-provisioner/internal/scrub"
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
 )
 
 func main() {
+	// mask the secrets of runs in progress in everything we log
+	logOutput := scrub.NewWriter(scrub.Default, os.Stderr)
+	log.SetOutput(logOutput)
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
-	log.Printf("Configuration loaded successfully: %+v", cfg)
+	logger, err := logging.NewFromConfig(cfg, logOutput)
+	if err != nil {
+		log.Fatalf("Failed to configure logging: %v", err)
+	}
+	// also routes anything still logging through the log package
+	slog.SetDefault(logger)
+	slog.Info("Configuration loaded successfully", "config", cfg)
 
-	deployer := deployer.NewDeployer(cfg)
-	log.Printf("Deployer initialized")
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		fatal("Failed to configure tracing", err)
+	}
 
-	subscriber := pubsub.NewSubscriber(cfg, deployer.DeployPackage, deployer)
-	log.Printf("Subscriber initialized")
+	protector, err := sensitive.NewProtectorFromConfig(cfg)
+	if err != nil {
+		fatal("Failed to configure sensitive output handling", err)
+	}
+	// the outbox retries updates on its interval, each delivery is a single
+	// attempt so a package canvas-api doesn't take doesn't hold up the others
+	reportCfg := *cfg
+	reportCfg.APIMaxRetries = 0
+	reporter, err := report.NewFromConfig(context.Background(), &reportCfg)
+	if err != nil {
+		fatal("Failed to configure status reporting", err)
+	}
+	statusOutbox, err := outbox.NewFromConfig(cfg, reporter)
+	if err != nil {
+		fatal("Failed to open status outbox", err)
+	}
+	go statusOutbox.Run(context.Background())
+	slog.Info("Reporting status updates", "transport", cfg.ReportTransport)
+
+	notifier, err := notify.NewFromConfig(cfg)
+	if err != nil {
+		fatal("Failed to configure notifications", err)
+	}
+
+	deployerOpts := []deployer.Option{
+		deployer.WithProtector(protector),
+		deployer.WithReporter(statusOutbox),
+		deployer.WithNotifier(notifier),
+	}
+	if cfg.PropagationTopicID != "" {
+		publisher, err := pubsub.NewTopicPublisher(context.Background(), cfg.ProjectID, cfg.PropagationTopicID)
+		if err != nil {
+			fatal("Failed to create propagation publisher", err)
+		}
+		defer publisher.Close()
+		deployerOpts = append(deployerOpts, deployer.WithPropagator(pubsub.NewRedeployPublisher(publisher)))
+		slog.Info("Propagating output changes", "topic", cfg.PropagationTopicID)
+	}
+
+	deployer := deployer.NewDeployer(cfg, deployerOpts...)
+	slog.Info("Deployer initialized")
+
+	orchestrator := orchestrator.NewOrchestrator(deployer.DeployPackage)
+
+	kms, err := envelope.NewKMSFromConfig(cfg)
+	if err != nil {
+		fatal("Failed to configure message encryption", err)
+	}
+
+	var deadLetterPublisher deadletter.Publisher
+	if cfg.DeadLetterSink == deadletter.SinkPubSub && cfg.DeadLetterTopicID != "" {
+		publisher, err := pubsub.NewTopicPublisher(context.Background(), cfg.ProjectID, cfg.DeadLetterTopicID)
+		if err != nil {
+			fatal("Failed to create dead letter publisher", err)
+		}
+		defer publisher.Close()
+		deadLetterPublisher = publisher
+	}
+	deadLetters, err := deadletter.NewFromConfig(cfg, deadLetterPublisher)
+	if err != nil {
+		fatal("Failed to configure dead letters", err)
+	}
+
+	subscriberOpts := []pubsub.Option{pubsub.WithKMS(kms), pubsub.WithDeadLetters(deadLetters)}
+	dedupStore := dedup.NewFromConfig(cfg)
+	if dedupStore != nil {
+		subscriberOpts = append(subscriberOpts, pubsub.WithDedup(dedupStore))
+		slog.Info("Deduplicating messages", "ttl", time.Duration(cfg.DedupTTLSeconds)*time.Second)
+	}
+
+	subscriber := pubsub.NewSubscriber(cfg, orchestrator.Handle, subscriberOpts...)
+	slog.Info("Subscriber initialized")
+	// messages were acked when they arrived, the ones still processing when
+	// the last process stopped are only retried from here
+	if resumed, err := subscriber.Resume(context.Background()); err != nil {
+		slog.Error("Failed to resume interrupted messages", "error", err)
+	} else if resumed > 0 {
+		slog.Info("Resumed interrupted messages", "messages", resumed)
+	}
+	if dedupStore != nil {
+		go dedupStore.Run(context.Background(), time.Hour)
+	}
 
 	// Set up HTTP server
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request: %s %s", r.Method, r.URL.Path)
+		slog.Debug("Received request", "method", r.Method, "path", r.URL.Path)
 		fmt.Fprintf(w, "Deployer is running")
 	})
 
+	// liveness only covers what a restart fixes, the dependencies of a run
+	// are readiness checks. The status worker falls behind while canvas-api
+	// is slow or down, which a restart doesn't fix either.
+	liveness := health.NewChecker(4 * time.Second)
+	readiness := health.NewChecker(4 * time.Second)
+	readiness.Add("status_worker", health.Fresh(statusOutbox.LastActive, time.Duration(cfg.HealthWorkerStaleSeconds)*time.Second))
+	readiness.Add("terraform", health.TerraformVersion("terraform"))
+	readiness.Add("modules", health.ReadableDir(cfg.TerraformModulesPath))
+	if err := os.MkdirAll(cfg.WorkspacePath, 0755); err != nil {
+		fatal("Failed to create workspace directory", err)
+	}
+	readiness.Add("disk_space", health.DiskSpace(cfg.WorkspacePath, uint64(cfg.HealthMinFreeMB)<<20))
+	if cfg.HealthCheckBucket {
+		prober, err := health.NewGCSProber(context.Background())
+		if err != nil {
+			fatal("Failed to configure bucket health check", err)
+		}
+		readiness.Add("state_bucket", health.Bucket(prober, cfg.BucketName))
+	}
+	http.Handle("/healthz", liveness.Handler())
+	http.Handle("/readyz", readiness.Handler())
+
+	http.Handle("/metrics", metrics.Handler())
+
 	// Add the push endpoint
-	http.HandleFunc("/push", subscriber.HandlePush)
+	var pushHandler http.Handler = http.HandlerFunc(subscriber.HandlePush)
+	if cfg.PushAuthEnabled {
+		verifier, err := auth.NewVerifierFromConfig(cfg)
+		if err != nil {
+			fatal("Failed to configure push authentication", err)
+		}
+		pushHandler = verifier.Middleware(pushHandler)
+		slog.Info("Push authentication enabled", "audience", cfg.PushAuthAudience)
+	}
+	http.Handle("/push", pushHandler)
+
+	if cfg.AdminEnabled {
+		verifier, err := auth.NewAdminVerifierFromConfig(cfg)
+		if err != nil {
+			fatal("Failed to configure admin authentication", err)
+		}
+		var adminOpts []admin.Option
+		// dead letters published to a topic are replayed by republishing them
+		if store, ok := deadLetters.(*deadletter.FileStore); ok {
+			adminOpts = append(adminOpts, admin.WithDeadLetters(store, subscriber))
+		}
+		http.Handle("/admin/", verifier.Middleware(admin.NewServer(deployer, orchestrator, adminOpts...).Handler()))
+		slog.Info("Admin API enabled", "audience", cfg.AdminAuthAudience)
+	}
 
 	// Get PORT from environment variable
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080" // Default port if not set
 	}
-	log.Printf("Using port: %s", port)
+	slog.Info("Starting HTTP server", "port", port,
+		"subscription", fmt.Sprintf("projects/%s/subscriptions/%s", cfg.ProjectID, cfg.SubscriptionID))
+	stop, cancelStop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancelStop()
+	server := &http.Server{Addr: ":" + port}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		fatal("Failed to start HTTP server", err)
+	case <-stop.Done():
+	}
+	// a second signal stops right away
+	cancelStop()
+
+	// finish what was accepted before stopping, Pub/Sub redelivers pushes
+	// that come in meanwhile
+	slog.Info("Shutting down", "timeout", time.Duration(cfg.ShutdownTimeoutSeconds)*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to stop HTTP server", "error", err)
+	}
+	if err := waitFor(ctx, subscriber.Wait); err != nil {
+		slog.Warn("Stopping with messages still in progress, they are resumed on the next start", "error", err)
+	}
+	if err := waitFor(ctx, notifier.Wait); err != nil {
+		slog.Warn("Stopping with notifications still being delivered", "error", err)
+	}
+	if err := statusOutbox.Flush(ctx); err != nil {
+		slog.Warn("Stopping with status updates left in the outbox", "error", err)
+	}
+
+	tracingCtx, cancelTracing := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelTracing()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+}
 
-	log.Printf("Starting HTTP server on port %s", port)
-	log.Printf("Listening for messages on projects/%s/subscriptions/%s", cfg.ProjectID, cfg.SubscriptionID)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
+// waitFor calls wait, giving up once ctx is done.
+func waitFor(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
+
+func fatal(msg string, err error) {
+	slog.Log(context.Background(), logging.LevelCritical, msg, "error", err)
+	os.Exit(1)
+}
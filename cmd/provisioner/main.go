@@ -0,0 +1,191 @@
+// cmd/provisioner/main.go
+
+// provisioner runs a deployment message through the deployer without Pub/Sub,
+// against local modules and a local terraform backend. It is meant for package
+// authors testing modules before publishing them to canvas-packages.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/deployer"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/report"
+	"github.com/radiatus-ai/package-provisioner/internal/scrub"
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+const usage = `Usage: provisioner <command> [flags] <message.json>
+
+Runs a DeploymentMessage read from a file, or stdin for -, the way the
+deployer would, with terraform state kept locally.
+
+Commands:
+  deploy    apply the package and print its outputs
+  destroy   destroy the package
+  plan      print the changes a deploy, or a destroy with -destroy, would make
+  outputs   print the outputs of the last deploy of the package
+
+Flags:
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command := os.Args[1]
+	switch command {
+	case "deploy", "destroy", "plan", "outputs":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", command, usage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	modules := flags.String("modules", os.Getenv("TERRAFORM_MODULES_PATH"), "path to the package modules, e.g. a canvas-packages checkout")
+	dir := flags.String("dir", ".provisioner", "where workspaces, state and run history are kept")
+	destroy := flags.Bool("destroy", false, "plan a destroy instead of a deploy")
+	showSensitive := flags.Bool("show-sensitive", false, "print sensitive outputs instead of masking them")
+	logLevel := flags.String("log-level", "info", "debug shows the output of terraform commands")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// mask the secrets of the run in everything we log
+	slog.SetDefault(logging.New(scrub.NewWriter(scrub.Default, os.Stderr), level, "text", ""))
+
+	action := models.ActionDeploy
+	if command == "destroy" || command == "plan" && *destroy {
+		action = models.ActionDestroy
+	}
+	msg, err := readMessage(flags.Arg(0), action)
+	if err != nil {
+		fatal("Failed to read deployment message", err)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fatal("Failed to load configuration", err)
+	}
+	cfg.TerraformModulesPath = *modules
+	cfg.TerraformBackend = "local"
+	cfg.LocalStatePath = filepath.Join(*dir, "state")
+	cfg.WorkspacePath = filepath.Join(*dir, "deployments")
+	cfg.HistoryPath = filepath.Join(*dir, "history")
+	cfg.RunLogPath = ""
+	// messages are the author's own, secrets may come from their environment
+	cfg.LocalSecretProviders = true
+	// nothing tracks package state, and connections resolve from local runs
+	cfg.ReportTransport = report.TransportLog
+	if cfg.TerraformModulesPath == "" && command != "outputs" {
+		fatal("No modules path", errors.New("set -modules or TERRAFORM_MODULES_PATH"))
+	}
+
+	// interrupting stops terraform cleanly, releasing its state lock
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	d := deployer.NewDeployer(cfg, deployer.WithReporter(report.LogReporter{}))
+	switch command {
+	case "deploy", "destroy":
+		if err := d.DeployPackage(ctx, msg); err != nil {
+			fatal("Run failed", err)
+		}
+		if msg.Action == models.ActionDeploy {
+			printOutputs(history.NewFileStore(cfg.HistoryPath), msg.PackageID, *showSensitive)
+		}
+	case "plan":
+		plan, err := d.Plan(ctx, msg)
+		if err != nil {
+			fatal("Plan failed", err)
+		}
+		fmt.Println(plan)
+	case "outputs":
+		printOutputs(history.NewFileStore(cfg.HistoryPath), msg.PackageID, *showSensitive)
+	}
+}
+
+// readMessage reads a message the way the subscriber does, the action is the
+// command's.
+func readMessage(path string, action models.DeploymentAction) (models.DeploymentMessage, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return models.DeploymentMessage{}, err
+	}
+	msg, err := models.DecodeDeploymentMessage(data)
+	if err != nil {
+		return msg, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	msg.Action = action
+	return msg, msg.Validate()
+}
+
+// printOutputs prints the outputs of a package as JSON, as of its last
+// successful run.
+func printOutputs(store history.Store, packageID string, showSensitive bool) {
+	runs, err := store.List(packageID)
+	if err != nil {
+		fatal("Failed to look up the runs of the package", err)
+	}
+	var run *history.Run
+	for i := len(runs) - 1; i >= 0 && run == nil; i-- {
+		switch runs[i].Status {
+		case models.Deployed:
+			run = runs[i]
+		case models.Destroyed:
+			fatal("No outputs", fmt.Errorf("package %s has been destroyed", packageID))
+		}
+	}
+	if run == nil {
+		fatal("No outputs", fmt.Errorf("package %s hasn't been deployed", packageID))
+	}
+	// only the outputs the package declares are kept
+	outputs := run.Outputs
+	if outputs == nil {
+		outputs = map[string]interface{}{}
+	}
+	if !showSensitive {
+		outputs = sensitive.Redact(outputs, run.SensitiveKeys)
+	}
+	data, err := json.MarshalIndent(outputs, "", "  ")
+	if err != nil {
+		fatal("Failed to encode outputs", err)
+	}
+	fmt.Println(string(data))
+}
+
+func fatal(msg string, err error) {
+	slog.Log(context.Background(), logging.LevelCritical, msg, "error", err)
+	os.Exit(1)
+}
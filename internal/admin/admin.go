@@ -0,0 +1,298 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/auth"
+	"github.com/radiatus-ai/package-provisioner/internal/deadletter"
+	"github.com/radiatus-ai/package-provisioner/internal/deployer"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/orchestrator"
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+const (
+	defaultLogLines = 100
+	maxLogLines     = 5000
+)
+
+// Runs is what the admin API needs from the deployer.
+type Runs interface {
+	Active() []deployer.ActiveRun
+	History(packageID string) ([]*history.Run, error)
+	Run(packageID, runID string) (*history.Run, error)
+	LogTail(packageID, runID string, lines int) ([]string, error)
+	Files(packageID, runID string) (map[string]string, error)
+	Retry(ctx context.Context, packageID, runID string) (string, error)
+	Cancel(packageID, runID string) error
+}
+
+// Queue lists the packages waiting for a run.
+type Queue interface {
+	Queued() []orchestrator.Queued
+}
+
+// DeadLetters are the messages the subscriber gave up on.
+type DeadLetters interface {
+	List() ([]deadletter.Entry, error)
+	Get(id string) (*deadletter.Entry, error)
+	Delete(id string) error
+}
+
+// Replayer processes a dead-lettered message again, removing the dead letter
+// once the message goes through.
+type Replayer interface {
+	Replay(ctx context.Context, entry deadletter.Entry)
+}
+
+// Server is the admin API operators use to see what the provisioner is doing
+// and to retry or cancel runs. It expects to sit behind authentication.
+type Server struct {
+	runs  Runs
+	queue Queue
+	// nil leaves out the dead letter routes
+	deadLetters DeadLetters
+	replayer    Replayer
+}
+
+type Option func(*Server)
+
+// WithDeadLetters serves the dead letters to inspect, replay through replayer
+// and delete.
+func WithDeadLetters(deadLetters DeadLetters, replayer Replayer) Option {
+	return func(s *Server) {
+		s.deadLetters = deadLetters
+		s.replayer = replayer
+	}
+}
+
+// NewServer returns an admin API over runs. queue may be nil.
+func NewServer(runs Runs, queue Queue, opts ...Option) *Server {
+	s := &Server{runs: runs, queue: queue}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/runs", s.listRuns)
+	mux.HandleFunc("GET /admin/packages/{packageID}/runs", s.listPackageRuns)
+	mux.HandleFunc("GET /admin/packages/{packageID}/runs/{runID}", s.getRun)
+	mux.HandleFunc("GET /admin/packages/{packageID}/runs/{runID}/logs", s.getLogs)
+	mux.HandleFunc("GET /admin/packages/{packageID}/runs/{runID}/files", s.getFiles)
+	mux.HandleFunc("POST /admin/packages/{packageID}/runs/{runID}/retry", s.retry)
+	mux.HandleFunc("POST /admin/packages/{packageID}/runs/{runID}/cancel", s.cancel)
+	if s.deadLetters != nil {
+		mux.HandleFunc("GET /admin/dead-letters", s.listDeadLetters)
+		mux.HandleFunc("GET /admin/dead-letters/{id}", s.getDeadLetter)
+		mux.HandleFunc("POST /admin/dead-letters/{id}/replay", s.replayDeadLetter)
+		mux.HandleFunc("DELETE /admin/dead-letters/{id}", s.deleteDeadLetter)
+	}
+	return mux
+}
+
+func (s *Server) listRuns(w http.ResponseWriter, r *http.Request) {
+	queued := []orchestrator.Queued{}
+	if s.queue != nil {
+		queued = s.queue.Queued()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"active": s.runs.Active(),
+		"queued": queued,
+	})
+}
+
+func (s *Server) listPackageRuns(w http.ResponseWriter, r *http.Request) {
+	runs, err := s.runs.History(r.PathValue("packageID"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	redacted := make([]*history.Run, 0, len(runs))
+	for _, run := range runs {
+		redacted = append(redacted, redact(run))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"runs": redacted})
+}
+
+func (s *Server) getRun(w http.ResponseWriter, r *http.Request) {
+	run, err := s.runs.Run(r.PathValue("packageID"), r.PathValue("runID"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, redact(run))
+}
+
+func (s *Server) getLogs(w http.ResponseWriter, r *http.Request) {
+	lines := defaultLogLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxLogLines {
+			http.Error(w, "lines must be between 1 and "+strconv.Itoa(maxLogLines), http.StatusBadRequest)
+			return
+		}
+		lines = n
+	}
+	tail, err := s.runs.LogTail(r.PathValue("packageID"), r.PathValue("runID"), lines)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"lines": tail})
+}
+
+func (s *Server) getFiles(w http.ResponseWriter, r *http.Request) {
+	files, err := s.runs.Files(r.PathValue("packageID"), r.PathValue("runID"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"files": files})
+}
+
+func (s *Server) retry(w http.ResponseWriter, r *http.Request) {
+	packageID, runID := r.PathValue("packageID"), r.PathValue("runID")
+	newRunID, err := s.runs.Retry(r.Context(), packageID, runID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	slog.Info("Run retried by operator", "package_id", packageID, "retry_of", runID, "run_id", newRunID, "email", operator(r))
+	writeJSON(w, http.StatusAccepted, map[string]string{"run_id": newRunID})
+}
+
+func (s *Server) cancel(w http.ResponseWriter, r *http.Request) {
+	packageID, runID := r.PathValue("packageID"), r.PathValue("runID")
+	if err := s.runs.Cancel(packageID, runID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	slog.Info("Run cancelled by operator", "package_id", packageID, "run_id", runID, "email", operator(r))
+	writeJSON(w, http.StatusAccepted, map[string]string{"run_id": runID})
+}
+
+// deadLetter is a dead-lettered message without its payload, which may carry
+// secrets.
+type deadLetter struct {
+	ID             string            `json:"id"`
+	MessageID      string            `json:"message_id,omitempty"`
+	Reason         deadletter.Reason `json:"reason"`
+	Error          string            `json:"error"`
+	Attempts       int               `json:"attempts"`
+	DeadLetteredAt time.Time         `json:"dead_lettered_at"`
+	Attributes     map[string]string `json:"attributes,omitempty"`
+	Size           int               `json:"size"`
+	// when the payload is a readable deployment message
+	ProjectID string                  `json:"project_id,omitempty"`
+	PackageID string                  `json:"package_id,omitempty"`
+	Action    models.DeploymentAction `json:"action,omitempty"`
+}
+
+func newDeadLetter(entry deadletter.Entry) deadLetter {
+	view := deadLetter{
+		ID:             entry.ID,
+		MessageID:      entry.MessageID,
+		Reason:         entry.Reason,
+		Error:          entry.Error,
+		Attempts:       entry.Attempts,
+		DeadLetteredAt: entry.DeadLetteredAt,
+		Attributes:     entry.Attributes,
+		Size:           len(entry.Data),
+	}
+	var msg models.DeploymentMessage
+	if json.Unmarshal(entry.Data, &msg) == nil {
+		view.ProjectID, view.PackageID, view.Action = msg.ProjectID, msg.PackageID, msg.Action
+	}
+	return view
+}
+
+func (s *Server) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.deadLetters.List()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	views := make([]deadLetter, 0, len(entries))
+	for _, entry := range entries {
+		views = append(views, newDeadLetter(entry))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"dead_letters": views})
+}
+
+func (s *Server) getDeadLetter(w http.ResponseWriter, r *http.Request) {
+	entry, err := s.deadLetters.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newDeadLetter(*entry))
+}
+
+// replayDeadLetter takes a message out of the dead letters and processes it
+// again. It goes back in if it fails again.
+func (s *Server) replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	entry, err := s.deadLetters.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// the replayer removes the entry once the message goes through
+	s.replayer.Replay(r.Context(), *entry)
+	slog.Info("Dead letter replayed by operator", "dead_letter_id", entry.ID, logging.MessageID, entry.MessageID, "email", operator(r))
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": entry.ID})
+}
+
+func (s *Server) deleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.deadLetters.Delete(id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	slog.Info("Dead letter deleted by operator", "dead_letter_id", id, "email", operator(r))
+	writeJSON(w, http.StatusOK, map[string]string{"id": id})
+}
+
+// redact masks the sensitive outputs of a run, which are recorded the way the
+// sensitive output mode protects them, so in plain unless it encrypts them.
+func redact(run *history.Run) *history.Run {
+	redacted := *run
+	redacted.Outputs = sensitive.Redact(run.Outputs, run.SensitiveKeys)
+	return &redacted
+}
+
+func operator(r *http.Request) string {
+	if claims := auth.ClaimsFromContext(r.Context()); claims != nil {
+		return claims.Email
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, history.ErrNotFound), errors.Is(err, deployer.ErrNoRunLog), errors.Is(err, deadletter.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, deployer.ErrRunNotActive), errors.Is(err, deployer.ErrNotRetryable), errors.Is(err, deployer.ErrWorkspaceReused):
+		status = http.StatusConflict
+	default:
+		slog.Error("Admin request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,268 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/deadletter"
+	"github.com/radiatus-ai/package-provisioner/internal/deployer"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/orchestrator"
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+type fakeRuns struct {
+	runs      map[string]*history.Run
+	retried   []string
+	cancelled []string
+	lines     int
+}
+
+func (f *fakeRuns) Active() []deployer.ActiveRun {
+	return []deployer.ActiveRun{{RunID: "run-2", PackageID: "db", Status: models.StartDeploy}}
+}
+
+func (f *fakeRuns) History(packageID string) ([]*history.Run, error) {
+	var runs []*history.Run
+	for _, run := range f.runs {
+		if run.PackageID == packageID {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+func (f *fakeRuns) Run(packageID, runID string) (*history.Run, error) {
+	run, ok := f.runs[runID]
+	if !ok || run.PackageID != packageID {
+		return nil, history.ErrNotFound
+	}
+	return run, nil
+}
+
+func (f *fakeRuns) LogTail(packageID, runID string, lines int) ([]string, error) {
+	if _, err := f.Run(packageID, runID); err != nil {
+		return nil, err
+	}
+	f.lines = lines
+	return []string{`{"message":"Starting run"}`}, nil
+}
+
+func (f *fakeRuns) Files(packageID, runID string) (map[string]string, error) {
+	if runID != "run-2" {
+		return nil, fmt.Errorf("%w: run-2", deployer.ErrWorkspaceReused)
+	}
+	return map[string]string{"backend.tf": "terraform {}"}, nil
+}
+
+func (f *fakeRuns) Retry(ctx context.Context, packageID, runID string) (string, error) {
+	if run, err := f.Run(packageID, runID); err != nil {
+		return "", err
+	} else if run.Status != models.Failed {
+		return "", deployer.ErrNotRetryable
+	}
+	f.retried = append(f.retried, runID)
+	return "run-3", nil
+}
+
+func (f *fakeRuns) Cancel(packageID, runID string) error {
+	if runID != "run-2" {
+		return deployer.ErrRunNotActive
+	}
+	f.cancelled = append(f.cancelled, runID)
+	return nil
+}
+
+type fakeQueue []orchestrator.Queued
+
+func (q fakeQueue) Queued() []orchestrator.Queued {
+	return q
+}
+
+func newTestServer() (*fakeRuns, http.Handler) {
+	runs := &fakeRuns{runs: map[string]*history.Run{
+		"run-1": {ID: "run-1", PackageID: "db", Status: models.Failed, StartedAt: time.Now()},
+		"run-2": {
+			ID:            "run-2",
+			PackageID:     "db",
+			Status:        models.StartDeploy,
+			Outputs:       map[string]interface{}{"host": "10.0.0.1", "password": "hunter2"},
+			SensitiveKeys: []string{"password"},
+		},
+	}}
+	queue := fakeQueue{{ProjectID: "test-project", PackageID: "app", WaitingOn: []string{"db"}}}
+	return runs, NewServer(runs, queue).Handler()
+}
+
+func serve(handler http.Handler, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestServer_ListRuns(t *testing.T) {
+	_, handler := newTestServer()
+	rec := serve(handler, http.MethodGet, "/admin/runs")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var body struct {
+		Active []deployer.ActiveRun  `json:"active"`
+		Queued []orchestrator.Queued `json:"queued"`
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if len(body.Active) != 1 || body.Active[0].RunID != "run-2" {
+		t.Errorf("Expected the active run, got %+v", body.Active)
+	}
+	if len(body.Queued) != 1 || body.Queued[0].PackageID != "app" {
+		t.Errorf("Expected the queued package, got %+v", body.Queued)
+	}
+}
+
+func TestServer_GetRun(t *testing.T) {
+	_, handler := newTestServer()
+	rec := serve(handler, http.MethodGet, "/admin/packages/db/runs/run-2")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var run history.Run
+	json.NewDecoder(rec.Body).Decode(&run)
+	if run.Status != models.StartDeploy || run.Outputs["host"] != "10.0.0.1" || run.Outputs["password"] != sensitive.Mask {
+		t.Errorf("Expected the run with sensitive outputs masked, got %+v", run)
+	}
+
+	if rec := serve(handler, http.MethodGet, "/admin/packages/app/runs/run-2"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a run of another package, got %d", rec.Code)
+	}
+
+	rec = serve(handler, http.MethodGet, "/admin/packages/db/runs")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "hunter2") {
+		t.Errorf("Expected the package history with sensitive outputs masked, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestServer_GetLogs(t *testing.T) {
+	runs, handler := newTestServer()
+	rec := serve(handler, http.MethodGet, "/admin/packages/db/runs/run-1/logs")
+	if rec.Code != http.StatusOK || runs.lines != defaultLogLines || !strings.Contains(rec.Body.String(), "Starting run") {
+		t.Errorf("Expected the default tail, got %d with %d lines: %s", rec.Code, runs.lines, rec.Body)
+	}
+	if rec := serve(handler, http.MethodGet, "/admin/packages/db/runs/run-1/logs?lines=10"); rec.Code != http.StatusOK || runs.lines != 10 {
+		t.Errorf("Expected a tail of 10 lines, got %d with %d lines", rec.Code, runs.lines)
+	}
+	for _, lines := range []string{"0", "abc", "100000"} {
+		if rec := serve(handler, http.MethodGet, "/admin/packages/db/runs/run-1/logs?lines="+lines); rec.Code != http.StatusBadRequest {
+			t.Errorf("lines=%s: expected 400, got %d", lines, rec.Code)
+		}
+	}
+}
+
+func TestServer_GetFiles(t *testing.T) {
+	_, handler := newTestServer()
+	if rec := serve(handler, http.MethodGet, "/admin/packages/db/runs/run-2/files"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "backend.tf") {
+		t.Errorf("Expected the generated files, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(handler, http.MethodGet, "/admin/packages/db/runs/run-1/files"); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a reused workspace, got %d", rec.Code)
+	}
+}
+
+func TestServer_Retry(t *testing.T) {
+	runs, handler := newTestServer()
+	rec := serve(handler, http.MethodPost, "/admin/packages/db/runs/run-1/retry")
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), "run-3") {
+		t.Errorf("Expected the retry to be accepted, got %d: %s", rec.Code, rec.Body)
+	}
+	if len(runs.retried) != 1 || runs.retried[0] != "run-1" {
+		t.Errorf("Expected run-1 to be retried, got %v", runs.retried)
+	}
+	if rec := serve(handler, http.MethodPost, "/admin/packages/db/runs/run-2/retry"); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a run that didn't fail, got %d", rec.Code)
+	}
+	if rec := serve(handler, http.MethodGet, "/admin/packages/db/runs/run-1/retry"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for a GET, got %d", rec.Code)
+	}
+}
+
+func TestServer_Cancel(t *testing.T) {
+	runs, handler := newTestServer()
+	if rec := serve(handler, http.MethodPost, "/admin/packages/db/runs/run-2/cancel"); rec.Code != http.StatusAccepted {
+		t.Errorf("Expected the cancel to be accepted, got %d", rec.Code)
+	}
+	if len(runs.cancelled) != 1 {
+		t.Errorf("Expected run-2 to be cancelled, got %v", runs.cancelled)
+	}
+	if rec := serve(handler, http.MethodPost, "/admin/packages/db/runs/run-1/cancel"); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a finished run, got %d", rec.Code)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeError(rec, httptest.NewRequest(http.MethodGet, "/admin/runs", nil), errors.New("disk on fire"))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for an unexpected error, got %d", rec.Code)
+	}
+}
+
+type fakeReplayer []deadletter.Entry
+
+func (f *fakeReplayer) Replay(ctx context.Context, entry deadletter.Entry) {
+	*f = append(*f, entry)
+}
+
+func TestServer_DeadLetters(t *testing.T) {
+	store := deadletter.NewFileStore(t.TempDir())
+	store.Put(context.Background(), deadletter.NewEntry("msg-1", []byte(`{"package_id": "db", "action": "DEPLOY", "secrets": {"password": "hunter2"}}`), nil, deadletter.ReasonFailed, errors.New("terraform apply failed"), 1))
+	store.Put(context.Background(), deadletter.NewEntry("msg-2", []byte("not json"), nil, deadletter.ReasonInvalid, errors.New("invalid character"), 1))
+	replayer := &fakeReplayer{}
+	handler := NewServer(&fakeRuns{}, nil, WithDeadLetters(store, replayer)).Handler()
+
+	rec := serve(handler, http.MethodGet, "/admin/dead-letters")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "hunter2") {
+		t.Fatalf("Expected the dead letters without their payload, got %d: %s", rec.Code, rec.Body)
+	}
+	var list struct {
+		DeadLetters []deadLetter `json:"dead_letters"`
+	}
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list.DeadLetters) != 2 || list.DeadLetters[0].PackageID != "db" || list.DeadLetters[0].Action != models.ActionDeploy {
+		t.Errorf("Expected both dead letters with the package they're for, got %+v", list.DeadLetters)
+	}
+
+	if rec := serve(handler, http.MethodGet, "/admin/dead-letters/msg-2"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "INVALID") {
+		t.Errorf("Expected the dead letter, got %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := serve(handler, http.MethodPost, "/admin/dead-letters/msg-1/replay"); rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected the replay to be accepted, got %d", rec.Code)
+	}
+	if len(*replayer) != 1 || string((*replayer)[0].Data) == "" {
+		t.Errorf("Expected msg-1 to be replayed with its payload, got %+v", *replayer)
+	}
+	if _, err := store.Get("msg-1"); err != nil {
+		t.Errorf("Expected the dead letter to be kept until its replay succeeds, got %v", err)
+	}
+
+	if rec := serve(handler, http.MethodDelete, "/admin/dead-letters/msg-2"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the dead letter to be deleted, got %d", rec.Code)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if rec := serve(handler, method, "/admin/dead-letters/msg-2"); rec.Code != http.StatusNotFound {
+			t.Errorf("%s of a deleted dead letter: expected 404, got %d", method, rec.Code)
+		}
+	}
+
+	_, withoutDeadLetters := newTestServer()
+	if rec := serve(withoutDeadLetters, http.MethodGet, "/admin/dead-letters"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no dead letter routes without a store, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,357 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+)
+
+// allowed difference between our clock and the token issuer's
+const clockSkew = time.Minute
+
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Audience      audience `json:"aud"`
+	Subject       string   `json:"sub"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+}
+
+// audience accepts both the string and the array form of the aud claim.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// KeySource returns the public key a token was signed with.
+type KeySource interface {
+	Key(ctx context.Context, kid string) (*rsa.PublicKey, error)
+}
+
+// Verifier checks the OIDC tokens Pub/Sub push attaches to its requests.
+type Verifier struct {
+	issuers       []string
+	audience      string
+	allowedEmails map[string]bool
+	keys          KeySource
+	now           func() time.Time
+}
+
+func NewVerifier(issuers []string, audience string, allowedEmails []string, keys KeySource) *Verifier {
+	emails := make(map[string]bool, len(allowedEmails))
+	for _, email := range allowedEmails {
+		emails[strings.ToLower(email)] = true
+	}
+	return &Verifier{
+		issuers:       issuers,
+		audience:      audience,
+		allowedEmails: emails,
+		keys:          keys,
+		now:           time.Now,
+	}
+}
+
+func NewVerifierFromConfig(cfg *config.Config) (*Verifier, error) {
+	if cfg.PushAuthAudience == "" {
+		return nil, fmt.Errorf("PUSH_AUTH_AUDIENCE is required when push authentication is enabled")
+	}
+	if len(splitList(cfg.PushAuthAllowedEmails)) == 0 {
+		return nil, fmt.Errorf("PUSH_AUTH_ALLOWED_EMAILS is required when push authentication is enabled")
+	}
+	keys, err := keySourceFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewVerifier(splitList(cfg.PushAuthIssuers), cfg.PushAuthAudience, splitList(cfg.PushAuthAllowedEmails), keys), nil
+}
+
+// NewAdminVerifierFromConfig checks the identity tokens of operators calling
+// the admin API, e.g. from gcloud auth print-identity-token. Tokens are signed
+// by the same issuers as push requests.
+func NewAdminVerifierFromConfig(cfg *config.Config) (*Verifier, error) {
+	if cfg.AdminAuthAudience == "" {
+		return nil, fmt.Errorf("ADMIN_AUTH_AUDIENCE is required when the admin API is enabled")
+	}
+	// anyone can get a token for any audience, the emails are what restricts
+	// access
+	if len(splitList(cfg.AdminAllowedEmails)) == 0 {
+		return nil, fmt.Errorf("ADMIN_ALLOWED_EMAILS is required when the admin API is enabled")
+	}
+	keys, err := keySourceFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewVerifier(splitList(cfg.PushAuthIssuers), cfg.AdminAuthAudience, splitList(cfg.AdminAllowedEmails), keys), nil
+}
+
+func keySourceFromConfig(cfg *config.Config) (KeySource, error) {
+	var keys KeySource
+	if cfg.PushAuthJWKSFile != "" {
+		data, err := os.ReadFile(cfg.PushAuthJWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS file: %v", err)
+		}
+		static, err := ParseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = static
+	} else {
+		keys = NewRemoteJWKS(cfg.PushAuthJWKSURL)
+	}
+	return keys, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Verify checks the signature and claims of a JWT and returns its claims.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", header.Alg)
+	}
+
+	key, err := v.keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if err := v.checkClaims(&claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (v *Verifier) checkClaims(claims *Claims) error {
+	issuerOK := false
+	for _, issuer := range v.issuers {
+		issuerOK = issuerOK || claims.Issuer == issuer
+	}
+	if !issuerOK {
+		return fmt.Errorf("unexpected issuer: %s", claims.Issuer)
+	}
+
+	audienceOK := false
+	for _, aud := range claims.Audience {
+		audienceOK = audienceOK || aud == v.audience
+	}
+	if !audienceOK {
+		return fmt.Errorf("unexpected audience: %v", []string(claims.Audience))
+	}
+
+	now := v.now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)) {
+		return fmt.Errorf("token expired")
+	}
+	if claims.IssuedAt != 0 && now.Add(clockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return fmt.Errorf("token used before issued")
+	}
+
+	if !claims.EmailVerified || !v.allowedEmails[strings.ToLower(claims.Email)] {
+		return fmt.Errorf("service account %q is not allowed", claims.Email)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Middleware rejects requests without a valid bearer token.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			slog.Warn("Rejecting request without a bearer token", "method", r.Method, "path", r.URL.Path)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := v.Verify(r.Context(), token)
+		if err != nil {
+			slog.Warn("Rejecting request with an invalid token", "method", r.Method, "path", r.URL.Path, "error", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		slog.Debug("Authenticated request", "email", claims.Email, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims of the token a request was
+// authenticated with, or nil.
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+// StaticJWKS is a fixed set of keys, e.g. loaded from a file for offline use.
+type StaticJWKS map[string]*rsa.PublicKey
+
+func (s StaticJWKS) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	key, ok := s[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	return key, nil
+}
+
+// ParseJWKS reads the RSA keys of a JSON Web Key Set.
+func ParseJWKS(data []byte) (StaticJWKS, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(StaticJWKS)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus for key %s: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent for key %s: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// RemoteJWKS fetches keys from a JWKS endpoint, caching them and refetching
+// when a token names a key it hasn't seen, which is how rotations show up.
+type RemoteJWKS struct {
+	url    string
+	client *http.Client
+	// don't hammer the endpoint with tokens signed by unknown keys
+	minRefresh time.Duration
+
+	mu        sync.Mutex
+	keys      StaticJWKS
+	fetchedAt time.Time
+}
+
+func NewRemoteJWKS(url string) *RemoteJWKS {
+	return &RemoteJWKS{
+		url:        url,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		minRefresh: time.Minute,
+	}
+}
+
+func (r *RemoteJWKS) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if key, ok := r.keys[kid]; ok && time.Since(r.fetchedAt) < time.Hour {
+		return key, nil
+	}
+	if r.keys == nil || time.Since(r.fetchedAt) >= r.minRefresh {
+		if err := r.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return r.keys.Key(ctx, kid)
+}
+
+func (r *RemoteJWKS) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: status code %d", resp.StatusCode)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("invalid JWKS: %v", err)
+	}
+	keys, err := ParseJWKS(raw)
+	if err != nil {
+		return err
+	}
+	r.keys = keys
+	r.fetchedAt = time.Now()
+	return nil
+}
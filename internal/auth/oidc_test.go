@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+)
+
+const (
+	testAudience = "https://provisioner.example.com/push"
+	testEmail    = "pubsub-push@test-project.iam.gserviceaccount.com"
+)
+
+var testKey, otherKey = mustKey(), mustKey()
+
+func mustKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func jwks(keys map[string]*rsa.PrivateKey) []byte {
+	type jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"aud":            testAudience,
+		"sub":            "1234567890",
+		"email":          testEmail,
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, kid, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testVerifier(t *testing.T) *Verifier {
+	keys, err := ParseJWKS(jwks(map[string]*rsa.PrivateKey{"key-1": testKey}))
+	if err != nil {
+		t.Fatalf("ParseJWKS() error = %v", err)
+	}
+	return NewVerifier([]string{"https://accounts.google.com", "accounts.google.com"}, testAudience, []string{testEmail}, keys)
+}
+
+func TestVerify(t *testing.T) {
+	verifier := testVerifier(t)
+
+	claims, err := verifier.Verify(context.Background(), sign(t, testKey, "key-1", "RS256", validClaims()))
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if claims.Email != testEmail {
+		t.Errorf("Email = %s, want %s", claims.Email, testEmail)
+	}
+
+	// Google issues tokens with and without the scheme, and aud may be a list
+	alt := validClaims()
+	alt["iss"] = "accounts.google.com"
+	alt["aud"] = []string{"other", testAudience}
+	alt["email"] = strings.ToUpper(testEmail)
+	if _, err := verifier.Verify(context.Background(), sign(t, testKey, "key-1", "RS256", alt)); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestVerify_Rejects(t *testing.T) {
+	verifier := testVerifier(t)
+
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"wrong audience", sign(t, testKey, "key-1", "RS256", with("aud", "https://elsewhere.example.com")), "unexpected audience"},
+		{"wrong issuer", sign(t, testKey, "key-1", "RS256", with("iss", "https://evil.example.com")), "unexpected issuer"},
+		{"expired", sign(t, testKey, "key-1", "RS256", with("exp", time.Now().Add(-time.Hour).Unix())), "expired"},
+		{"no expiry", sign(t, testKey, "key-1", "RS256", with("exp", nil)), "expired"},
+		{"issued in the future", sign(t, testKey, "key-1", "RS256", with("iat", time.Now().Add(time.Hour).Unix())), "before issued"},
+		{"email not allowed", sign(t, testKey, "key-1", "RS256", with("email", "someone@else.iam.gserviceaccount.com")), "not allowed"},
+		{"email not verified", sign(t, testKey, "key-1", "RS256", with("email_verified", false)), "not allowed"},
+		{"wrong signing key", sign(t, otherKey, "key-1", "RS256", validClaims()), "invalid token signature"},
+		{"unknown key id", sign(t, testKey, "key-2", "RS256", validClaims()), "unknown signing key"},
+		{"unsupported algorithm", sign(t, testKey, "key-1", "RS512", validClaims()), "unsupported signing algorithm"},
+		{"malformed", "not-a-token", "malformed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifier.Verify(context.Background(), tt.token)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Verify() error = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("tampered claims", func(t *testing.T) {
+		parts := strings.Split(sign(t, testKey, "key-1", "RS256", validClaims()), ".")
+		payload, _ := json.Marshal(with("email", "attacker@evil.iam.gserviceaccount.com"))
+		parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+		if _, err := verifier.Verify(context.Background(), strings.Join(parts, ".")); err == nil {
+			t.Error("Expected a tampered token to be rejected")
+		}
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	verifier := testVerifier(t)
+	called := false
+	handler := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if claims := ClaimsFromContext(r.Context()); claims == nil || claims.Email != testEmail {
+			t.Errorf("Expected the claims of the token in the request context, got %+v", claims)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"valid token", "Bearer " + sign(t, testKey, "key-1", "RS256", validClaims()), http.StatusOK},
+		{"missing header", "", http.StatusUnauthorized},
+		{"not a bearer token", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"invalid token", "Bearer " + sign(t, otherKey, "key-1", "RS256", validClaims()), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			req := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("{}"))
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if called != (tt.want == http.StatusOK) {
+				t.Errorf("next handler called = %v", called)
+			}
+		})
+	}
+}
+
+func TestRemoteJWKS(t *testing.T) {
+	keys := map[string]*rsa.PrivateKey{"key-1": testKey}
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(jwks(keys))
+	}))
+	defer server.Close()
+
+	remote := NewRemoteJWKS(server.URL)
+	remote.minRefresh = 0
+	ctx := context.Background()
+
+	if _, err := remote.Key(ctx, "key-1"); err != nil {
+		t.Fatalf("Key() error = %v", err)
+	}
+	if _, err := remote.Key(ctx, "key-1"); err != nil {
+		t.Fatalf("Key() error = %v", err)
+	}
+	if fetches != 1 {
+		t.Errorf("Expected known keys to be cached, got %d fetches", fetches)
+	}
+
+	// a rotated key is picked up by refetching
+	keys["key-2"] = otherKey
+	if _, err := remote.Key(ctx, "key-2"); err != nil {
+		t.Fatalf("Key() error after rotation = %v", err)
+	}
+	if fetches != 2 {
+		t.Errorf("Expected a refetch for an unknown key, got %d fetches", fetches)
+	}
+
+	if _, err := remote.Key(ctx, "key-3"); err == nil {
+		t.Error("Expected an error for a key missing from the endpoint")
+	}
+}
+
+func TestNewVerifierFromConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks(map[string]*rsa.PrivateKey{"key-1": testKey}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		PushAuthIssuers:       "https://accounts.google.com, accounts.google.com",
+		PushAuthAudience:      testAudience,
+		PushAuthAllowedEmails: fmt.Sprintf("other@example.com, %s", testEmail),
+		PushAuthJWKSFile:      path,
+	}
+
+	verifier, err := NewVerifierFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewVerifierFromConfig() error = %v", err)
+	}
+	if _, err := verifier.Verify(context.Background(), sign(t, testKey, "key-1", "RS256", validClaims())); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	cfg.PushAuthAudience = ""
+	if _, err := NewVerifierFromConfig(cfg); err == nil {
+		t.Error("Expected an error without an audience")
+	}
+}
+
+func TestNewAdminVerifierFromConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks(map[string]*rsa.PrivateKey{"key-1": testKey}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		PushAuthIssuers:    "https://accounts.google.com",
+		PushAuthJWKSFile:   path,
+		AdminAuthAudience:  testAudience,
+		AdminAllowedEmails: "other@example.com",
+	}
+
+	verifier, err := NewAdminVerifierFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewAdminVerifierFromConfig() error = %v", err)
+	}
+	// the push service account isn't an operator
+	if _, err := verifier.Verify(context.Background(), sign(t, testKey, "key-1", "RS256", validClaims())); err == nil {
+		t.Error("Expected a token of an email that isn't allowed to be rejected")
+	}
+
+	cfg.AdminAllowedEmails = testEmail
+	verifier, _ = NewAdminVerifierFromConfig(cfg)
+	if _, err := verifier.Verify(context.Background(), sign(t, testKey, "key-1", "RS256", validClaims())); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	cfg.AdminAllowedEmails = ""
+	if _, err := NewAdminVerifierFromConfig(cfg); err == nil {
+		t.Error("Expected an error without allowed emails")
+	}
+}
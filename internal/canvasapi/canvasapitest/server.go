@@ -0,0 +1,156 @@
+// Package canvasapitest provides an in-memory canvas-api for tests.
+package canvasapitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
+)
+
+// Update is a package update the fake server applied.
+type Update struct {
+	ProjectID      string
+	PackageID      string
+	IdempotencyKey string
+	// W3C trace context the update was sent with
+	TraceParent string
+	Payload     canvasapi.OutputPayloadBody
+}
+
+// Server records package updates and serves package outputs. Like the real
+// API it applies an update once per idempotency key.
+type Server struct {
+	*httptest.Server
+	// token expected in x-canvas-token, any token is accepted when empty
+	Token string
+
+	mu       sync.Mutex
+	attempts int
+	updates  []Update
+	seen     map[string]bool
+	packages map[string]canvasapi.Package
+	failures []int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		seen:     make(map[string]bool),
+		packages: make(map[string]canvasapi.Package),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PATCH /provisioner/projects/{project}/packages/{package}", s.handleUpdate)
+	mux.HandleFunc("GET /provisioner/projects/{project}/packages/{package}", s.handleGet)
+	s.Server = httptest.NewServer(s.authenticate(mux))
+	return s
+}
+
+func key(projectID, packageID string) string {
+	return projectID + "/" + packageID
+}
+
+// FailNext makes the next requests fail with the given status codes, in order.
+func (s *Server) FailNext(statusCodes ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statusCodes...)
+}
+
+// SetPackage sets the record returned for a package.
+func (s *Server) SetPackage(projectID, packageID string, pkg canvasapi.Package) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packages[key(projectID, packageID)] = pkg
+}
+
+// Package returns the current record of a package.
+func (s *Server) Package(projectID, packageID string) (canvasapi.Package, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pkg, ok := s.packages[key(projectID, packageID)]
+	return pkg, ok
+}
+
+// Updates returns the updates applied so far, oldest first.
+func (s *Server) Updates() []Update {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Update(nil), s.updates...)
+}
+
+// Attempts returns the number of requests received, including failed and
+// duplicate ones.
+func (s *Server) Attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.attempts++
+		var status int
+		if len(s.failures) > 0 {
+			status, s.failures = s.failures[0], s.failures[1:]
+		}
+		s.mu.Unlock()
+
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if s.Token != "" && r.Header.Get("x-canvas-token") != s.Token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	var payload canvasapi.OutputPayloadBody
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	projectID, packageID := r.PathValue("project"), r.PathValue("package")
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idempotencyKey != "" && s.seen[idempotencyKey] {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	s.seen[idempotencyKey] = idempotencyKey != ""
+	s.updates = append(s.updates, Update{
+		ProjectID:      projectID,
+		PackageID:      packageID,
+		IdempotencyKey: idempotencyKey,
+		TraceParent:    r.Header.Get("traceparent"),
+		Payload:        payload,
+	})
+
+	pkg := s.packages[key(projectID, packageID)]
+	if payload.DeployStatus != nil {
+		pkg.DeployStatus = *payload.DeployStatus
+	}
+	if payload.OutputData != nil {
+		pkg.OutputData = payload.OutputData
+	}
+	s.packages[key(projectID, packageID)] = pkg
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	pkg, ok := s.Package(r.PathValue("project"), r.PathValue("package"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pkg)
+}
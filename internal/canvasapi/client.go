@@ -0,0 +1,205 @@
+package canvasapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrNotFound is returned when canvas-api has no record of a package.
+var ErrNotFound = errors.New("not found")
+
+// StatusError is returned for non 2xx responses.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API request failed with status code: %d", e.StatusCode)
+}
+
+// Retryable reports whether a failed attempt is worth repeating: network
+// errors, timeouts included, and server errors are, anything the API rejected
+// is not. Whether the caller still wants an answer is up to its context.
+func Retryable(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+// IdempotencyKey identifies a single status transition of a run, so a retried
+// update is applied once.
+func IdempotencyKey(runID string, status string) string {
+	return runID + ":" + status
+}
+
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	// attempts after the first one
+	maxRetries int
+	// wait before the first retry, doubled for each one after it
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+func NewClient(baseURL, token string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    baseURL,
+		token:      token,
+		http:       newHTTPClient(30 * time.Second),
+		maxRetries: 4,
+		backoff:    500 * time.Millisecond,
+		maxBackoff: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func NewClientFromConfig(cfg *config.Config) *Client {
+	opts := []Option{WithRetries(cfg.APIMaxRetries, 500*time.Millisecond)}
+	if cfg.APITimeoutSeconds > 0 {
+		opts = append(opts, WithHTTPClient(newHTTPClient(time.Duration(cfg.APITimeoutSeconds)*time.Second)))
+	}
+	return NewClient(cfg.APIURL, cfg.CanvasToken, opts...)
+}
+
+func (c *Client) packageURL(projectID, packageID string) string {
+	return fmt.Sprintf("%s/provisioner/projects/%s/packages/%s", c.baseURL, projectID, packageID)
+}
+
+// UpdatePackage patches the state of a package. Updates sharing an
+// idempotency key are applied once by the API, an empty key sends none.
+func (c *Client) UpdatePackage(ctx context.Context, projectID, packageID string, payload OutputPayloadBody, idempotencyKey string) error {
+	if c.baseURL == "" {
+		return fmt.Errorf("API_URL environment variable is not set")
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling output data: %v", err)
+	}
+
+	headers := http.Header{"Content-Type": {"application/json"}}
+	if idempotencyKey != "" {
+		headers.Set("Idempotency-Key", idempotencyKey)
+	}
+	_, err = c.do(ctx, http.MethodPatch, c.packageURL(projectID, packageID), body, headers)
+	return err
+}
+
+// GetPackage returns the record of a package, or ErrNotFound.
+func (c *Client) GetPackage(ctx context.Context, projectID, packageID string) (*Package, error) {
+	data, err := c.do(ctx, http.MethodGet, c.packageURL(projectID, packageID), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var pkg Package
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return nil, fmt.Errorf("error decoding API response: %v", err)
+	}
+	return &pkg, nil
+}
+
+// newHTTPClient returns a client whose requests carry the trace context of
+// the caller and show up as spans of their own.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: otelhttp.NewTransport(http.DefaultTransport),
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, url string, body []byte, headers http.Header) (data []byte, err error) {
+	ctx, span := tracing.Start(ctx, "canvasapi "+method, trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		data, err = c.attempt(ctx, method, url, body, headers)
+		// a request timing out is retried, the caller giving up is not
+		if err == nil || attempt >= c.maxRetries || !Retryable(err) || ctx.Err() != nil {
+			span.SetAttributes(attribute.Int("attempts", attempt+1))
+			return data, err
+		}
+
+		logging.FromContext(ctx).Warn("API request failed, retrying", "method", method, "url", url, "retry_in", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > c.maxBackoff {
+			wait = c.maxBackoff
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, url string, body []byte, headers http.Header) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, fmt.Errorf("error creating HTTP request: %v", err)
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-canvas-token", c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+	logging.FromContext(ctx).Debug("API response", "method", method, "url", url, "status", resp.StatusCode)
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading API response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	return data, nil
+}
@@ -0,0 +1,200 @@
+package canvasapi_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi/canvasapitest"
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
+)
+
+func newClient(server *canvasapitest.Server, maxRetries int) *canvasapi.Client {
+	return canvasapi.NewClient(server.URL, "token", canvasapi.WithRetries(maxRetries, time.Millisecond))
+}
+
+func deployed() canvasapi.OutputPayloadBody {
+	status := "DEPLOYED"
+	return canvasapi.OutputPayloadBody{
+		DeployStatus: &status,
+		OutputData:   map[string]interface{}{"host": "10.0.0.1"},
+	}
+}
+
+func TestClient_UpdatePackage(t *testing.T) {
+	server := canvasapitest.NewServer()
+	server.Token = "token"
+	defer server.Close()
+
+	if err := newClient(server, 0).UpdatePackage(context.Background(), "p", "pkg", deployed(), "run-1:DEPLOYED"); err != nil {
+		t.Fatalf("UpdatePackage() error = %v", err)
+	}
+
+	pkg, ok := server.Package("p", "pkg")
+	if !ok || pkg.DeployStatus != "DEPLOYED" || pkg.OutputData["host"] != "10.0.0.1" {
+		t.Errorf("Unexpected package record %+v", pkg)
+	}
+	if updates := server.Updates(); len(updates) != 1 || updates[0].IdempotencyKey != "run-1:DEPLOYED" {
+		t.Errorf("Unexpected updates %+v", updates)
+	}
+}
+
+func TestClient_PropagatesTraceContext(t *testing.T) {
+	exporter, restore := tracing.UseInMemory()
+	defer restore()
+	server := canvasapitest.NewServer()
+	defer server.Close()
+
+	ctx, span := tracing.Start(context.Background(), "DeployPackage")
+	if err := newClient(server, 0).UpdatePackage(ctx, "p", "pkg", deployed(), "run-1:DEPLOYED"); err != nil {
+		t.Fatalf("UpdatePackage() error = %v", err)
+	}
+	span.End()
+
+	updates := server.Updates()
+	if len(updates) != 1 || !strings.Contains(updates[0].TraceParent, span.SpanContext().TraceID().String()) {
+		t.Errorf("Expected the request to carry the caller's trace, got %+v", updates)
+	}
+	var names []string
+	for _, s := range exporter.GetSpans() {
+		names = append(names, s.Name)
+	}
+	if len(names) < 2 || !slices.Contains(names, "canvasapi PATCH") {
+		t.Errorf("Expected spans for the API call, got %v", names)
+	}
+}
+
+func TestClient_RetriesServerErrors(t *testing.T) {
+	server := canvasapitest.NewServer()
+	defer server.Close()
+	server.FailNext(http.StatusBadGateway, http.StatusServiceUnavailable)
+
+	if err := newClient(server, 3).UpdatePackage(context.Background(), "p", "pkg", deployed(), "run-1:DEPLOYED"); err != nil {
+		t.Fatalf("UpdatePackage() error = %v", err)
+	}
+	if server.Attempts() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", server.Attempts())
+	}
+	if len(server.Updates()) != 1 {
+		t.Errorf("Expected the update to be applied once, got %+v", server.Updates())
+	}
+}
+
+func TestClient_GivesUp(t *testing.T) {
+	server := canvasapitest.NewServer()
+	defer server.Close()
+	server.FailNext(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+
+	err := newClient(server, 2).UpdatePackage(context.Background(), "p", "pkg", deployed(), "")
+	var statusErr *canvasapi.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("UpdatePackage() error = %v, want a 500 StatusError", err)
+	}
+	if server.Attempts() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", server.Attempts())
+	}
+}
+
+func TestClient_DoesNotRetryClientErrors(t *testing.T) {
+	server := canvasapitest.NewServer()
+	server.Token = "expected"
+	defer server.Close()
+
+	err := newClient(server, 3).UpdatePackage(context.Background(), "p", "pkg", deployed(), "")
+	var statusErr *canvasapi.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("UpdatePackage() error = %v, want a 401 StatusError", err)
+	}
+	if server.Attempts() != 1 {
+		t.Errorf("Expected a single attempt, got %d", server.Attempts())
+	}
+}
+
+func TestClient_RetriesNetworkErrors(t *testing.T) {
+	server := canvasapitest.NewServer()
+	url := server.URL
+	server.Close()
+
+	client := canvasapi.NewClient(url, "token", canvasapi.WithRetries(2, time.Millisecond))
+	if err := client.UpdatePackage(context.Background(), "p", "pkg", deployed(), ""); err == nil {
+		t.Error("Expected an error from a closed server")
+	}
+}
+
+func TestClient_RetriesTimeouts(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// canvas-api hangs on the first request
+		if attempts.Add(1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	client := canvasapi.NewClient(server.URL, "token",
+		canvasapi.WithHTTPClient(&http.Client{Timeout: 50 * time.Millisecond}),
+		canvasapi.WithRetries(2, time.Millisecond))
+	if err := client.UpdatePackage(context.Background(), "p", "pkg", deployed(), ""); err != nil {
+		t.Fatalf("UpdatePackage() error = %v", err)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("Expected the timed out request to be retried, got %d attempts", attempts.Load())
+	}
+}
+
+func TestClient_IdempotentRetries(t *testing.T) {
+	server := canvasapitest.NewServer()
+	defer server.Close()
+	client := newClient(server, 0)
+
+	// the first update went through but its response was lost, the caller
+	// sends it again with the same key
+	for i := 0; i < 2; i++ {
+		if err := client.UpdatePackage(context.Background(), "p", "pkg", deployed(), canvasapi.IdempotencyKey("run-1", "DEPLOYED")); err != nil {
+			t.Fatalf("UpdatePackage() error = %v", err)
+		}
+	}
+	if len(server.Updates()) != 1 {
+		t.Errorf("Expected one applied update, got %+v", server.Updates())
+	}
+}
+
+func TestClient_GetPackage(t *testing.T) {
+	server := canvasapitest.NewServer()
+	defer server.Close()
+	server.SetPackage("p", "pkg", canvasapi.Package{OutputData: map[string]interface{}{"host": "10.0.0.1"}})
+	client := canvasapi.NewClientFromConfig(&config.Config{APIURL: server.URL})
+
+	pkg, err := client.GetPackage(context.Background(), "p", "pkg")
+	if err != nil {
+		t.Fatalf("GetPackage() error = %v", err)
+	}
+	if pkg.OutputData["host"] != "10.0.0.1" {
+		t.Errorf("Unexpected package %+v", pkg)
+	}
+
+	if _, err := client.GetPackage(context.Background(), "p", "missing"); !errors.Is(err, canvasapi.ErrNotFound) {
+		t.Errorf("GetPackage() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClient_StopsOnCancel(t *testing.T) {
+	server := canvasapitest.NewServer()
+	defer server.Close()
+	server.FailNext(http.StatusInternalServerError)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client := canvasapi.NewClient(server.URL, "token", canvasapi.WithRetries(5, time.Hour))
+	if err := client.UpdatePackage(ctx, "p", "pkg", deployed(), ""); err == nil {
+		t.Error("Expected an error for a cancelled context")
+	}
+}
@@ -0,0 +1,24 @@
+package canvasapi
+
+import "github.com/radiatus-ai/package-provisioner/pkg/models"
+
+// OutputPayloadBody is the update sent to canvas-api when a package changes
+// state.
+type OutputPayloadBody struct {
+	DeployStatus *string                `json:"deploy_status,omitempty"`
+	OutputData   map[string]interface{} `json:"output_data,omitempty"`
+	// keys whose value was discarded when merging parameters and connected inputs
+	OverriddenKeys []string `json:"overridden_keys,omitempty"`
+	// output keys the UI should mask
+	SensitiveKeys []string `json:"sensitive_keys,omitempty"`
+	// the status change this update reports
+	Transition *models.StatusTransition `json:"transition,omitempty"`
+	// errors and logs are added to the output data, which we will add a struct for shortly
+	// ErrorMessage string                 `json:"error_message,omitempty"`
+}
+
+// Package is what canvas-api has on record for a package.
+type Package struct {
+	DeployStatus string                 `json:"deploy_status,omitempty"`
+	OutputData   map[string]interface{} `json:"output_data,omitempty"`
+}
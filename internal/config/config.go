@@ -1,34 +1,274 @@
 package config
 
 import (
+	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
 )
 
 type Config struct {
-	APIURL               string
-	CanvasToken          string
+	APIURL            string
+	CanvasToken       string
+	APITimeoutSeconds int
+	// retries of a failed API request, with exponential backoff
+	APIMaxRetries        int
 	ProjectID            string
 	SubscriptionID       string
 	BucketName           string
 	TerraformModulesPath string
+	// where terraform keeps state: gcs, in BucketName, or local, under
+	// LocalStatePath
+	TerraformBackend string
+	LocalStatePath   string
+	HistoryPath      string
+	// where status updates wait until they are delivered. This, HistoryPath,
+	// RunLogPath, DedupPath and DeadLetterPath must be on a persistent volume
+	// in production, a restart loses whatever they hold otherwise
+	OutboxPath         string
+	OutboxRetrySeconds int
+	// how status updates are delivered: http, pubsub, webhook or log
+	ReportTransport  string
+	ReportTopicID    string
+	ReportWebhookURL string
+	// base64 HMAC key webhook bodies are signed with
+	ReportWebhookSecret string
+	// JSON list of outbound notification hooks, notifications are disabled
+	// when empty
+	NotifyHooksFile string
+	// JSON lines log of notification deliveries
+	NotifyDeliveryLog string
+	NotifyMaxAttempts int
+	// where messages that can't be processed go: file, pubsub or empty to
+	// drop them. Both keep the payload as received, secrets in plain unless
+	// messages are enveloped, see RequireEncryptedMessages
+	DeadLetterSink    string
+	DeadLetterPath    string
+	DeadLetterTopicID string
+	// times a message that fails to deploy is tried before it is
+	// dead-lettered, a little longer apart each time
+	DeadLetterMaxAttempts int
+	MessageRetrySeconds   int
+	// where the messages processed recently are remembered, and the ones in
+	// progress kept to resume after a restart. Empty disables both
+	DedupPath       string
+	DedupTTLSeconds int
+	// topic redeploy requests for downstream packages are published to,
+	// propagation is disabled when empty
+	PropagationTopicID  string
+	MaxPropagationDepth int
+	// how sensitive outputs are sent to the API: plain or encrypt
+	SensitiveOutputMode string
+	// base64 AES key used in encrypt mode
+	SensitiveOutputKey string
+	// reject plaintext values in DeploymentMessage.Secrets
+	RequireSecretReferences bool
+	VaultAddr               string
+	VaultToken              string
+	// resolve env:// and file:// references from the provisioner's own
+	// environment and files, for development and tests only
+	LocalSecretProviders bool
+	// how secrets reach terraform: file, env or tmpfs
+	SecretsMode     string
+	SecretsTmpfsDir string
+	// kms used to open encrypted messages: local, gcp or empty to disable
+	MessageKMS string
+	// id:base64key pairs for the local kms
+	MessageEncryptionKeys    string
+	RequireEncryptedMessages bool
+	// verify the OIDC token Pub/Sub push attaches to /push requests
+	PushAuthEnabled bool
+	// comma separated
+	PushAuthIssuers       string
+	PushAuthAudience      string
+	PushAuthAllowedEmails string
+	PushAuthJWKSURL       string
+	// static JWKS used instead of PushAuthJWKSURL when set
+	PushAuthJWKSFile string
+	// serve the admin API under /admin/, for the identity tokens of
+	// AdminAllowedEmails
+	AdminEnabled       bool
+	AdminAuthAudience  string
+	AdminAllowedEmails string
+	// where spans are exported: none, otlp or stdout
+	TracingExporter string
+	// fraction of traces started here that are sampled
+	TracingSampleRatio float64
+	// debug, info, warning or error
+	LogLevel string
+	// json, in the Cloud Logging format, or text
+	LogFormat string
+	// root of the package workspaces
+	WorkspacePath string
+	// where the log of each run is kept, empty disables run logs
+	RunLogPath string
+	// /readyz fails with less free space in WorkspacePath
+	HealthMinFreeMB int
+	// /readyz fails once the status worker hasn't run for this long
+	HealthWorkerStaleSeconds int
+	// probe BucketName from /readyz
+	HealthCheckBucket bool
+	// how long messages in progress get to finish once asked to stop, keep
+	// it under the termination grace period of the pod, 600s in
+	// k8s/deployment.yaml, with room left to flush the outbox and traces
+	ShutdownTimeoutSeconds int
 }
 
 func Load() (*Config, error) {
 	cfg := &Config{
-		APIURL:               getEnvOrDefault("API_URL", "https://canvas-api.dev.r7ai.net"),
-		CanvasToken:          getEnvOrDefault("CANVAS_TOKEN", "foobar"),
-		ProjectID:            getEnvOrDefault("GOOGLE_CLOUD_PROJECT", "rad-dev-dev"),
-		SubscriptionID:       getEnvOrDefault("PUBSUB_SUBSCRIPTION_ID", "provisioner"),
-		BucketName:           getEnvOrDefault("BUCKET_NAME", "rad-provisioner-state-1234"),
-		TerraformModulesPath: getEnvOrDefault("TERRAFORM_MODULES_PATH", "/mnt/canvas-packages"),
+		APIURL:                getEnvOrDefault("API_URL", "https://canvas-api.dev.r7ai.net"),
+		CanvasToken:           getEnvOrDefault("CANVAS_TOKEN", "foobar"),
+		ProjectID:             getEnvOrDefault("GOOGLE_CLOUD_PROJECT", "rad-dev-dev"),
+		SubscriptionID:        getEnvOrDefault("PUBSUB_SUBSCRIPTION_ID", "provisioner"),
+		BucketName:            getEnvOrDefault("BUCKET_NAME", "rad-provisioner-state-1234"),
+		TerraformModulesPath:  getEnvOrDefault("TERRAFORM_MODULES_PATH", "/mnt/canvas-packages"),
+		TerraformBackend:      getEnvOrDefault("TERRAFORM_BACKEND", "gcs"),
+		LocalStatePath:        getEnvOrDefault("LOCAL_STATE_PATH", "state"),
+		HistoryPath:           getEnvOrDefault("HISTORY_PATH", "history"),
+		OutboxPath:            getEnvOrDefault("OUTBOX_PATH", "outbox"),
+		ReportTransport:       getEnvOrDefault("REPORT_TRANSPORT", "http"),
+		ReportTopicID:         getEnvOrDefault("REPORT_TOPIC_ID", ""),
+		ReportWebhookURL:      getEnvOrDefault("REPORT_WEBHOOK_URL", ""),
+		ReportWebhookSecret:   getEnvOrDefault("REPORT_WEBHOOK_SECRET", ""),
+		NotifyHooksFile:       getEnvOrDefault("NOTIFY_HOOKS_FILE", ""),
+		NotifyDeliveryLog:     getEnvOrDefault("NOTIFY_DELIVERY_LOG", "notify-deliveries.jsonl"),
+		DeadLetterSink:        getEnvOrDefault("DEAD_LETTER_SINK", "file"),
+		DeadLetterPath:        getEnvOrDefault("DEAD_LETTER_PATH", "dead-letters"),
+		DeadLetterTopicID:     getEnvOrDefault("DEAD_LETTER_TOPIC_ID", ""),
+		DedupPath:             getEnvOrDefault("DEDUP_PATH", "dedup"),
+		PropagationTopicID:    getEnvOrDefault("PROPAGATION_TOPIC_ID", ""),
+		SensitiveOutputMode:   getEnvOrDefault("SENSITIVE_OUTPUT_MODE", "plain"),
+		SensitiveOutputKey:    getEnvOrDefault("SENSITIVE_OUTPUT_KEY", ""),
+		VaultAddr:             getEnvOrDefault("VAULT_ADDR", ""),
+		VaultToken:            getEnvOrDefault("VAULT_TOKEN", ""),
+		SecretsMode:           getEnvOrDefault("SECRETS_MODE", "file"),
+		SecretsTmpfsDir:       getEnvOrDefault("SECRETS_TMPFS_DIR", "/dev/shm"),
+		MessageKMS:            getEnvOrDefault("MESSAGE_KMS", ""),
+		MessageEncryptionKeys: getEnvOrDefault("MESSAGE_ENCRYPTION_KEYS", ""),
+		PushAuthIssuers:       getEnvOrDefault("PUSH_AUTH_ISSUERS", "https://accounts.google.com,accounts.google.com"),
+		PushAuthAudience:      getEnvOrDefault("PUSH_AUTH_AUDIENCE", ""),
+		PushAuthAllowedEmails: getEnvOrDefault("PUSH_AUTH_ALLOWED_EMAILS", ""),
+		PushAuthJWKSURL:       getEnvOrDefault("PUSH_AUTH_JWKS_URL", "https://www.googleapis.com/oauth2/v3/certs"),
+		PushAuthJWKSFile:      getEnvOrDefault("PUSH_AUTH_JWKS_FILE", ""),
+		AdminAuthAudience:     getEnvOrDefault("ADMIN_AUTH_AUDIENCE", ""),
+		AdminAllowedEmails:    getEnvOrDefault("ADMIN_ALLOWED_EMAILS", ""),
+		TracingExporter:       getEnvOrDefault("TRACING_EXPORTER", "none"),
+		LogLevel:              getEnvOrDefault("LOG_LEVEL", "info"),
+		LogFormat:             getEnvOrDefault("LOG_FORMAT", "json"),
+		WorkspacePath:         getEnvOrDefault("WORKSPACE_PATH", "deployments"),
+		RunLogPath:            getEnvOrDefault("RUN_LOG_PATH", "run-logs"),
+	}
+
+	var err error
+	if cfg.APITimeoutSeconds, err = getEnvIntOrDefault("API_TIMEOUT_SECONDS", 30); err != nil {
+		return nil, err
+	}
+	if cfg.APIMaxRetries, err = getEnvIntOrDefault("API_MAX_RETRIES", 4); err != nil {
+		return nil, err
+	}
+	if cfg.OutboxRetrySeconds, err = getEnvIntOrDefault("OUTBOX_RETRY_SECONDS", 10); err != nil {
+		return nil, err
+	}
+	if cfg.DedupTTLSeconds, err = getEnvIntOrDefault("DEDUP_TTL_SECONDS", 24*60*60); err != nil {
+		return nil, err
+	}
+	if cfg.DeadLetterMaxAttempts, err = getEnvIntOrDefault("DEAD_LETTER_MAX_ATTEMPTS", 3); err != nil {
+		return nil, err
+	}
+	if cfg.MessageRetrySeconds, err = getEnvIntOrDefault("MESSAGE_RETRY_SECONDS", 60); err != nil {
+		return nil, err
+	}
+	if cfg.NotifyMaxAttempts, err = getEnvIntOrDefault("NOTIFY_MAX_ATTEMPTS", 5); err != nil {
+		return nil, err
+	}
+	if cfg.MaxPropagationDepth, err = getEnvIntOrDefault("MAX_PROPAGATION_DEPTH", 5); err != nil {
+		return nil, err
+	}
+	if cfg.RequireSecretReferences, err = getEnvBoolOrDefault("REQUIRE_SECRET_REFERENCES", false); err != nil {
+		return nil, err
+	}
+	if cfg.LocalSecretProviders, err = getEnvBoolOrDefault("LOCAL_SECRET_PROVIDERS", false); err != nil {
+		return nil, err
+	}
+	if cfg.RequireEncryptedMessages, err = getEnvBoolOrDefault("REQUIRE_ENCRYPTED_MESSAGES", false); err != nil {
+		return nil, err
+	}
+	if cfg.PushAuthEnabled, err = getEnvBoolOrDefault("PUSH_AUTH_ENABLED", false); err != nil {
+		return nil, err
+	}
+	if cfg.AdminEnabled, err = getEnvBoolOrDefault("ADMIN_ENABLED", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.HealthMinFreeMB, err = getEnvIntOrDefault("HEALTH_MIN_FREE_MB", 512); err != nil {
+		return nil, err
+	}
+	if cfg.HealthWorkerStaleSeconds, err = getEnvIntOrDefault("HEALTH_WORKER_STALE_SECONDS", 300); err != nil {
+		return nil, err
+	}
+	if cfg.HealthCheckBucket, err = getEnvBoolOrDefault("HEALTH_CHECK_BUCKET", true); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownTimeoutSeconds, err = getEnvIntOrDefault("SHUTDOWN_TIMEOUT_SECONDS", 540); err != nil {
+		return nil, err
+	}
+
+	if cfg.TracingSampleRatio, err = getEnvFloatOrDefault("TRACING_SAMPLE_RATIO", 1); err != nil {
+		return nil, err
 	}
 
 	return cfg, nil
 }
 
+// LogValue logs the configuration with its credentials and keys masked.
+func (c Config) LogValue() slog.Value {
+	for _, secret := range []*string{&c.CanvasToken, &c.ReportWebhookSecret, &c.SensitiveOutputKey, &c.VaultToken, &c.MessageEncryptionKeys} {
+		if *secret != "" {
+			*secret = "********"
+		}
+	}
+	return slog.StringValue(fmt.Sprintf("%+v", c))
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+func getEnvIntOrDefault(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	return i, nil
+}
+
+func getEnvBoolOrDefault(key string, defaultValue bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	return b, nil
+}
+
+func getEnvFloatOrDefault(key string, defaultValue float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestConfig_LogValue(t *testing.T) {
+	cfg := &Config{
+		APIURL:                "https://canvas-api.example.com",
+		CanvasToken:           "canvas-token",
+		ReportWebhookSecret:   "webhook-secret",
+		SensitiveOutputKey:    "aes-key",
+		VaultToken:            "vault-token",
+		MessageEncryptionKeys: "dev:message-key",
+	}
+	var logs bytes.Buffer
+	slog.New(slog.NewTextHandler(&logs, nil)).Info("Configuration loaded successfully", "config", cfg)
+
+	for _, secret := range []string{"canvas-token", "webhook-secret", "aes-key", "vault-token", "message-key"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("Expected %s to be masked, got %s", secret, logs.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "https://canvas-api.example.com") {
+		t.Errorf("Expected the rest of the configuration, got %s", logs.String())
+	}
+	if cfg.CanvasToken != "canvas-token" {
+		t.Error("Expected the configuration itself to be left alone")
+	}
+}
@@ -0,0 +1,188 @@
+package connections
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+// OutputSource looks up the last known outputs of a package. It returns nil
+// outputs without an error when the package has none recorded.
+type OutputSource interface {
+	Outputs(ctx context.Context, projectID, packageID string) (map[string]interface{}, error)
+}
+
+// HistorySource reads outputs from the provisioner's own run history.
+type HistorySource struct {
+	store    history.Store
+	revealer Revealer
+}
+
+func NewHistorySource(store history.Store, revealer Revealer) *HistorySource {
+	return &HistorySource{store: store, revealer: revealer}
+}
+
+func (s *HistorySource) Outputs(ctx context.Context, projectID, packageID string) (map[string]interface{}, error) {
+	run, err := s.store.LastDeployed(packageID)
+	if err != nil || run == nil {
+		return nil, err
+	}
+	if run.ProjectID != projectID {
+		return nil, nil
+	}
+	// runs are recorded with their sensitive outputs protected
+	return reveal(s.revealer, run.Outputs)
+}
+
+// Revealer turns a protected sensitive output back into its value.
+type Revealer interface {
+	Reveal(value interface{}) (interface{}, error)
+}
+
+// APISource reads the outputs canvas-api has on record for a package.
+type APISource struct {
+	api      *canvasapi.Client
+	revealer Revealer
+}
+
+func NewAPISource(cfg *config.Config, revealer Revealer) *APISource {
+	return &APISource{
+		api:      canvasapi.NewClientFromConfig(cfg),
+		revealer: revealer,
+	}
+}
+
+func (s *APISource) Outputs(ctx context.Context, projectID, packageID string) (map[string]interface{}, error) {
+	pkg, err := s.api.GetPackage(ctx, projectID, packageID)
+	if errors.Is(err, canvasapi.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// sensitive outputs may have been encrypted before they were sent
+	return reveal(s.revealer, pkg.OutputData)
+}
+
+// reveal returns outputs with the values Protect encrypted decrypted.
+func reveal(revealer Revealer, outputs map[string]interface{}) (map[string]interface{}, error) {
+	if revealer == nil || outputs == nil {
+		return outputs, nil
+	}
+	revealed := make(map[string]interface{}, len(outputs))
+	for k, v := range outputs {
+		value, err := revealer.Reveal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reveal output %s: %v", k, err)
+		}
+		revealed[k] = value
+	}
+	return revealed, nil
+}
+
+// ChainSource asks each source in turn and returns the first outputs found.
+type ChainSource []OutputSource
+
+func (c ChainSource) Outputs(ctx context.Context, projectID, packageID string) (map[string]interface{}, error) {
+	for _, source := range c {
+		outputs, err := source.Outputs(ctx, projectID, packageID)
+		if err != nil {
+			return nil, err
+		}
+		if outputs != nil {
+			return outputs, nil
+		}
+	}
+	return nil, nil
+}
+
+type Resolver struct {
+	source OutputSource
+}
+
+func NewResolver(source OutputSource) *Resolver {
+	return &Resolver{source: source}
+}
+
+// Resolve builds the connected input data for a message from the recorded
+// outputs of its upstream packages. Inputs are keyed by connection name when
+// the package namespaces its connections and flattened otherwise. A destroy
+// skips connections to upstream packages that have no outputs recorded.
+func (r *Resolver) Resolve(ctx context.Context, msg models.DeploymentMessage) (map[string]interface{}, error) {
+	resolved := make(map[string]interface{})
+	providedBy := make(map[string]string)
+
+	for _, conn := range msg.Connections {
+		name := conn.Name
+		if name == "" {
+			name = conn.SourcePackageID
+		}
+		if conn.SourcePackageID == "" {
+			return nil, fmt.Errorf("connection %q has no source package", name)
+		}
+
+		outputs, err := r.source.Outputs(ctx, msg.ProjectID, conn.SourcePackageID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch outputs of package %s: %v", conn.SourcePackageID, err)
+		}
+		if outputs == nil {
+			// an upstream package destroyed first has no outputs left, the
+			// inputs the message carries are all a destroy can go on
+			if msg.Action == models.ActionDestroy {
+				logging.FromContext(ctx).Warn("Skipping connection without recorded outputs", "connection", name, "source_package_id", conn.SourcePackageID)
+				continue
+			}
+			return nil, fmt.Errorf("no recorded outputs for upstream package %s", conn.SourcePackageID)
+		}
+
+		inputs, err := mapOutputs(conn, outputs)
+		if err != nil {
+			return nil, err
+		}
+		logging.FromContext(ctx).Info("Resolved connection", "connection", name, "source_package_id", conn.SourcePackageID, "inputs", len(inputs))
+
+		if msg.Package.NamespaceConnections {
+			if _, ok := resolved[name]; ok {
+				return nil, fmt.Errorf("duplicate connection name: %s", name)
+			}
+			resolved[name] = inputs
+			continue
+		}
+
+		for k, v := range inputs {
+			if other, ok := providedBy[k]; ok {
+				return nil, fmt.Errorf("input %s is provided by both connection %s and %s", k, other, name)
+			}
+			providedBy[k] = name
+			resolved[k] = v
+		}
+	}
+
+	return resolved, nil
+}
+
+func mapOutputs(conn models.Connection, outputs map[string]interface{}) (map[string]interface{}, error) {
+	inputs := make(map[string]interface{})
+	if len(conn.OutputMappings) == 0 {
+		for k, v := range outputs {
+			inputs[k] = v
+		}
+		return inputs, nil
+	}
+
+	for outputKey, inputKey := range conn.OutputMappings {
+		v, ok := outputs[outputKey]
+		if !ok {
+			return nil, fmt.Errorf("upstream package %s has no output %s", conn.SourcePackageID, outputKey)
+		}
+		inputs[inputKey] = v
+	}
+	return inputs, nil
+}
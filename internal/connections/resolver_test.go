@@ -0,0 +1,135 @@
+package connections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+type staticSource map[string]map[string]interface{}
+
+func (s staticSource) Outputs(ctx context.Context, projectID, packageID string) (map[string]interface{}, error) {
+	return s[packageID], nil
+}
+
+func TestResolver_Resolve(t *testing.T) {
+	source := staticSource{
+		"db":  {"host": "10.0.0.1", "port": 5432.0},
+		"net": {"network_id": "vpc-1"},
+	}
+
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "app",
+		Connections: []models.Connection{
+			{Name: "database", SourcePackageID: "db", OutputMappings: map[string]string{"host": "db_host"}},
+			{Name: "network", SourcePackageID: "net"},
+		},
+	}
+
+	got, err := NewResolver(source).Resolve(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	want := map[string]interface{}{"db_host": "10.0.0.1", "network_id": "vpc-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %v, want %v", got, want)
+	}
+
+	msg.Package.NamespaceConnections = true
+	got, err = NewResolver(source).Resolve(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	want = map[string]interface{}{
+		"database": map[string]interface{}{"db_host": "10.0.0.1"},
+		"network":  map[string]interface{}{"network_id": "vpc-1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() namespaced = %v, want %v", got, want)
+	}
+}
+
+func TestResolver_Resolve_Errors(t *testing.T) {
+	source := staticSource{
+		"db":      {"host": "10.0.0.1"},
+		"replica": {"host": "10.0.0.2"},
+	}
+
+	tests := []struct {
+		name        string
+		connections []models.Connection
+	}{
+		{"missing upstream", []models.Connection{{Name: "cache", SourcePackageID: "redis"}}},
+		{"missing output", []models.Connection{{SourcePackageID: "db", OutputMappings: map[string]string{"password": "db_password"}}}},
+		{"duplicate input", []models.Connection{{SourcePackageID: "db"}, {SourcePackageID: "replica"}}},
+		{"no source", []models.Connection{{Name: "orphan"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := models.DeploymentMessage{ProjectID: "test-project", Connections: tt.connections}
+			if _, err := NewResolver(source).Resolve(context.Background(), msg); err == nil {
+				t.Error("Expected Resolve() to fail")
+			}
+		})
+	}
+}
+
+func TestResolver_Resolve_DestroyWithoutUpstream(t *testing.T) {
+	msg := models.DeploymentMessage{
+		ProjectID:   "test-project",
+		Connections: []models.Connection{{Name: "cache", SourcePackageID: "redis"}},
+		Action:      models.ActionDestroy,
+	}
+	got, err := NewResolver(staticSource{}).Resolve(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Expected no inputs from a destroyed upstream, got %v", got)
+	}
+}
+
+func TestChainSource_FallsBackToAPI(t *testing.T) {
+	store := history.NewFileStore(t.TempDir())
+	run := history.NewRun(models.DeploymentMessage{ProjectID: "test-project", PackageID: "db"})
+	run.Status = models.Deployed
+	run.Outputs = map[string]interface{}{"host": "from-history"}
+	if err := store.Save(run); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Header.Get("x-canvas-token") != "token" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.URL.Path != "/provisioner/projects/test-project/packages/cache" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"output_data": {"host": "from-api"}}`))
+	}))
+	defer server.Close()
+
+	source := ChainSource{
+		NewHistorySource(store, nil),
+		NewAPISource(&config.Config{APIURL: server.URL, CanvasToken: "token"}, nil),
+	}
+
+	for packageID, want := range map[string]interface{}{"db": "from-history", "cache": "from-api", "unknown": nil} {
+		outputs, err := source.Outputs(context.Background(), "test-project", packageID)
+		if err != nil {
+			t.Fatalf("Outputs(%s) error = %v", packageID, err)
+		}
+		if outputs["host"] != want {
+			t.Errorf("Outputs(%s) host = %v, want %v", packageID, outputs["host"], want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+const (
+	// keep dead letters in DeadLetterPath, where the admin API can replay them
+	SinkFile = "file"
+	// publish dead letters to DeadLetterTopicID
+	SinkPubSub = "pubsub"
+)
+
+// Reason is why a message was dead-lettered.
+type Reason string
+
+const (
+	// the payload couldn't be opened, e.g. an envelope without a kms
+	ReasonRejected Reason = "REJECTED"
+	// the payload isn't a valid deployment message of a supported schema
+	ReasonInvalid Reason = "INVALID"
+	// the message failed to deploy
+	ReasonFailed Reason = "FAILED"
+)
+
+// Entry is a message that couldn't be processed, kept as it was received so
+// it can be replayed once whatever failed it is fixed.
+type Entry struct {
+	ID        string `json:"id"`
+	MessageID string `json:"message_id,omitempty"`
+	// the payload as received, still enveloped when it was encrypted. A plain
+	// payload holds the secrets of the message in plain.
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Reason     Reason            `json:"reason"`
+	Error      string            `json:"error"`
+	// times the message was processed, replays included
+	Attempts       int       `json:"attempts"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+}
+
+// NewEntry returns an entry for a message, identified by its message id when
+// it has one.
+func NewEntry(messageID string, data []byte, attributes map[string]string, reason Reason, err error, attempts int) Entry {
+	id := messageID
+	if !models.ValidID(id) {
+		id = uuid.NewString()
+	}
+	return Entry{
+		ID:             id,
+		MessageID:      messageID,
+		Data:           data,
+		Attributes:     attributes,
+		Reason:         reason,
+		Error:          err.Error(),
+		Attempts:       attempts,
+		DeadLetteredAt: time.Now().UTC(),
+	}
+}
+
+// Sink takes the messages the subscriber gives up on.
+type Sink interface {
+	Put(ctx context.Context, entry Entry) error
+}
+
+// ErrNotFound is returned for an entry the store has no record of.
+var ErrNotFound = errors.New("dead letter not found")
+
+// NewFromConfig returns the configured sink, or nil when dead-lettering is
+// disabled. publisher is the dead letter topic, needed by the pubsub sink.
+func NewFromConfig(cfg *config.Config, publisher Publisher) (Sink, error) {
+	switch cfg.DeadLetterSink {
+	case "":
+		return nil, nil
+	case SinkFile:
+		return NewFileStore(cfg.DeadLetterPath), nil
+	case SinkPubSub:
+		if publisher == nil {
+			return nil, fmt.Errorf("DEAD_LETTER_TOPIC_ID is required for the pubsub dead letter sink")
+		}
+		return NewPubSubSink(publisher), nil
+	default:
+		return nil, fmt.Errorf("unsupported dead letter sink: %s", cfg.DeadLetterSink)
+	}
+}
+
+// FileStore keeps one JSON file per entry under root. Payloads are kept as
+// received, so the files are only readable by the provisioner, and hold the
+// secrets of any message that wasn't published enveloped in plain.
+type FileStore struct {
+	root string
+	mu   sync.Mutex
+}
+
+func NewFileStore(root string) *FileStore {
+	return &FileStore{root: root}
+}
+
+func (s *FileStore) Put(ctx context.Context, entry Entry) error {
+	if !models.ValidID(entry.ID) {
+		return fmt.Errorf("invalid dead letter id: %q", entry.ID)
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.root, 0700); err != nil {
+		return fmt.Errorf("failed to create dead letter directory: %v", err)
+	}
+	// write then rename so readers never see a partial entry
+	path := s.path(entry.ID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write dead letter: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get returns a single entry, or ErrNotFound.
+func (s *FileStore) Get(id string) (*Entry, error) {
+	if !models.ValidID(id) {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(s.path(id))
+}
+
+// List returns every entry, oldest first.
+func (s *FileStore) List() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := os.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letter directory: %v", err)
+	}
+
+	var entries []Entry
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		entry, err := s.read(filepath.Join(s.root, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeadLetteredAt.Before(entries[j].DeadLetteredAt)
+	})
+	return entries, nil
+}
+
+// Delete removes an entry, or returns ErrNotFound.
+func (s *FileStore) Delete(id string) error {
+	if !models.ValidID(id) {
+		return ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.root, id+".json")
+}
+
+func (s *FileStore) read(path string) (*Entry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letter: %v", err)
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse dead letter %s: %v", filepath.Base(path), err)
+	}
+	return &entry, nil
+}
+
+// Publisher publishes a message to a topic, pubsub.Publisher.
+type Publisher interface {
+	Publish(ctx context.Context, data []byte, attributes map[string]string) error
+}
+
+// PubSubSink publishes entries to a dead letter topic with the original
+// payload and attributes, so they can be replayed by republishing them to the
+// deployment topic. The error of an entry is cut to fit in an attribute, the
+// output of a failed terraform command usually doesn't.
+type PubSubSink struct {
+	publisher Publisher
+}
+
+func NewPubSubSink(publisher Publisher) *PubSubSink {
+	return &PubSubSink{publisher: publisher}
+}
+
+func (s *PubSubSink) Put(ctx context.Context, entry Entry) error {
+	attributes := make(map[string]string, len(entry.Attributes)+4)
+	for k, v := range entry.Attributes {
+		attributes[k] = v
+	}
+	attributes["dead_letter_reason"] = string(entry.Reason)
+	attributes["dead_letter_error"] = truncate(entry.Error, maxAttributeLength)
+	attributes["dead_letter_attempts"] = strconv.Itoa(entry.Attempts)
+	attributes["original_message_id"] = entry.MessageID
+	return s.publisher.Publish(ctx, entry.Data, attributes)
+}
+
+// Pub/Sub rejects messages with attribute values over 1024 bytes
+const maxAttributeLength = 1024
+
+// truncate cuts s to at most n bytes, on a rune boundary, marking the cut.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	const marker = "... (truncated)"
+	s = s[:n-len(marker)]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + marker
+}
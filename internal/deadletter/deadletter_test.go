@@ -0,0 +1,136 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+)
+
+func TestFileStore(t *testing.T) {
+	root := t.TempDir()
+	store := NewFileStore(root)
+
+	first := NewEntry("msg-1", []byte(`{"package_id": "db"}`), map[string]string{"traceparent": "00-abc"}, ReasonFailed, errors.New("terraform apply failed"), 1)
+	second := NewEntry("", []byte("not json"), nil, ReasonInvalid, errors.New("invalid character"), 1)
+	for _, entry := range []Entry{first, second} {
+		if err := store.Put(context.Background(), entry); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	if second.ID == "" {
+		t.Fatal("Expected an id for a message without one")
+	}
+	if info, _ := os.Stat(filepath.Join(root, "msg-1.json")); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the payload to be readable only by the provisioner, got %v", info.Mode().Perm())
+	}
+
+	entries, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(entries) != 2 || entries[0].ID != "msg-1" || entries[1].ID != second.ID {
+		t.Fatalf("Expected both entries oldest first, got %+v", entries)
+	}
+
+	got, err := store.Get("msg-1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(got.Data) != `{"package_id": "db"}` || got.Attributes["traceparent"] != "00-abc" || got.Error != "terraform apply failed" {
+		t.Errorf("Unexpected entry %+v", got)
+	}
+
+	if err := store.Delete("msg-1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	for _, id := range []string{"msg-1", "../msg-1", ""} {
+		if _, err := store.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) error = %v, want ErrNotFound", id, err)
+		}
+		if err := store.Delete(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Delete(%q) error = %v, want ErrNotFound", id, err)
+		}
+	}
+}
+
+func TestFileStore_ListEmpty(t *testing.T) {
+	entries, err := NewFileStore(filepath.Join(t.TempDir(), "missing")).List()
+	if err != nil || len(entries) != 0 {
+		t.Errorf("List() = %v, %v, want no entries", entries, err)
+	}
+}
+
+type recordingPublisher struct {
+	data       []byte
+	attributes map[string]string
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, data []byte, attributes map[string]string) error {
+	p.data = data
+	p.attributes = attributes
+	return nil
+}
+
+func TestPubSubSink(t *testing.T) {
+	publisher := &recordingPublisher{}
+	entry := NewEntry("msg-1", []byte("payload"), map[string]string{"traceparent": "00-abc"}, ReasonRejected, errors.New("no kms"), 2)
+	if err := NewPubSubSink(publisher).Put(context.Background(), entry); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if string(publisher.data) != "payload" {
+		t.Errorf("Expected the original payload, got %s", publisher.data)
+	}
+	want := map[string]string{
+		"traceparent":          "00-abc",
+		"dead_letter_reason":   "REJECTED",
+		"dead_letter_error":    "no kms",
+		"dead_letter_attempts": "2",
+		"original_message_id":  "msg-1",
+	}
+	for k, v := range want {
+		if publisher.attributes[k] != v {
+			t.Errorf("Attribute %s = %q, want %q", k, publisher.attributes[k], v)
+		}
+	}
+	if _, ok := entry.Attributes["dead_letter_reason"]; ok {
+		t.Error("Expected the entry attributes to be left alone")
+	}
+}
+
+func TestPubSubSink_TruncatesLongErrors(t *testing.T) {
+	publisher := &recordingPublisher{}
+	output := strings.Repeat("Error: creating Cloud SQL instance: googleapi: Error 409 ✗\n", 100)
+	entry := NewEntry("msg-1", []byte("payload"), nil, ReasonFailed, errors.New("command 'terraform apply' failed: exit status 1\nOutput: "+output), 1)
+	if err := NewPubSubSink(publisher).Put(context.Background(), entry); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	got := publisher.attributes["dead_letter_error"]
+	if len(got) > 1024 || !utf8.ValidString(got) || !strings.HasPrefix(got, "command 'terraform apply' failed") {
+		t.Errorf("Expected the error cut to fit an attribute, got %d bytes: %q", len(got), got)
+	}
+	if string(publisher.data) != "payload" {
+		t.Errorf("Expected the original payload, got %s", publisher.data)
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	if sink, err := NewFromConfig(&config.Config{}, nil); sink != nil || err != nil {
+		t.Errorf("Expected dead-lettering to be disabled, got %v, %v", sink, err)
+	}
+	if sink, err := NewFromConfig(&config.Config{DeadLetterSink: SinkFile, DeadLetterPath: t.TempDir()}, nil); err != nil {
+		t.Errorf("NewFromConfig() error = %v", err)
+	} else if _, ok := sink.(*FileStore); !ok {
+		t.Errorf("Expected a file store, got %T", sink)
+	}
+	for _, cfg := range []*config.Config{{DeadLetterSink: SinkPubSub}, {DeadLetterSink: "carrier-pigeon"}} {
+		if _, err := NewFromConfig(cfg, nil); err == nil {
+			t.Errorf("Expected an error for %+v", cfg)
+		}
+	}
+}
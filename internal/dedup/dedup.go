@@ -0,0 +1,249 @@
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+)
+
+type State string
+
+const (
+	StateProcessing State = "PROCESSING"
+	StateSucceeded  State = "SUCCEEDED"
+	StateFailed     State = "FAILED"
+)
+
+// Record is what happened to the first delivery of a message.
+type Record struct {
+	Key   string `json:"key"`
+	State State  `json:"state"`
+	// why processing failed, scrubbed like every deployer error
+	Error string `json:"error,omitempty"`
+	// the store that claimed the message, see FileStore
+	Claimant    string    `json:"claimant,omitempty"`
+	ClaimedAt   time.Time `json:"claimed_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// the message as delivered, kept while it is processing so one
+	// interrupted by a restart can be resumed
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+// Store remembers the messages processed recently, so a message delivered
+// again isn't processed again.
+type Store interface {
+	// Claim records that message, identified by key, is being processed. When
+	// it already is, or was within the TTL, it returns that record and false.
+	Claim(key string, message []byte) (*Record, bool, error)
+	// Complete records the result of processing a claimed message.
+	Complete(key string, err error) error
+	// Interrupted returns the records of the messages a restart stopped
+	// processing, oldest first.
+	Interrupted() ([]*Record, error)
+}
+
+// NewFromConfig returns the store, or nil when deduplication is disabled.
+func NewFromConfig(cfg *config.Config) *FileStore {
+	if cfg.DedupPath == "" {
+		return nil
+	}
+	return NewFileStore(cfg.DedupPath, time.Duration(cfg.DedupTTLSeconds)*time.Second)
+}
+
+// FileStore keeps one JSON file per key under root, until it expires. A
+// message still processing when the store was opened was interrupted by a
+// restart, so it can be claimed again right away. Each process needs its own
+// root.
+type FileStore struct {
+	root string
+	ttl  time.Duration
+	// tells the claims of this process from those of earlier ones
+	claimant string
+	mu       sync.Mutex
+	now      func() time.Time
+}
+
+func NewFileStore(root string, ttl time.Duration) *FileStore {
+	return &FileStore{root: root, ttl: ttl, claimant: uuid.NewString(), now: time.Now}
+}
+
+func (s *FileStore) Claim(key string, message []byte) (*Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().UTC()
+	existing, err := s.read(s.path(key))
+	if err != nil {
+		return nil, false, err
+	}
+	interrupted := existing != nil && s.interrupted(existing)
+	if existing != nil && now.Before(existing.ExpiresAt) && !interrupted {
+		return existing, false, nil
+	}
+	if interrupted {
+		slog.Warn("Claiming message interrupted by a restart", "dedup_key", key, "claimed_at", existing.ClaimedAt)
+	}
+
+	record := &Record{Key: key, State: StateProcessing, Claimant: s.claimant, ClaimedAt: now, ExpiresAt: now.Add(s.ttl), Message: message}
+	if err := s.write(record); err != nil {
+		return nil, false, err
+	}
+	return record, true, nil
+}
+
+func (s *FileStore) Complete(key string, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, readErr := s.read(s.path(key))
+	if readErr != nil {
+		return readErr
+	}
+	if record == nil {
+		return fmt.Errorf("message %s was never claimed", key)
+	}
+	record.State = StateSucceeded
+	if err != nil {
+		record.State = StateFailed
+		record.Error = err.Error()
+	}
+	record.CompletedAt = s.now().UTC()
+	record.Message = nil
+	return s.write(record)
+}
+
+func (s *FileStore) Interrupted() ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := os.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dedup directory: %v", err)
+	}
+
+	var interrupted []*Record
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		record, err := s.read(filepath.Join(s.root, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if record != nil && s.interrupted(record) && record.Message != nil {
+			interrupted = append(interrupted, record)
+		}
+	}
+	sort.Slice(interrupted, func(i, j int) bool { return interrupted[i].ClaimedAt.Before(interrupted[j].ClaimedAt) })
+	return interrupted, nil
+}
+
+// interrupted reports whether a record is of a message an earlier process
+// was still processing when it stopped.
+func (s *FileStore) interrupted(record *Record) bool {
+	return record.State == StateProcessing && record.Claimant != s.claimant
+}
+
+// Prune removes the records that expired and returns how many it removed. A
+// record still holding a message to resume is kept until it is completed.
+func (s *FileStore) Prune() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := os.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read dedup directory: %v", err)
+	}
+
+	now := s.now()
+	pruned := 0
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(s.root, f.Name())
+		record, err := s.read(path)
+		if err != nil {
+			return pruned, err
+		}
+		if record != nil && record.Message == nil && now.After(record.ExpiresAt) {
+			if err := os.Remove(path); err != nil {
+				return pruned, fmt.Errorf("failed to remove dedup record: %v", err)
+			}
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// Run prunes expired records every interval until ctx is done.
+func (s *FileStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if pruned, err := s.Prune(); err != nil {
+			slog.Warn("Failed to prune dedup records", "error", err)
+		} else if pruned > 0 {
+			slog.Debug("Pruned dedup records", "records", pruned)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// keys come from messages, hash them into a file name
+func (s *FileStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.root, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *FileStore) read(path string) (*Record, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dedup record: %v", err)
+	}
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse dedup record %s: %v", strings.TrimSuffix(filepath.Base(path), ".json"), err)
+	}
+	return &record, nil
+}
+
+func (s *FileStore) write(record *Record) error {
+	// records hold messages, secrets included, until they are processed
+	if err := os.MkdirAll(s.root, 0700); err != nil {
+		return fmt.Errorf("failed to create dedup directory: %v", err)
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal dedup record: %v", err)
+	}
+	// write then rename so a crash never leaves a partial record
+	path := s.path(record.Key)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write dedup record: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
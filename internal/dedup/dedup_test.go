@@ -0,0 +1,137 @@
+package dedup
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+)
+
+func TestFileStore_Claim(t *testing.T) {
+	store := NewFileStore(t.TempDir(), time.Hour)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	record, claimed, err := store.Claim("message_id:1", nil)
+	if err != nil || !claimed || record.State != StateProcessing {
+		t.Fatalf("Claim() = %+v, %v, %v, want a new claim", record, claimed, err)
+	}
+	if record, claimed, _ := store.Claim("message_id:1", nil); claimed || record.State != StateProcessing {
+		t.Errorf("Expected a message in progress not to be claimed again, got %+v, %v", record, claimed)
+	}
+
+	if err := store.Complete("message_id:1", errors.New("terraform apply failed")); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	record, claimed, _ = store.Claim("message_id:1", nil)
+	if claimed || record.State != StateFailed || record.Error != "terraform apply failed" {
+		t.Errorf("Expected the recorded result, got %+v, %v", record, claimed)
+	}
+	if _, claimed, _ := store.Claim("message_id:2", nil); !claimed {
+		t.Error("Expected another message to be claimed")
+	}
+
+	// once expired the message is processed again
+	now = now.Add(2 * time.Hour)
+	if record, claimed, _ := store.Claim("message_id:1", nil); !claimed || record.State != StateProcessing {
+		t.Errorf("Expected an expired record to be claimed again, got %+v, %v", record, claimed)
+	}
+
+	if err := store.Complete("message_id:3", nil); err == nil {
+		t.Error("Expected an error completing a message that was never claimed")
+	}
+}
+
+func TestFileStore_Claim_AfterRestart(t *testing.T) {
+	root := t.TempDir()
+	before := NewFileStore(root, time.Hour)
+	before.Claim("message_id:1", nil)
+	before.Claim("message_id:2", nil)
+	before.Complete("message_id:2", nil)
+
+	// the process stopped while message 1 was processing
+	after := NewFileStore(root, time.Hour)
+	if record, claimed, err := after.Claim("message_id:1", nil); err != nil || !claimed || record.State != StateProcessing {
+		t.Fatalf("Claim() = %+v, %v, %v, want the interrupted message to be claimed again", record, claimed, err)
+	}
+	if _, claimed, _ := after.Claim("message_id:1", nil); claimed {
+		t.Error("Expected the new claim to hold")
+	}
+	if record, claimed, _ := after.Claim("message_id:2", nil); claimed || record.State != StateSucceeded {
+		t.Errorf("Expected a completed message to stay deduplicated, got %+v, %v", record, claimed)
+	}
+}
+
+func TestFileStore_Interrupted(t *testing.T) {
+	root := t.TempDir()
+	before := NewFileStore(root, time.Minute)
+	now := time.Now()
+	before.now = func() time.Time { return now }
+	before.Claim("message_id:2", []byte(`{"messageId":"2"}`))
+	now = now.Add(-time.Second)
+	before.Claim("message_id:1", []byte(`{"messageId":"1"}`))
+	before.Claim("message_id:3", []byte(`{"messageId":"3"}`))
+	before.Complete("message_id:3", nil)
+
+	if records, err := before.Interrupted(); err != nil || len(records) != 0 {
+		t.Fatalf("Interrupted() = %v, %v, want none while this store is processing them", records, err)
+	}
+
+	// the process stopped while messages 1 and 2 were processing, for longer
+	// than the TTL
+	after := NewFileStore(root, time.Minute)
+	after.now = func() time.Time { return now.Add(time.Hour) }
+	if pruned, err := after.Prune(); err != nil || pruned != 1 {
+		t.Fatalf("Prune() = %d, %v, want only the completed record pruned", pruned, err)
+	}
+	records, err := after.Interrupted()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Interrupted() = %v, %v, want 2 records", records, err)
+	}
+	if records[0].Key != "message_id:1" || records[1].Key != "message_id:2" {
+		t.Errorf("Expected the interrupted messages oldest first, got %s and %s", records[0].Key, records[1].Key)
+	}
+
+	after.Claim("message_id:1", records[0].Message)
+	after.Complete("message_id:1", nil)
+	if record, _, _ := after.Claim("message_id:1", nil); record.Message != nil {
+		t.Errorf("Expected a completed record to drop its message, got %s", record.Message)
+	}
+	if records, _ := after.Interrupted(); len(records) != 1 {
+		t.Errorf("Expected only message 2 left to resume, got %d", len(records))
+	}
+}
+
+func TestFileStore_Prune(t *testing.T) {
+	root := t.TempDir()
+	store := NewFileStore(root, time.Hour)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	store.Claim("message_id:1", nil)
+	now = now.Add(30 * time.Minute)
+	store.Claim("message_id:2", nil)
+	store.Complete("message_id:2", nil)
+
+	now = now.Add(45 * time.Minute)
+	pruned, err := store.Prune()
+	if err != nil || pruned != 1 {
+		t.Fatalf("Prune() = %d, %v, want 1 record pruned", pruned, err)
+	}
+	if files, _ := os.ReadDir(root); len(files) != 1 {
+		t.Errorf("Expected the record that hasn't expired to be kept, got %d files", len(files))
+	}
+	if record, claimed, _ := store.Claim("message_id:2", nil); claimed || record.State != StateSucceeded {
+		t.Errorf("Expected the recorded result, got %+v, %v", record, claimed)
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	if store := NewFromConfig(&config.Config{}); store != nil {
+		t.Errorf("Expected deduplication to be disabled, got %+v", store)
+	}
+	if store := NewFromConfig(&config.Config{DedupPath: t.TempDir(), DedupTTLSeconds: 60}); store == nil || store.ttl != time.Minute {
+		t.Errorf("Expected a store with a minute TTL, got %+v", store)
+	}
+}
@@ -1,90 +1,421 @@
 package deployer
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
 	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/connections"
 	"github.com/radiatus-ai/package-provisioner/internal/executors/terraform"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/metrics"
+	"github.com/radiatus-ai/package-provisioner/internal/notify"
+	"github.com/radiatus-ai/package-provisioner/internal/report"
+	"github.com/radiatus-ai/package-provisioner/internal/scrub"
+	"github.com/radiatus-ai/package-provisioner/internal/secrets"
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
 	"github.com/radiatus-ai/package-provisioner/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Deployer struct {
 	cfg *config.Config
 	// executor *terraform.Executor
 	executor terraform.ExecutorInterface
+	history  history.Store
+	resolver *connections.Resolver
+	// nil disables output change propagation
+	propagator Propagator
+	// nil sends sensitive outputs as is
+	protector *sensitive.Protector
+	// nil passes secrets through as they arrived
+	secrets *secrets.Resolver
+	// masks the secrets of runs in progress, nil leaves errors as they are
+	scrubber *scrub.Registry
+	// delivers status updates, nil posts them to the API through the executor
+	reporter report.Reporter
+	// fires outbound hooks on status changes, nil disables them
+	notifier *notify.Notifier
+
+	mu sync.Mutex
+	// runs in progress by package
+	active map[string]*activeRun
+	// the last run of a package when it failed, by package
+	failed map[string]failedRun
+}
+
+type Option func(*Deployer)
+
+func WithPropagator(propagator Propagator) Option {
+	return func(d *Deployer) {
+		d.propagator = propagator
+	}
+}
+
+func WithProtector(protector *sensitive.Protector) Option {
+	return func(d *Deployer) {
+		d.protector = protector
+	}
+}
+
+func WithSecretResolver(resolver *secrets.Resolver) Option {
+	return func(d *Deployer) {
+		d.secrets = resolver
+	}
+}
+
+func WithScrubber(scrubber *scrub.Registry) Option {
+	return func(d *Deployer) {
+		d.scrubber = scrubber
+	}
 }
 
-func NewDeployer(cfg *config.Config) *Deployer {
-	return &Deployer{
+func WithReporter(reporter report.Reporter) Option {
+	return func(d *Deployer) {
+		d.reporter = reporter
+	}
+}
+
+func WithNotifier(notifier *notify.Notifier) Option {
+	return func(d *Deployer) {
+		d.notifier = notifier
+	}
+}
+
+func NewDeployer(cfg *config.Config, opts ...Option) *Deployer {
+	store := history.NewFileStore(cfg.HistoryPath)
+	d := &Deployer{
 		cfg:      cfg,
 		executor: terraform.NewExecutor(cfg),
+		history:  store,
+		secrets:  secrets.NewResolverFromConfig(cfg),
+		scrubber: scrub.Default,
+	}
+	for _, opt := range opts {
+		opt(d)
 	}
+	sources := connections.ChainSource{connections.NewHistorySource(store, d.protector)}
+	// without the http transport the API may well be unreachable
+	if cfg.ReportTransport == "" || cfg.ReportTransport == report.TransportHTTP {
+		sources = append(sources, connections.NewAPISource(cfg, d.protector))
+	}
+	d.resolver = connections.NewResolver(sources)
+	return d
 }
 
-func (d *Deployer) DeployPackage(msg models.DeploymentMessage) error {
-	log.Printf("Starting deployment for package %s in project %s", msg.PackageID, msg.ProjectID)
-	var startData = map[string]interface{}{}
-	var startStatus models.DeployStatus
-	if msg.Action == models.ActionDestroy {
-		startStatus = models.StartDestroy
-	} else {
-		startStatus = models.StartDeploy
+func (d *Deployer) DeployPackage(ctx context.Context, msg models.DeploymentMessage) error {
+	return d.runPackage(ctx, msg, history.NewRun(msg))
+}
+
+func (d *Deployer) runPackage(ctx context.Context, msg models.DeploymentMessage, run *history.Run) (err error) {
+	ctx, span := tracing.Start(ctx, "DeployPackage", trace.WithAttributes(
+		attribute.String("project_id", msg.ProjectID),
+		attribute.String("package_id", msg.PackageID),
+		attribute.String("package_type", msg.Package.Type),
+		attribute.String("action", string(msg.Action)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	span.SetAttributes(attribute.String("run_id", run.ID))
+	ctx = logging.With(ctx,
+		logging.RunID, run.ID,
+		logging.ProjectID, msg.ProjectID,
+		logging.PackageID, msg.PackageID,
+		logging.Action, msg.Action,
+	)
+	logger := logging.FromContext(ctx)
+
+	// the ids become the workspace and history paths of the run
+	if err := msg.Validate(); err != nil {
+		logger.Warn("Rejecting run", "error", err)
+		metrics.Deployments.WithLabelValues(string(msg.Action), "REJECTED", msg.Package.Type).Inc()
+		return err
 	}
-	if err := d.executor.PostOutputToAPI(msg.ProjectID, msg.PackageID, startData, startStatus); err != nil {
-		return fmt.Errorf("failed to post to api: %v", err)
+
+	var previous *history.Run
+	if d.propagator != nil && msg.Action == models.ActionDeploy {
+		var err error
+		if previous, err = d.history.LastDeployed(msg.PackageID); err != nil {
+			logger.Warn("Failed to look up previous run", "error", err)
+		}
 	}
 
-	deployDir := filepath.Join("deployments", msg.PackageID)
-	if err := os.MkdirAll(deployDir, 0755); err != nil {
-		return fmt.Errorf("failed to create deployment directory: %v", err)
+	// the run stops when cancelled, its failure is still reported through ctx
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	start, err := d.begin(ctx, run, cancel)
+	if errors.Is(err, ErrSuperseded) {
+		// what the message asked for was already overtaken, nothing failed
+		logger.Info("Skipping superseded message", "generation", msg.Generation, "reason", err)
+		metrics.Deployments.WithLabelValues(string(msg.Action), "SUPERSEDED", msg.Package.Type).Inc()
+		return nil
+	}
+	if err != nil {
+		logger.Warn("Rejecting run", "error", err)
+		metrics.Deployments.WithLabelValues(string(msg.Action), "REJECTED", msg.Package.Type).Inc()
+		return err
 	}
+	defer d.finish(msg.PackageID)
 
-	if err := d.executor.CopyTerraformModules(msg.Package.Type, deployDir); err != nil {
-		return fmt.Errorf("failed to copy terraform modules: %v", err)
+	scope := d.scrubber.NewScope()
+	defer scope.Release()
+	if runLog, err := d.openRunLog(run); err != nil {
+		logger.Warn("Failed to open run log", "error", err)
+	} else if runLog != nil {
+		defer runLog.Close()
+		runCtx = logging.Tee(runCtx, scrub.NewWriter(d.scrubber, runLog))
+	}
+	// the error is posted to the api and recorded, it must not carry secrets
+	err = scope.Error(d.deploy(runCtx, msg, run, start, scope))
+	if err != nil && errors.Is(context.Cause(runCtx), ErrCancelled) {
+		err = fmt.Errorf("%v: %v", ErrCancelled, err)
 	}
 
-	if err := d.executor.CreateParameterFile(msg, deployDir); err != nil {
-		return fmt.Errorf("failed to create parameter file: %v", err)
+	run.FinishedAt = time.Now().UTC()
+	if err != nil {
+		logging.FromContext(runCtx).Error("Run failed", "error", err, "status", run.Status)
+		d.fail(ctx, msg, run, err)
+	}
+	d.retain(msg, run)
+	metrics.Deployments.WithLabelValues(string(msg.Action), string(run.Status), msg.Package.Type).Inc()
+	metrics.DeploymentDuration.WithLabelValues(string(msg.Action), msg.Package.Type).Observe(run.FinishedAt.Sub(run.StartedAt).Seconds())
+	if saveErr := d.history.Save(run); saveErr != nil {
+		logger.Error("Failed to record run", "error", saveErr)
+		return err
 	}
 
-	if err := d.executor.CreateSecretsFile(msg, deployDir); err != nil {
-		return fmt.Errorf("failed to create secrets file: %v", err)
+	// dependents resolve the new outputs from history, so only propagate
+	// once the run is recorded
+	if err == nil && previous != nil {
+		if changed := changedOutputs(d.revealOutputs(previous.Outputs), d.revealOutputs(run.Outputs)); len(changed) > 0 {
+			logger.Info("Outputs changed", "outputs", changed)
+			d.propagate(ctx, msg, changed)
+		}
 	}
+	return err
+}
 
-	if err := d.executor.CreateBackendFile(msg, deployDir); err != nil {
-		return fmt.Errorf("failed to create backend file: %v", err)
+// deploy runs the stages of a package run, each in a span of its own.
+func (d *Deployer) deploy(ctx context.Context, msg models.DeploymentMessage, run *history.Run, start models.StatusTransition, scope *scrub.Scope) error {
+	logger := logging.FromContext(ctx)
+	logger.Info("Starting run", "package_type", msg.Package.Type)
+	var startData = map[string]interface{}{}
+	if err := d.reportTransition(ctx, msg, run, start, canvasapi.OutputPayloadBody{OutputData: startData}); err != nil {
+		return fmt.Errorf("failed to post to api: %v", err)
 	}
 
-	if err := d.executor.RunTerraformCommands(deployDir, msg.Action); err != nil {
+	deployDir := filepath.Join(d.workspacePath(), msg.PackageID)
+	defer func() {
+		if err := d.executor.CleanupSecrets(ctx, deployDir); err != nil {
+			logger.Error("Failed to clean up secrets", "error", err)
+		}
+	}()
+	if err := d.prepare(ctx, msg, run, deployDir, scope); err != nil {
+		return err
+	}
+
+	if err := d.executor.RunTerraformCommands(ctx, deployDir, msg.Action); err != nil {
 		return fmt.Errorf("failed to run terraform commands: %v", err)
 	}
 
-	outputData, err := d.executor.ProcessTerraformOutputs(msg, deployDir)
+	outputData, sensitiveKeys, err := d.executor.ProcessTerraformOutputs(ctx, msg, deployDir)
 	if err != nil {
 		return fmt.Errorf("failed to process terraform outputs: %v", err)
 	}
+	run.SensitiveKeys = sensitiveKeys
+	for _, k := range sensitiveKeys {
+		scope.RegisterValue(outputData[k])
+	}
 
-	if err := d.executor.WriteOutputFile(msg.PackageID, deployDir, outputData); err != nil {
-		return fmt.Errorf("failed to write output file: %v", err)
+	var protectedData map[string]interface{}
+	err = tracing.Stage(ctx, "store outputs", func(ctx context.Context) error {
+		if err := d.executor.WriteOutputFile(ctx, msg.PackageID, deployDir, outputData); err != nil {
+			return fmt.Errorf("failed to write output file: %v", err)
+		}
+		var err error
+		if protectedData, err = d.protector.Protect(outputData, sensitiveKeys); err != nil {
+			return fmt.Errorf("failed to protect sensitive outputs: %v", err)
+		}
+		// the run is recorded with the outputs canvas-api gets
+		run.Outputs = protectedData
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	var endStatus models.DeployStatus
-	if msg.Action == models.ActionDestroy {
-		endStatus = models.Destroyed
-	} else {
-		endStatus = models.Deployed
+	endStatus, err := msg.Action.EndStatus()
+	if err != nil {
+		return err
+	}
+	end, err := run.Transition(endStatus)
+	if err != nil {
+		return err
 	}
-	if err := d.executor.PostOutputToAPI(msg.ProjectID, msg.PackageID, outputData, endStatus); err != nil {
+	endPayload := canvasapi.OutputPayloadBody{
+		OutputData:     protectedData,
+		OverriddenKeys: run.OverriddenKeys,
+		SensitiveKeys:  sensitiveKeys,
+	}
+	if err := d.reportTransition(ctx, msg, run, end, endPayload); err != nil {
 		return fmt.Errorf("failed to post to api: %v", err)
 	}
 
-	log.Printf("%s completed successfully for package %s in project %s", msg.Action, msg.PackageID, msg.ProjectID)
+	logger.Info("Run completed", "status", run.Status)
 	return nil
 }
 
-func (d *Deployer) PostOutputToAPI(projectID string, packageID string, outputData map[string]interface{}, action models.DeployStatus) error {
-	return d.executor.PostOutputToAPI(projectID, packageID, outputData, action)
+// prepare writes the workspace of a package: its modules, inputs, secrets and
+// backend. The secrets handed to terraform are left for the caller to clean up.
+func (d *Deployer) prepare(ctx context.Context, msg models.DeploymentMessage, run *history.Run, deployDir string, scope *scrub.Scope) error {
+	err := tracing.Stage(ctx, "prepare workspace", func(ctx context.Context) error {
+		if err := os.MkdirAll(deployDir, 0755); err != nil {
+			return fmt.Errorf("failed to create deployment directory: %v", err)
+		}
+		if err := d.executor.CopyTerraformModules(ctx, msg.Package.Type, deployDir); err != nil {
+			return fmt.Errorf("failed to copy terraform modules: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(msg.Connections) > 0 {
+		err := tracing.Stage(ctx, "resolve connections", func(ctx context.Context) error {
+			resolved, err := d.resolver.Resolve(ctx, msg)
+			if err != nil {
+				return fmt.Errorf("failed to resolve connections: %v", err)
+			}
+			connectedInputData := make(map[string]interface{})
+			for k, v := range msg.ConnectedInputData {
+				connectedInputData[k] = v
+			}
+			for k, v := range resolved {
+				connectedInputData[k] = v
+			}
+			msg.ConnectedInputData = connectedInputData
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tracing.Stage(ctx, "write inputs", func(ctx context.Context) error {
+		overriddenKeys, err := d.executor.CreateParameterFile(ctx, msg, deployDir)
+		run.OverriddenKeys = overriddenKeys
+		run.ConnectedKeys = terraform.ConnectedKeys(msg)
+		if err != nil {
+			return fmt.Errorf("failed to create parameter file: %v", err)
+		}
+
+		resolvedSecrets, err := d.secrets.ResolveAll(ctx, msg.Secrets)
+		if err != nil {
+			return fmt.Errorf("failed to resolve secrets: %v", err)
+		}
+		msg.Secrets = resolvedSecrets
+		for _, v := range resolvedSecrets {
+			scope.Register(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tracing.Stage(ctx, "write configuration", func(ctx context.Context) error {
+		if err := d.executor.CreateSecretsFile(ctx, msg, deployDir); err != nil {
+			return fmt.Errorf("failed to create secrets file: %v", err)
+		}
+		if err := d.executor.CreateBackendFile(ctx, msg, deployDir); err != nil {
+			return fmt.Errorf("failed to create backend file: %v", err)
+		}
+		return nil
+	})
+}
+
+// Plan returns the terraform plan of msg, what a run of it would change. The
+// workspace is prepared as for a run, but nothing is applied, reported or
+// recorded.
+func (d *Deployer) Plan(ctx context.Context, msg models.DeploymentMessage) (plan string, err error) {
+	ctx, span := tracing.Start(ctx, "PlanPackage", trace.WithAttributes(
+		attribute.String("project_id", msg.ProjectID),
+		attribute.String("package_id", msg.PackageID),
+		attribute.String("package_type", msg.Package.Type),
+		attribute.String("action", string(msg.Action)),
+	))
+	defer func() { tracing.End(span, err) }()
+	ctx = logging.With(ctx,
+		logging.ProjectID, msg.ProjectID,
+		logging.PackageID, msg.PackageID,
+		logging.Action, msg.Action,
+	)
+	logger := logging.FromContext(ctx)
+
+	if err := msg.Validate(); err != nil {
+		return "", err
+	}
+	// the workspace is shared with runs of the package
+	d.mu.Lock()
+	_, busy := d.active[msg.PackageID]
+	d.mu.Unlock()
+	if busy {
+		return "", fmt.Errorf("package %s has a run in progress", msg.PackageID)
+	}
+
+	scope := d.scrubber.NewScope()
+	defer scope.Release()
+	deployDir := filepath.Join(d.workspacePath(), msg.PackageID)
+	defer func() {
+		if err := d.executor.CleanupSecrets(ctx, deployDir); err != nil {
+			logger.Error("Failed to clean up secrets", "error", err)
+		}
+	}()
+	// never recorded
+	run := history.NewRun(msg)
+	if err := d.prepare(ctx, msg, run, deployDir, scope); err != nil {
+		return "", scope.Error(err)
+	}
+	plan, err = d.executor.PlanTerraform(ctx, deployDir, msg.Action)
+	if err != nil {
+		return "", scope.Error(fmt.Errorf("failed to plan terraform changes: %v", err))
+	}
+	return d.scrubber.Scrub(plan), nil
+}
+
+func (d *Deployer) workspacePath() string {
+	if d.cfg.WorkspacePath == "" {
+		return "deployments"
+	}
+	return d.cfg.WorkspacePath
+}
+
+// sendUpdate hands a status update to the reporter, or posts it straight to
+// the API when there is none. With an outbox as the reporter updates are
+// delivered in order once the receiver is up, so an outage doesn't fail a run
+// whose infrastructure change went through.
+func (d *Deployer) sendUpdate(ctx context.Context, projectID, packageID string, payload canvasapi.OutputPayloadBody, idempotencyKey string) error {
+	if d.reporter != nil {
+		err := d.reporter.Report(ctx, report.Update{
+			ProjectID:      projectID,
+			PackageID:      packageID,
+			IdempotencyKey: idempotencyKey,
+			Payload:        payload,
+		})
+		if err != nil {
+			metrics.APIPostFailures.Inc()
+		}
+		return err
+	}
+	return d.executor.PostPayloadToAPI(ctx, projectID, packageID, payload, idempotencyKey)
 }
@@ -1,50 +1,92 @@
 package deployer
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
+	"github.com/radiatus-ai/package-provisioner/internal/connections"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/outbox"
+	"github.com/radiatus-ai/package-provisioner/internal/report"
+	"github.com/radiatus-ai/package-provisioner/internal/scrub"
+	"github.com/radiatus-ai/package-provisioner/internal/secrets"
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
 
 	"github.com/radiatus-ai/package-provisioner/internal/config"
 	"github.com/radiatus-ai/package-provisioner/internal/executors/terraform"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
 	"github.com/radiatus-ai/package-provisioner/pkg/models"
 	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var _ terraform.ExecutorInterface = (*MockExecutor)(nil)
 
 // MockExecutor is a mock implementation of the terraform.Executor
 type MockExecutor struct {
-	Fs afero.Fs
+	Fs       afero.Fs
+	Payloads []canvasapi.OutputPayloadBody
+	// idempotency keys of Payloads
+	Keys    []string
+	Inputs  map[string]interface{}
+	Secrets map[string]string
 }
 
-func (m *MockExecutor) CopyTerraformModules(packageType, deployDir string) error {
+func (m *MockExecutor) CopyTerraformModules(ctx context.Context, packageType, deployDir string) error {
 	return nil // Mock implementation
 }
 
-func (m *MockExecutor) CreateParameterFile(msg models.DeploymentMessage, deployDir string) error {
-	return afero.WriteFile(m.Fs, "deployments/test-package/parameters.tfvars", []byte("mocked parameters"), 0644)
+func (m *MockExecutor) CreateParameterFile(ctx context.Context, msg models.DeploymentMessage, deployDir string) ([]string, error) {
+	inputs, overriddenKeys, err := terraform.MergeInputs(msg)
+	if err != nil {
+		return overriddenKeys, err
+	}
+	m.Inputs = inputs
+	return overriddenKeys, afero.WriteFile(m.Fs, "deployments/test-package/parameters.tfvars", []byte("mocked parameters"), 0644)
 }
 
-func (m *MockExecutor) CreateSecretsFile(msg models.DeploymentMessage, deployDir string) error {
+func (m *MockExecutor) CreateSecretsFile(ctx context.Context, msg models.DeploymentMessage, deployDir string) error {
+	m.Secrets = msg.Secrets
 	return afero.WriteFile(m.Fs, "deployments/test-package/secrets.tfvars", []byte("mocked secrets"), 0644)
 }
 
-func (m *MockExecutor) CreateBackendFile(msg models.DeploymentMessage, deployDir string) error {
+func (m *MockExecutor) CleanupSecrets(ctx context.Context, deployDir string) error {
+	m.Secrets = nil
+	return nil
+}
+
+func (m *MockExecutor) CreateBackendFile(ctx context.Context, msg models.DeploymentMessage, deployDir string) error {
 	return afero.WriteFile(m.Fs, "deployments/test-package/backend.tf", []byte("mocked backend"), 0644)
 }
 
-func (m *MockExecutor) RunTerraformCommands(deployDir string, action models.DeploymentAction) error {
+func (m *MockExecutor) RunTerraformCommands(ctx context.Context, deployDir string, action models.DeploymentAction) error {
 	return nil // Mock implementation
 }
 
-func (m *MockExecutor) ProcessTerraformOutputs(msg models.DeploymentMessage, deployDir string) (map[string]interface{}, error) {
-	return map[string]interface{}{"output1": "value1"}, nil
+func (m *MockExecutor) PlanTerraform(ctx context.Context, deployDir string, action models.DeploymentAction) (string, error) {
+	return "Plan: 1 to add, 0 to change, 0 to destroy.", nil
 }
 
-func (m *MockExecutor) WriteOutputFile(packageID, deployDir string, outputData map[string]interface{}) error {
+func (m *MockExecutor) ProcessTerraformOutputs(ctx context.Context, msg models.DeploymentMessage, deployDir string) (map[string]interface{}, []string, error) {
+	return map[string]interface{}{"output1": "value1", "password": "hunter2"}, []string{"password"}, nil
+}
+
+func (m *MockExecutor) WriteOutputFile(ctx context.Context, packageID, deployDir string, outputData map[string]interface{}) error {
 	return afero.WriteFile(m.Fs, "deployments/test-package/output.json", []byte("mocked output"), 0644)
 }
 
-func (m *MockExecutor) PostOutputToAPI(projectID string, packageID string, outputData map[string]interface{}, action models.DeployStatus) error {
+func (m *MockExecutor) PostPayloadToAPI(ctx context.Context, projectID string, packageID string, payload canvasapi.OutputPayloadBody, idempotencyKey string) error {
+	m.Payloads = append(m.Payloads, payload)
+	m.Keys = append(m.Keys, idempotencyKey)
 	return nil
 }
 
@@ -66,6 +108,7 @@ func TestDeployer_DeployPackage(t *testing.T) {
 	deployer := &Deployer{
 		cfg:      cfg,
 		executor: mockExecutor,
+		history:  history.NewFileStore(t.TempDir()),
 	}
 
 	msg := models.DeploymentMessage{
@@ -80,7 +123,7 @@ func TestDeployer_DeployPackage(t *testing.T) {
 		Action:             models.ActionDeploy,
 	}
 
-	err := deployer.DeployPackage(msg)
+	err := deployer.DeployPackage(context.Background(), msg)
 	if err != nil {
 		t.Errorf("DeployPackage() error = %v", err)
 	}
@@ -104,3 +147,438 @@ func TestDeployer_DeployPackage(t *testing.T) {
 
 	// Add more assertions as needed
 }
+
+func TestDeployer_DeployPackage_OverriddenKeys(t *testing.T) {
+	mockExecutor := &MockExecutor{Fs: afero.NewMemMapFs()}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{
+		cfg:      &config.Config{},
+		executor: mockExecutor,
+		history:  store,
+	}
+
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package: models.Package{
+			Type:          "test-type",
+			ParameterData: map[string]interface{}{"region": "us-east1"},
+		},
+		ConnectedInputData: map[string]interface{}{"region": "us-central1"},
+		Action:             models.ActionDeploy,
+	}
+
+	if err := deployer.DeployPackage(context.Background(), msg); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+
+	if len(mockExecutor.Payloads) != 2 {
+		t.Fatalf("Expected a start and an end payload, got %d", len(mockExecutor.Payloads))
+	}
+	if keys := mockExecutor.Payloads[1].OverriddenKeys; len(keys) != 1 || keys[0] != "region" {
+		t.Errorf("Expected overridden keys [region] in payload, got %v", keys)
+	}
+	if keys := mockExecutor.Payloads[1].SensitiveKeys; len(keys) != 1 || keys[0] != "password" {
+		t.Errorf("Expected sensitive keys [password] in payload, got %v", keys)
+	}
+
+	run, err := store.LastDeployed("test-package")
+	if err != nil || run == nil {
+		t.Fatalf("Expected a recorded run, got %v (err %v)", run, err)
+	}
+	if len(run.OverriddenKeys) != 1 || run.OverriddenKeys[0] != "region" {
+		t.Errorf("Expected overridden keys [region] in run record, got %v", run.OverriddenKeys)
+	}
+	wantKeys := []string{run.ID + ":DEPLOYING", run.ID + ":DEPLOYED"}
+	if !reflect.DeepEqual(mockExecutor.Keys, wantKeys) {
+		t.Errorf("Expected idempotency keys %v, got %v", wantKeys, mockExecutor.Keys)
+	}
+}
+
+func TestDeployer_DeployPackage_MergeErrorRecordsFailure(t *testing.T) {
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{
+		cfg:      &config.Config{},
+		executor: &MockExecutor{Fs: afero.NewMemMapFs()},
+		history:  store,
+	}
+
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package: models.Package{
+			Type:          "test-type",
+			ParameterData: map[string]interface{}{"region": "us-east1"},
+			MergePolicy:   models.MergeError,
+		},
+		ConnectedInputData: map[string]interface{}{"region": "us-central1"},
+		Action:             models.ActionDeploy,
+	}
+
+	if err := deployer.DeployPackage(context.Background(), msg); err == nil {
+		t.Fatal("Expected DeployPackage() to fail on conflicting keys")
+	}
+
+	runs, err := store.List("test-package")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(runs) != 1 || runs[0].Status != models.Failed {
+		t.Fatalf("Expected 1 failed run, got %+v", runs)
+	}
+	if len(runs[0].OverriddenKeys) != 1 || runs[0].OverriddenKeys[0] != "region" {
+		t.Errorf("Expected conflicting keys [region] in run record, got %v", runs[0].OverriddenKeys)
+	}
+}
+
+func TestDeployer_DeployPackage_ResolvesConnections(t *testing.T) {
+	store := history.NewFileStore(t.TempDir())
+	upstream := history.NewRun(models.DeploymentMessage{ProjectID: "test-project", PackageID: "db"})
+	upstream.Status = models.Deployed
+	upstream.Outputs = map[string]interface{}{"host": "10.0.0.1"}
+	if err := store.Save(upstream); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	mockExecutor := &MockExecutor{Fs: afero.NewMemMapFs()}
+	deployer := &Deployer{
+		cfg:      &config.Config{},
+		executor: mockExecutor,
+		history:  store,
+		resolver: connections.NewResolver(connections.NewHistorySource(store, nil)),
+	}
+
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package:   models.Package{Type: "test-type"},
+		Connections: []models.Connection{
+			{Name: "database", SourcePackageID: "db", OutputMappings: map[string]string{"host": "db_host"}},
+		},
+		Action: models.ActionDeploy,
+	}
+
+	if err := deployer.DeployPackage(context.Background(), msg); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	if mockExecutor.Inputs["db_host"] != "10.0.0.1" {
+		t.Errorf("Expected db_host to be resolved from upstream outputs, got %v", mockExecutor.Inputs)
+	}
+}
+
+func TestDeployer_DeployPackage_DestroysAfterUpstream(t *testing.T) {
+	store := history.NewFileStore(t.TempDir())
+	db := models.DeploymentMessage{ProjectID: "test-project", PackageID: "db", Package: models.Package{Type: "postgres"}}
+	app := models.DeploymentMessage{
+		ProjectID:   "test-project",
+		PackageID:   "app",
+		Package:     models.Package{Type: "test-type"},
+		Connections: []models.Connection{{SourcePackageID: "db", OutputMappings: map[string]string{"host": "db_host"}}},
+	}
+	savedRun(t, store, db, map[string]interface{}{"host": "10.0.0.1"})
+	savedRun(t, store, app, nil)
+
+	deployer := &Deployer{
+		cfg:      &config.Config{},
+		executor: &MockExecutor{Fs: afero.NewMemMapFs()},
+		history:  store,
+		resolver: connections.NewResolver(connections.NewHistorySource(store, nil)),
+	}
+
+	// the upstream package goes first, leaving no outputs to resolve
+	for _, msg := range []models.DeploymentMessage{db, app} {
+		msg.Action = models.ActionDestroy
+		if err := deployer.DeployPackage(context.Background(), msg); err != nil {
+			t.Fatalf("DeployPackage(%s) error = %v", msg.PackageID, err)
+		}
+	}
+	runs, err := store.List("app")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if last := runs[len(runs)-1]; last.Status != models.Destroyed {
+		t.Errorf("Expected app to be destroyed, got %s", last.Status)
+	}
+}
+
+func TestDeployer_DeployPackage_EncryptsSensitiveOutputs(t *testing.T) {
+	protector, err := sensitive.NewProtector(sensitive.ModeEncrypt, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("NewProtector() error = %v", err)
+	}
+
+	mockExecutor := &MockExecutor{Fs: afero.NewMemMapFs()}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{
+		cfg:       &config.Config{},
+		executor:  mockExecutor,
+		history:   store,
+		protector: protector,
+	}
+
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package:   models.Package{Type: "test-type"},
+		Action:    models.ActionDeploy,
+	}
+	if err := deployer.DeployPackage(context.Background(), msg); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+
+	outputData := mockExecutor.Payloads[len(mockExecutor.Payloads)-1].OutputData
+	if outputData["output1"] != "value1" {
+		t.Errorf("Expected non-sensitive output to be sent as is, got %v", outputData["output1"])
+	}
+	if outputData["password"] == "hunter2" {
+		t.Error("Expected sensitive output to be encrypted in the payload")
+	}
+	if revealed, _ := protector.Reveal(outputData["password"]); revealed != "hunter2" {
+		t.Errorf("Expected encrypted output to decrypt to the original value, got %v", revealed)
+	}
+
+	run, _ := store.LastDeployed("test-package")
+	if run == nil || len(run.SensitiveKeys) != 1 || run.SensitiveKeys[0] != "password" {
+		t.Fatalf("Expected sensitive keys in the run record, got %+v", run)
+	}
+	if run.Outputs["password"] == "hunter2" {
+		t.Error("Expected sensitive output to be encrypted in the run record")
+	}
+	// connected packages still get the value
+	outputs, err := connections.NewHistorySource(store, protector).Outputs(context.Background(), "test-project", "test-package")
+	if err != nil || outputs["password"] != "hunter2" {
+		t.Errorf("Expected the recorded output to be revealed, got %v (err %v)", outputs, err)
+	}
+
+	// encrypting the same outputs again is no change to propagate
+	savedRun(t, store, models.DeploymentMessage{
+		ProjectID:   "test-project",
+		PackageID:   "app",
+		Connections: []models.Connection{{SourcePackageID: "test-package"}},
+	}, nil)
+	requested := 0
+	deployer.cfg.MaxPropagationDepth = 5
+	deployer.propagator = PropagatorFunc(func(req models.RedeployRequest) error {
+		requested++
+		return nil
+	})
+	if err := deployer.DeployPackage(context.Background(), msg); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	if requested != 0 {
+		t.Errorf("Expected no redeploy for unchanged outputs, got %d requests", requested)
+	}
+}
+
+func TestDeployer_DeployPackage_ResolvesSecretReferences(t *testing.T) {
+	t.Setenv("TEST_DB_PASSWORD", "hunter2")
+	resolver := secrets.NewResolver(true)
+	resolver.Register("env", secrets.EnvProvider{})
+
+	mockExecutor := &MockExecutor{Fs: afero.NewMemMapFs()}
+	var seen map[string]string
+	deployer := &Deployer{
+		cfg:      &config.Config{},
+		executor: &secretsSpy{MockExecutor: mockExecutor, seen: &seen},
+		history:  history.NewFileStore(t.TempDir()),
+		secrets:  resolver,
+	}
+
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package:   models.Package{Type: "test-type"},
+		Action:    models.ActionDeploy,
+		Secrets:   map[string]string{"db_password": "env://TEST_DB_PASSWORD"},
+	}
+	if err := deployer.DeployPackage(context.Background(), msg); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	if seen["db_password"] != "hunter2" {
+		t.Errorf("Expected the secret reference to be resolved, got %v", seen)
+	}
+	if mockExecutor.Secrets != nil {
+		t.Errorf("Expected secrets to be cleaned up after the run, got %v", mockExecutor.Secrets)
+	}
+
+	msg.Secrets = map[string]string{"db_password": "plaintext"}
+	if err := deployer.DeployPackage(context.Background(), msg); err == nil {
+		t.Error("Expected plaintext secrets to be rejected when references are required")
+	}
+}
+
+// secretsSpy records the secrets handed to the executor before they are
+// cleaned up.
+type secretsSpy struct {
+	*MockExecutor
+	seen *map[string]string
+}
+
+func (s *secretsSpy) RunTerraformCommands(ctx context.Context, deployDir string, action models.DeploymentAction) error {
+	*s.seen = s.Secrets
+	return s.MockExecutor.RunTerraformCommands(ctx, deployDir, action)
+}
+
+func TestDeployer_DeployPackage_ScrubsSecretsFromErrors(t *testing.T) {
+	store := history.NewFileStore(t.TempDir())
+	registry := scrub.NewRegistry()
+	deployer := &Deployer{
+		cfg:      &config.Config{},
+		executor: &leakyExecutor{MockExecutor: &MockExecutor{Fs: afero.NewMemMapFs()}},
+		history:  store,
+		scrubber: registry,
+	}
+
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package:   models.Package{Type: "test-type"},
+		Action:    models.ActionDeploy,
+		Secrets:   map[string]string{"db_password": "hunter2"},
+	}
+	err := deployer.DeployPackage(context.Background(), msg)
+	if err == nil {
+		t.Fatal("Expected DeployPackage() to fail")
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Error contains the secret: %v", err)
+	}
+
+	runs, _ := store.List("test-package")
+	if len(runs) != 1 || strings.Contains(runs[0].Error, "hunter2") {
+		t.Errorf("Expected a recorded run without the secret, got %+v", runs)
+	}
+	if got := registry.Scrub("hunter2"); got != "hunter2" {
+		t.Errorf("Expected the secret to be released after the run, Scrub() = %q", got)
+	}
+}
+
+// leakyExecutor fails the way terraform does when it echoes a bad value.
+type leakyExecutor struct {
+	*MockExecutor
+}
+
+func (l *leakyExecutor) RunTerraformCommands(ctx context.Context, deployDir string, action models.DeploymentAction) error {
+	return fmt.Errorf("command 'terraform apply' failed\nOutput: invalid password %q", l.Secrets["db_password"])
+}
+
+func TestDeployer_DeployPackage_QueuesUpdatesDuringOutage(t *testing.T) {
+	statusOutbox, err := outbox.New(t.TempDir(), failingReporter{}, time.Hour)
+	if err != nil {
+		t.Fatalf("outbox.New() error = %v", err)
+	}
+	deployer := &Deployer{
+		cfg:      &config.Config{},
+		executor: &MockExecutor{Fs: afero.NewMemMapFs()},
+		history:  history.NewFileStore(t.TempDir()),
+		reporter: statusOutbox,
+	}
+
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package:   models.Package{Type: "test-type"},
+		Action:    models.ActionDeploy,
+	}
+	if err := deployer.DeployPackage(context.Background(), msg); err != nil {
+		t.Fatalf("DeployPackage() error = %v, expected the run to succeed while the API is down", err)
+	}
+
+	statusOutbox.Flush(context.Background())
+	pending, _ := statusOutbox.Pending("test-package")
+	if len(pending) != 2 || *pending[0].Payload.DeployStatus != "DEPLOYING" || *pending[1].Payload.DeployStatus != "DEPLOYED" {
+		t.Fatalf("Expected the start and end updates to be queued, got %+v", pending)
+	}
+}
+
+type failingReporter struct{}
+
+func (failingReporter) Report(ctx context.Context, update report.Update) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestDeployer_DeployPackage_TracesStages(t *testing.T) {
+	exporter, restore := tracing.UseInMemory()
+	defer restore()
+
+	deployer := &Deployer{cfg: &config.Config{}, executor: &MockExecutor{Fs: afero.NewMemMapFs()}, history: history.NewFileStore(t.TempDir())}
+	ctx, parent := tracing.Start(context.Background(), "HandlePush")
+	if err := deployer.DeployPackage(ctx, models.DeploymentMessage{ProjectID: "test-project", PackageID: "test-package", Package: models.Package{Type: "test-type"}, Action: models.ActionDeploy}); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	parent.End()
+
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		byName[span.Name] = span
+		if span.SpanContext.TraceID() != parent.SpanContext().TraceID() {
+			t.Errorf("Span %s is not part of the push trace", span.Name)
+		}
+	}
+	root, ok := byName["DeployPackage"]
+	if !ok || root.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Fatalf("Expected a DeployPackage span under the push span, got %v", byName)
+	}
+	for _, name := range []string{"prepare workspace", "write inputs", "write configuration", "store outputs"} {
+		if span, ok := byName[name]; !ok || span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("Expected a %q span under DeployPackage", name)
+		}
+	}
+}
+
+func TestDeployer_DeployPackage_LogsRunFields(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(logger *slog.Logger) { slog.SetDefault(logger) }(slog.Default())
+	slog.SetDefault(logging.New(&buf, slog.LevelInfo, "json", ""))
+
+	deployer := &Deployer{cfg: &config.Config{}, executor: &MockExecutor{Fs: afero.NewMemMapFs()}, history: history.NewFileStore(t.TempDir())}
+	ctx := logging.With(context.Background(), logging.MessageID, "msg-1")
+	if err := deployer.DeployPackage(ctx, models.DeploymentMessage{ProjectID: "test-project", PackageID: "test-package", Package: models.Package{Type: "test-type"}, Action: models.ActionDeploy}); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		t.Fatal("Expected the run to log")
+	}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Failed to decode log line %q: %v", line, err)
+		}
+		for _, key := range []string{logging.MessageID, logging.RunID, logging.ProjectID, logging.PackageID, logging.Action} {
+			if entry[key] == nil || entry[key] == "" {
+				t.Errorf("Expected %s on %q", key, line)
+			}
+		}
+	}
+}
+
+func TestDeployer_Plan(t *testing.T) {
+	mockExecutor := &MockExecutor{Fs: afero.NewMemMapFs()}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{cfg: &config.Config{WorkspacePath: t.TempDir()}, executor: mockExecutor, history: store}
+
+	msg := lifecycleMessage(models.ActionDeploy)
+	msg.Secrets = map[string]string{"db_password": "hunter2"}
+	plan, err := deployer.Plan(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if !strings.Contains(plan, "1 to add") {
+		t.Errorf("Expected the plan, got %q", plan)
+	}
+	if mockExecutor.Secrets != nil {
+		t.Error("Expected the secrets to be cleaned up")
+	}
+	if len(mockExecutor.Payloads) != 0 {
+		t.Errorf("Expected no status updates, got %d", len(mockExecutor.Payloads))
+	}
+	if runs, _ := store.List("test-package"); len(runs) != 0 {
+		t.Errorf("Expected no runs to be recorded, got %d", len(runs))
+	}
+
+	if _, err := deployer.Plan(context.Background(), lifecycleMessage(models.ActionDeployProject)); err == nil {
+		t.Error("Expected an error for a project action")
+	}
+}
@@ -0,0 +1,189 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/metrics"
+	"github.com/radiatus-ai/package-provisioner/internal/notify"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+// ErrSuperseded is returned for a message of an older generation than the
+// last one run for its package.
+var ErrSuperseded = errors.New("superseded by a later message")
+
+// begin moves a package into the start status of the run's action, or fails
+// when the package lifecycle doesn't allow it, e.g. a destroy while a deploy
+// is in progress. A run of a later generation than the one in progress waits
+// for it to finish instead. The in progress run is recorded so a restart can
+// tell it was interrupted. cancel stops the run when it is cancelled through
+// Cancel.
+func (d *Deployer) begin(ctx context.Context, run *history.Run, cancel context.CancelCauseFunc) (models.StatusTransition, error) {
+	start, err := run.Action.StartStatus()
+	if err != nil {
+		return models.StatusTransition{}, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		if err := d.checkGeneration(run); err != nil {
+			return models.StatusTransition{}, err
+		}
+		active, ok := d.active[run.PackageID]
+		if !ok {
+			break
+		}
+		if run.Generation == 0 || run.Generation <= active.generation {
+			return models.StatusTransition{}, &models.TransitionError{From: active.Status, To: start}
+		}
+		// the generation is checked again once the active run is done, a
+		// later one may have started in the meantime
+		logging.FromContext(ctx).Info("Waiting for the run of an earlier generation", "active_run_id", active.RunID, "active_generation", active.generation)
+		d.mu.Unlock()
+		select {
+		case <-active.done:
+		case <-ctx.Done():
+		}
+		d.mu.Lock()
+		if ctx.Err() != nil {
+			return models.StatusTransition{}, context.Cause(ctx)
+		}
+	}
+	if d.active == nil {
+		d.active = make(map[string]*activeRun)
+	}
+
+	if run.Status, err = d.currentStatus(ctx, run.PackageID); err != nil {
+		return models.StatusTransition{}, err
+	}
+	transition, err := run.Transition(start)
+	if err != nil {
+		return models.StatusTransition{}, err
+	}
+	if err := d.history.Save(run); err != nil {
+		logging.FromContext(ctx).Error("Failed to record run", "error", err)
+	}
+	d.active[run.PackageID] = &activeRun{
+		ActiveRun: ActiveRun{
+			RunID:       run.ID,
+			ProjectID:   run.ProjectID,
+			PackageID:   run.PackageID,
+			PackageType: run.PackageType,
+			Action:      run.Action,
+			Status:      start,
+			StartedAt:   run.StartedAt,
+		},
+		generation: run.Generation,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	metrics.ActiveRuns.Inc()
+	return transition, nil
+}
+
+func (d *Deployer) finish(packageID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if active, ok := d.active[packageID]; ok {
+		close(active.done)
+		delete(d.active, packageID)
+	}
+	metrics.ActiveRuns.Dec()
+}
+
+// checkGeneration fails a run for a message older than the last one run for
+// the package, failed runs included. The same generation runs again, e.g. a
+// retry.
+func (d *Deployer) checkGeneration(run *history.Run) error {
+	if run.Generation == 0 {
+		return nil
+	}
+	runs, err := d.history.List(run.PackageID)
+	if err != nil {
+		return fmt.Errorf("failed to look up runs of package %s: %v", run.PackageID, err)
+	}
+	for _, previous := range runs {
+		if previous.Generation > run.Generation {
+			return fmt.Errorf("%w: generation %d, run %s was for generation %d", ErrSuperseded, run.Generation, previous.ID, previous.Generation)
+		}
+	}
+	return nil
+}
+
+// currentStatus returns the last recorded status of a package. A run still in
+// progress in the history isn't running in this process, so it was
+// interrupted by a restart and is marked failed.
+func (d *Deployer) currentStatus(ctx context.Context, packageID string) (models.DeployStatus, error) {
+	runs, err := d.history.List(packageID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up status of package %s: %v", packageID, err)
+	}
+	if len(runs) == 0 {
+		return "", nil
+	}
+
+	last := runs[len(runs)-1]
+	if last.Status.InProgress() {
+		logger := logging.FromContext(ctx).With("interrupted_run_id", last.ID)
+		logger.Warn("Previous run was interrupted", "status", last.Status)
+		if _, err := last.Transition(models.Failed); err != nil {
+			return "", err
+		}
+		last.Error = "interrupted"
+		last.FinishedAt = time.Now().UTC()
+		if err := d.history.Save(last); err != nil {
+			logger.Error("Failed to record interrupted run", "error", err)
+		}
+	}
+	return last.Status, nil
+}
+
+// fail moves a run that didn't reach its end status to FAILED and reports it.
+func (d *Deployer) fail(ctx context.Context, msg models.DeploymentMessage, run *history.Run, err error) {
+	run.Error = err.Error()
+	if !run.Status.InProgress() {
+		// the run reached its end status, only reporting it went wrong
+		return
+	}
+	transition, transitionErr := run.Transition(models.Failed)
+	if transitionErr != nil {
+		logging.FromContext(ctx).Error("Failed to mark run as failed", "error", transitionErr)
+		return
+	}
+	payload := canvasapi.OutputPayloadBody{
+		OutputData: map[string]interface{}{
+			"error": err.Error(),
+		},
+	}
+	if postErr := d.reportTransition(ctx, msg, run, transition, payload); postErr != nil {
+		logging.FromContext(ctx).Error("Failed to report failure", "error", postErr)
+	}
+}
+
+// reportTransition sends a status change of the run, along with payload, to
+// the API and fires the notification hooks interested in it. Each transition
+// of a run is sent with its own idempotency key.
+func (d *Deployer) reportTransition(ctx context.Context, msg models.DeploymentMessage, run *history.Run, transition models.StatusTransition, payload canvasapi.OutputPayloadBody) error {
+	status := string(transition.To)
+	payload.DeployStatus = &status
+	payload.Transition = &transition
+	d.notifier.Notify(notify.Event{
+		ProjectID:   msg.ProjectID,
+		PackageID:   msg.PackageID,
+		PackageType: msg.Package.Type,
+		RunID:       run.ID,
+		Action:      msg.Action,
+		From:        transition.From,
+		Status:      transition.To,
+		At:          transition.At,
+		Error:       run.Error,
+	})
+	return d.sendUpdate(ctx, msg.ProjectID, msg.PackageID, payload, canvasapi.IdempotencyKey(run.ID, status))
+}
@@ -0,0 +1,277 @@
+package deployer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/metrics"
+	"github.com/radiatus-ai/package-provisioner/internal/notify"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+	"github.com/spf13/afero"
+)
+
+func lifecycleMessage(action models.DeploymentAction) models.DeploymentMessage {
+	return models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package:   models.Package{Type: "test-type"},
+		Action:    action,
+	}
+}
+
+func TestDeployer_DeployPackage_RecordsTransitions(t *testing.T) {
+	mockExecutor := &MockExecutor{Fs: afero.NewMemMapFs()}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{cfg: &config.Config{}, executor: mockExecutor, history: store}
+
+	if err := deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDeploy)); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	if err := deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDestroy)); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+
+	want := [][2]models.DeployStatus{
+		{"", models.StartDeploy},
+		{models.StartDeploy, models.Deployed},
+		{models.Deployed, models.StartDestroy},
+		{models.StartDestroy, models.Destroyed},
+	}
+	if len(mockExecutor.Payloads) != len(want) {
+		t.Fatalf("Expected %d updates, got %d", len(want), len(mockExecutor.Payloads))
+	}
+	for i, payload := range mockExecutor.Payloads {
+		transition := payload.Transition
+		if transition == nil || transition.From != want[i][0] || transition.To != want[i][1] || transition.At.IsZero() {
+			t.Errorf("Update %d transition = %+v, want %v", i, transition, want[i])
+		}
+		if *payload.DeployStatus != string(want[i][1]) {
+			t.Errorf("Update %d status = %s, want %s", i, *payload.DeployStatus, want[i][1])
+		}
+	}
+
+	if got := testutil.ToFloat64(metrics.Deployments.WithLabelValues(string(models.ActionDestroy), string(models.Destroyed), "test-type")); got < 1 {
+		t.Errorf("Expected the destroy to be counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.ActiveRuns); got != 0 {
+		t.Errorf("Expected no active runs, got %v", got)
+	}
+
+	runs, _ := store.List("test-package")
+	if len(runs) != 2 || len(runs[1].Transitions) != 2 || runs[1].Status != models.Destroyed {
+		t.Errorf("Expected the transitions in the run history, got %+v", runs)
+	}
+}
+
+func TestDeployer_DeployPackage_ReportsFailure(t *testing.T) {
+	mockExecutor := &MockExecutor{Fs: afero.NewMemMapFs()}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{cfg: &config.Config{}, executor: &leakyExecutor{MockExecutor: mockExecutor}, history: store}
+
+	if err := deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDeploy)); err == nil {
+		t.Fatal("Expected DeployPackage() to fail")
+	}
+
+	last := mockExecutor.Payloads[len(mockExecutor.Payloads)-1]
+	if *last.DeployStatus != string(models.Failed) || last.Transition.From != models.StartDeploy {
+		t.Errorf("Expected a DEPLOYING to FAILED update, got %+v", last)
+	}
+	if last.OutputData["error"] == nil {
+		t.Error("Expected the error in the failure update")
+	}
+
+	// a failed package can be deployed again
+	deployer.executor = mockExecutor
+	if err := deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDeploy)); err != nil {
+		t.Errorf("DeployPackage() after a failure error = %v", err)
+	}
+}
+
+func TestDeployer_DeployPackage_RejectsDestroyWhileDeploying(t *testing.T) {
+	blocking := &blockingExecutor{
+		MockExecutor: &MockExecutor{Fs: afero.NewMemMapFs()},
+		started:      make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	deployer := &Deployer{cfg: &config.Config{}, executor: blocking, history: history.NewFileStore(t.TempDir())}
+
+	done := make(chan error)
+	go func() {
+		done <- deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDeploy))
+	}()
+	<-blocking.started
+
+	err := deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDestroy))
+	var transitionErr *models.TransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.From != models.StartDeploy {
+		t.Errorf("DeployPackage() error = %v, want a transition error from DEPLOYING", err)
+	}
+
+	close(blocking.release)
+	if err := <-done; err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	for _, payload := range blocking.Payloads {
+		if *payload.DeployStatus == string(models.Failed) || *payload.DeployStatus == string(models.StartDestroy) {
+			t.Errorf("The rejected destroy must not report anything, got %s", *payload.DeployStatus)
+		}
+	}
+}
+
+func TestDeployer_DeployPackage_LaterGenerationWaits(t *testing.T) {
+	blocking := &blockingExecutor{
+		MockExecutor: &MockExecutor{Fs: afero.NewMemMapFs()},
+		started:      make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{cfg: &config.Config{}, executor: blocking, history: store}
+
+	deploy := lifecycleMessage(models.ActionDeploy)
+	deploy.Generation = 2
+	done := make(chan error)
+	go func() {
+		done <- deployer.DeployPackage(context.Background(), deploy)
+	}()
+	<-blocking.started
+
+	// an older generation is skipped, a later one waits for the deploy
+	older := lifecycleMessage(models.ActionDestroy)
+	older.Generation = 1
+	if err := deployer.DeployPackage(context.Background(), older); err != nil {
+		t.Errorf("Expected the older message to be skipped, got %v", err)
+	}
+	destroy := lifecycleMessage(models.ActionDestroy)
+	destroy.Generation = 3
+	waiting := make(chan error)
+	go func() {
+		waiting <- deployer.DeployPackage(context.Background(), destroy)
+	}()
+	select {
+	case err := <-waiting:
+		t.Fatalf("Expected the destroy to wait for the deploy, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(blocking.release)
+	if err := <-done; err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	if err := <-waiting; err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	runs, _ := store.List("test-package")
+	if len(runs) != 2 || runs[0].Status != models.Deployed || runs[1].Status != models.Destroyed {
+		t.Errorf("Expected the deploy and then the destroy, got %+v", runs)
+	}
+}
+
+func TestDeployer_DeployPackage_SkipsSupersededMessage(t *testing.T) {
+	mockExecutor := &MockExecutor{Fs: afero.NewMemMapFs()}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{cfg: &config.Config{}, executor: mockExecutor, history: store}
+
+	// the destroy was published after the deploy, but arrives first
+	destroy := lifecycleMessage(models.ActionDestroy)
+	destroy.Generation = 2
+	deploy := lifecycleMessage(models.ActionDeploy)
+	deploy.Generation = 1
+	if err := deployer.DeployPackage(context.Background(), destroy); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	if err := deployer.DeployPackage(context.Background(), deploy); err != nil {
+		t.Fatalf("Expected a superseded message to be skipped without an error, got %v", err)
+	}
+	runs, _ := store.List("test-package")
+	if len(runs) != 1 || runs[0].Generation != 2 || runs[0].Action != models.ActionDestroy {
+		t.Fatalf("Expected only the destroy to run, got %+v", runs)
+	}
+	if len(mockExecutor.Payloads) != 2 {
+		t.Errorf("Expected nothing to be reported for the skipped deploy, got %d updates", len(mockExecutor.Payloads))
+	}
+
+	// the same generation runs again, and messages without one always run
+	destroy.Generation = 2
+	for _, msg := range []models.DeploymentMessage{destroy, lifecycleMessage(models.ActionDeploy)} {
+		if err := deployer.DeployPackage(context.Background(), msg); err != nil {
+			t.Fatalf("DeployPackage() error = %v", err)
+		}
+	}
+	if runs, _ := store.List("test-package"); len(runs) != 3 {
+		t.Errorf("Expected 3 runs, got %d", len(runs))
+	}
+}
+
+func TestDeployer_DeployPackage_RecoversInterruptedRun(t *testing.T) {
+	store := history.NewFileStore(t.TempDir())
+	interrupted := history.NewRun(lifecycleMessage(models.ActionDeploy))
+	interrupted.StartedAt = time.Now().Add(-time.Hour)
+	interrupted.Transition(models.StartDeploy)
+	store.Save(interrupted)
+
+	deployer := &Deployer{cfg: &config.Config{}, executor: &MockExecutor{Fs: afero.NewMemMapFs()}, history: store}
+	if err := deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDestroy)); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+
+	runs, _ := store.List("test-package")
+	if len(runs) != 2 || runs[0].Status != models.Failed || runs[0].Error != "interrupted" {
+		t.Errorf("Expected the interrupted run to be marked failed, got %+v", runs[0])
+	}
+}
+
+func TestDeployer_DeployPackage_RejectsUnknownAction(t *testing.T) {
+	deployer := &Deployer{cfg: &config.Config{}, executor: &MockExecutor{Fs: afero.NewMemMapFs()}, history: history.NewFileStore(t.TempDir())}
+	if err := deployer.DeployPackage(context.Background(), lifecycleMessage("UPGRADE")); err == nil {
+		t.Error("Expected an unknown action to be rejected")
+	}
+}
+
+// blockingExecutor holds a run in terraform until released.
+type blockingExecutor struct {
+	*MockExecutor
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (b *blockingExecutor) RunTerraformCommands(ctx context.Context, deployDir string, action models.DeploymentAction) error {
+	b.once.Do(func() { close(b.started) })
+	<-b.release
+	return nil
+}
+
+func TestDeployer_DeployPackage_NotifiesHooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []notify.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notify.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	notifier, err := notify.NewNotifier([]notify.Hook{{Name: "ci", URL: server.URL}}, "")
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+
+	mockExecutor := &MockExecutor{Fs: afero.NewMemMapFs()}
+	deployer := &Deployer{cfg: &config.Config{}, executor: &leakyExecutor{MockExecutor: mockExecutor}, history: history.NewFileStore(t.TempDir()), notifier: notifier}
+	deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDeploy))
+	notifier.Wait()
+
+	if len(events) != 1 || events[0].Status != models.Failed || events[0].From != models.StartDeploy || events[0].Error == "" {
+		t.Errorf("Expected a single FAILED notification with the error, got %+v", events)
+	}
+}
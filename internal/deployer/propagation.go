@@ -0,0 +1,131 @@
+package deployer
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/orchestrator"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+// Propagator delivers redeploy requests for packages downstream of one whose
+// outputs changed.
+type Propagator interface {
+	RequestRedeploy(req models.RedeployRequest) error
+}
+
+// PropagatorFunc adapts a callback to the Propagator interface.
+type PropagatorFunc func(req models.RedeployRequest) error
+
+func (f PropagatorFunc) RequestRedeploy(req models.RedeployRequest) error {
+	return f(req)
+}
+
+// changedOutputs returns the keys added, removed or modified between two sets
+// of outputs.
+func changedOutputs(previous, current map[string]interface{}) []string {
+	var changed []string
+	for k, v := range current {
+		if old, ok := previous[k]; !ok || !reflect.DeepEqual(old, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range previous {
+		if _, ok := current[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// revealOutputs decrypts the sensitive outputs of a run, encrypting the same
+// value twice doesn't give the same result. A value that can't be decrypted is
+// compared as it is.
+func (d *Deployer) revealOutputs(outputs map[string]interface{}) map[string]interface{} {
+	revealed := make(map[string]interface{}, len(outputs))
+	for k, v := range outputs {
+		if value, err := d.protector.Reveal(v); err == nil {
+			v = value
+		}
+		revealed[k] = v
+	}
+	return revealed
+}
+
+// propagate requests a redeploy of every package wired to changed outputs of
+// msg's package. Packages already in the propagation chain are skipped so a
+// cycle of connections can't trigger redeploys forever, and so are packages of
+// the project action msg is part of, which deploys them itself.
+func (d *Deployer) propagate(ctx context.Context, msg models.DeploymentMessage, changed []string) {
+	logger := logging.FromContext(ctx)
+	chain := append(append([]string{}, msg.PropagationChain...), msg.PackageID)
+	if len(chain) > d.cfg.MaxPropagationDepth {
+		logger.Warn("Not propagating output changes, propagation too deep", "depth", len(chain), "max_depth", d.cfg.MaxPropagationDepth)
+		return
+	}
+
+	dependents, err := d.history.Dependents(msg.ProjectID, msg.PackageID)
+	if err != nil {
+		logger.Error("Failed to look up dependents", "error", err)
+		return
+	}
+
+	inChain := make(map[string]bool, len(chain))
+	for _, id := range chain {
+		inChain[id] = true
+	}
+	inGraph := make(map[string]bool)
+	for _, id := range orchestrator.GraphPackages(ctx) {
+		inGraph[id] = true
+	}
+
+	for _, dependent := range dependents {
+		if inChain[dependent.PackageID] {
+			logger.Info("Not redeploying package already redeployed in this propagation", "dependent", dependent.PackageID, "chain", chain)
+			continue
+		}
+		if inGraph[dependent.PackageID] {
+			logger.Info("Not redeploying package deployed by this project action", "dependent", dependent.PackageID)
+			continue
+		}
+
+		affected := affectedOutputs(dependent.Connections, msg.PackageID, changed)
+		if len(affected) == 0 {
+			continue
+		}
+
+		req := models.RedeployRequest{
+			ProjectID:        msg.ProjectID,
+			PackageID:        dependent.PackageID,
+			SourcePackageID:  msg.PackageID,
+			ChangedOutputs:   affected,
+			PropagationChain: chain,
+		}
+		if err := d.propagator.RequestRedeploy(req); err != nil {
+			logger.Error("Failed to request redeploy", "dependent", dependent.PackageID, "error", err)
+			continue
+		}
+		logger.Info("Requested redeploy", "dependent", dependent.PackageID, "outputs", affected)
+	}
+}
+
+// affectedOutputs returns the changed outputs of sourceID that the connections
+// actually consume.
+func affectedOutputs(connections []models.Connection, sourceID string, changed []string) []string {
+	var affected []string
+	for _, key := range changed {
+		for _, conn := range connections {
+			if conn.SourcePackageID != sourceID {
+				continue
+			}
+			if _, ok := conn.OutputMappings[key]; ok || len(conn.OutputMappings) == 0 {
+				affected = append(affected, key)
+				break
+			}
+		}
+	}
+	return affected
+}
@@ -0,0 +1,155 @@
+package deployer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/connections"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/orchestrator"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+	"github.com/spf13/afero"
+)
+
+func TestChangedOutputs(t *testing.T) {
+	previous := map[string]interface{}{"host": "10.0.0.1", "port": 5432.0, "removed": true}
+	current := map[string]interface{}{"host": "10.0.0.2", "port": 5432.0, "added": "x"}
+
+	got := changedOutputs(previous, current)
+	want := []string{"added", "host", "removed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changedOutputs() = %v, want %v", got, want)
+	}
+}
+
+func savedRun(t *testing.T, store history.Store, msg models.DeploymentMessage, outputs map[string]interface{}) {
+	t.Helper()
+	run := history.NewRun(msg)
+	run.Status = models.Deployed
+	run.Outputs = outputs
+	if err := store.Save(run); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+}
+
+func TestDeployer_DeployPackage_PropagatesChangedOutputs(t *testing.T) {
+	store := history.NewFileStore(t.TempDir())
+	db := models.DeploymentMessage{ProjectID: "test-project", PackageID: "db", Package: models.Package{Type: "postgres"}, Action: models.ActionDeploy}
+	savedRun(t, store, db, map[string]interface{}{"output1": "old"})
+
+	// app consumes output1, metrics only consumes an output that did not change
+	savedRun(t, store, models.DeploymentMessage{
+		ProjectID:   "test-project",
+		PackageID:   "app",
+		Connections: []models.Connection{{SourcePackageID: "db", OutputMappings: map[string]string{"output1": "db_host"}}},
+	}, nil)
+	savedRun(t, store, models.DeploymentMessage{
+		ProjectID:   "test-project",
+		PackageID:   "metrics",
+		Connections: []models.Connection{{SourcePackageID: "db", OutputMappings: map[string]string{"port": "db_port"}}},
+	}, nil)
+	// already redeployed in this propagation
+	savedRun(t, store, models.DeploymentMessage{
+		ProjectID:   "test-project",
+		PackageID:   "web",
+		Connections: []models.Connection{{SourcePackageID: "db"}},
+	}, nil)
+
+	var requests []models.RedeployRequest
+	deployer := &Deployer{
+		cfg:      &config.Config{MaxPropagationDepth: 5},
+		executor: &MockExecutor{Fs: afero.NewMemMapFs()},
+		history:  store,
+		propagator: PropagatorFunc(func(req models.RedeployRequest) error {
+			requests = append(requests, req)
+			return nil
+		}),
+	}
+
+	db.PropagationChain = []string{"web"}
+	if err := deployer.DeployPackage(context.Background(), db); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+
+	want := []models.RedeployRequest{{
+		ProjectID:        "test-project",
+		PackageID:        "app",
+		SourcePackageID:  "db",
+		ChangedOutputs:   []string{"output1"},
+		PropagationChain: []string{"web", "db"},
+	}}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("Expected redeploy requests %+v, got %+v", want, requests)
+	}
+}
+
+func TestDeployer_DeployPackage_PropagationDepthLimit(t *testing.T) {
+	store := history.NewFileStore(t.TempDir())
+	db := models.DeploymentMessage{ProjectID: "test-project", PackageID: "db", Package: models.Package{Type: "postgres"}, Action: models.ActionDeploy}
+	savedRun(t, store, db, map[string]interface{}{"output1": "old"})
+	savedRun(t, store, models.DeploymentMessage{
+		ProjectID:   "test-project",
+		PackageID:   "app",
+		Connections: []models.Connection{{SourcePackageID: "db"}},
+	}, nil)
+
+	requested := 0
+	deployer := &Deployer{
+		cfg:      &config.Config{MaxPropagationDepth: 2},
+		executor: &MockExecutor{Fs: afero.NewMemMapFs()},
+		history:  store,
+		propagator: PropagatorFunc(func(req models.RedeployRequest) error {
+			requested++
+			return nil
+		}),
+	}
+
+	db.PropagationChain = []string{"a", "b"}
+	if err := deployer.DeployPackage(context.Background(), db); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	if requested != 0 {
+		t.Errorf("Expected no redeploy requests past the depth limit, got %d", requested)
+	}
+}
+
+func TestDeployer_DeployPackage_NoPropagationWithinProjectDeploy(t *testing.T) {
+	store := history.NewFileStore(t.TempDir())
+	db := models.DeploymentMessage{ProjectID: "test-project", PackageID: "db", Package: models.Package{Type: "postgres"}}
+	savedRun(t, store, db, map[string]interface{}{"output1": "old"})
+	// web is deployed after db by the project deploy, app isn't part of it
+	web := models.DeploymentMessage{
+		ProjectID:   "test-project",
+		PackageID:   "web",
+		Package:     models.Package{Type: "service"},
+		Connections: []models.Connection{{SourcePackageID: "db"}},
+	}
+	savedRun(t, store, web, nil)
+	savedRun(t, store, models.DeploymentMessage{
+		ProjectID:   "test-project",
+		PackageID:   "app",
+		Connections: []models.Connection{{SourcePackageID: "db"}},
+	}, nil)
+
+	var requested []string
+	deployer := &Deployer{
+		cfg:      &config.Config{MaxPropagationDepth: 5},
+		executor: &MockExecutor{Fs: afero.NewMemMapFs()},
+		history:  store,
+		resolver: connections.NewResolver(connections.NewHistorySource(store, nil)),
+		propagator: PropagatorFunc(func(req models.RedeployRequest) error {
+			requested = append(requested, req.PackageID)
+			return nil
+		}),
+	}
+
+	project := models.DeploymentMessage{ProjectID: "test-project", Action: models.ActionDeployProject, Packages: []models.DeploymentMessage{db, web}}
+	if err := orchestrator.NewOrchestrator(deployer.DeployPackage).Handle(context.Background(), project); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	if !reflect.DeepEqual(requested, []string{"app"}) {
+		t.Errorf("Expected a redeploy of app only, got %v", requested)
+	}
+}
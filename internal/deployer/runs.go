@@ -0,0 +1,224 @@
+package deployer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/executors/terraform"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+var (
+	// ErrCancelled is the cause of a run stopped through Cancel.
+	ErrCancelled = errors.New("run cancelled")
+	// ErrRunNotActive is returned when cancelling a run that isn't in
+	// progress.
+	ErrRunNotActive = errors.New("run is not in progress")
+	// ErrNotRetryable is returned when retrying a run that didn't fail, or
+	// whose message is gone.
+	ErrNotRetryable = errors.New("run can't be retried")
+	// ErrWorkspaceReused is returned for the files of a run whose workspace a
+	// later run has written to.
+	ErrWorkspaceReused = errors.New("workspace was reused by a later run")
+	// ErrNoRunLog is returned for a run without a log.
+	ErrNoRunLog = errors.New("no log for run")
+)
+
+// ActiveRun is a run in progress in this process.
+type ActiveRun struct {
+	RunID       string                  `json:"run_id"`
+	ProjectID   string                  `json:"project_id"`
+	PackageID   string                  `json:"package_id"`
+	PackageType string                  `json:"package_type"`
+	Action      models.DeploymentAction `json:"action"`
+	Status      models.DeployStatus     `json:"status"`
+	StartedAt   time.Time               `json:"started_at"`
+}
+
+type activeRun struct {
+	ActiveRun
+	generation int64
+	cancel     context.CancelCauseFunc
+	// closed once the run finishes
+	done chan struct{}
+}
+
+// failedRun holds on to the message of a failed run so it can be retried.
+// It's only kept in memory, the message carries secrets.
+type failedRun struct {
+	runID string
+	msg   models.DeploymentMessage
+}
+
+// Active returns the runs in progress, oldest first.
+func (d *Deployer) Active() []ActiveRun {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	runs := make([]ActiveRun, 0, len(d.active))
+	for _, active := range d.active {
+		runs = append(runs, active.ActiveRun)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt.Before(runs[j].StartedAt)
+	})
+	return runs
+}
+
+// History returns the runs of a package, oldest first.
+func (d *Deployer) History(packageID string) ([]*history.Run, error) {
+	return d.history.List(packageID)
+}
+
+// Run returns the record of a run, or history.ErrNotFound.
+func (d *Deployer) Run(packageID, runID string) (*history.Run, error) {
+	return d.history.Get(packageID, runID)
+}
+
+// Cancel stops a run in progress. The terraform command it is running is
+// interrupted and the run fails.
+func (d *Deployer) Cancel(packageID, runID string) error {
+	if _, err := d.history.Get(packageID, runID); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	active, ok := d.active[packageID]
+	if !ok || active.RunID != runID {
+		return fmt.Errorf("%w: %s", ErrRunNotActive, runID)
+	}
+	active.cancel(ErrCancelled)
+	return nil
+}
+
+// Retry runs the message of a failed run again, if it is still the last run
+// of its package. It returns the id of the new run, which goes on in the
+// background.
+func (d *Deployer) Retry(ctx context.Context, packageID, runID string) (string, error) {
+	if _, err := d.history.Get(packageID, runID); err != nil {
+		return "", err
+	}
+	d.mu.Lock()
+	failed, ok := d.failed[packageID]
+	_, busy := d.active[packageID]
+	d.mu.Unlock()
+	if busy {
+		return "", fmt.Errorf("%w: package %s has a run in progress", ErrNotRetryable, packageID)
+	}
+	if !ok || failed.runID != runID {
+		return "", fmt.Errorf("%w: %s is not the last failed run of package %s, or its message was lost in a restart", ErrNotRetryable, runID, packageID)
+	}
+
+	run := history.NewRun(failed.msg)
+	// the run outlives the request that asked for it
+	ctx = logging.With(context.WithoutCancel(ctx), "retry_of", runID)
+	go func() {
+		if err := d.runPackage(ctx, failed.msg, run); err != nil {
+			logging.FromContext(ctx).Error("Retry failed", logging.RunID, run.ID, "error", err)
+		}
+	}()
+	return run.ID, nil
+}
+
+// retain keeps the message of a run that failed until the next run of its
+// package.
+func (d *Deployer) retain(msg models.DeploymentMessage, run *history.Run) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if run.Status != models.Failed {
+		delete(d.failed, run.PackageID)
+		return
+	}
+	if d.failed == nil {
+		d.failed = make(map[string]failedRun)
+	}
+	d.failed[run.PackageID] = failedRun{runID: run.ID, msg: msg}
+}
+
+// Files returns the files generated in the workspace of a run, with secrets,
+// connected inputs and sensitive outputs masked. Only the last run of a package still has its
+// workspace.
+func (d *Deployer) Files(packageID, runID string) (map[string]string, error) {
+	run, err := d.history.Get(packageID, runID)
+	if err != nil {
+		return nil, err
+	}
+	runs, err := d.history.List(packageID)
+	if err != nil {
+		return nil, err
+	}
+	if last := runs[len(runs)-1]; last.ID != run.ID {
+		return nil, fmt.Errorf("%w: %s", ErrWorkspaceReused, last.ID)
+	}
+	files, err := terraform.GeneratedFiles(filepath.Join(d.workspacePath(), packageID), packageID, run.ConnectedKeys, run.SensitiveKeys)
+	if err != nil {
+		return nil, err
+	}
+	// an input may carry a secret of the run when it is still in progress
+	for name, content := range files {
+		files[name] = d.scrubber.Scrub(content)
+	}
+	return files, nil
+}
+
+func (d *Deployer) runLogPath(packageID, runID string) string {
+	return filepath.Join(d.cfg.RunLogPath, packageID, runID+".log")
+}
+
+// openRunLog creates the log of a run, or returns nil when run logs are
+// disabled.
+func (d *Deployer) openRunLog(run *history.Run) (io.WriteCloser, error) {
+	if d.cfg.RunLogPath == "" {
+		return nil, nil
+	}
+	path := d.runLogPath(run.PackageID, run.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create run log directory: %v", err)
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+// LogTail returns the last lines of the log of a run, JSON lines in the
+// Cloud Logging format.
+func (d *Deployer) LogTail(packageID, runID string, lines int) ([]string, error) {
+	if _, err := d.history.Get(packageID, runID); err != nil {
+		return nil, err
+	}
+	if lines <= 0 {
+		return nil, nil
+	}
+	if d.cfg.RunLogPath == "" {
+		return nil, ErrNoRunLog
+	}
+	file, err := os.Open(d.runLogPath(packageID, runID))
+	if os.IsNotExist(err) {
+		return nil, ErrNoRunLog
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open run log: %v", err)
+	}
+	defer file.Close()
+
+	tail := make([]string, 0, lines)
+	scanner := bufio.NewScanner(file)
+	// command output is logged as a single line
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(tail) == lines {
+			tail = tail[1:]
+		}
+		tail = append(tail, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read run log: %v", err)
+	}
+	return tail, nil
+}
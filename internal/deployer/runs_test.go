@@ -0,0 +1,200 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/history"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+	"github.com/spf13/afero"
+)
+
+// cancellableExecutor runs terraform until ctx is cancelled, or fails while
+// failures are left.
+type cancellableExecutor struct {
+	*MockExecutor
+	started chan struct{}
+
+	mu       sync.Mutex
+	failures int
+}
+
+func (e *cancellableExecutor) RunTerraformCommands(ctx context.Context, deployDir string, action models.DeploymentAction) error {
+	e.mu.Lock()
+	failing := e.failures > 0
+	e.failures--
+	e.mu.Unlock()
+	if failing {
+		return errors.New("terraform apply failed")
+	}
+	if e.started == nil {
+		return nil
+	}
+	close(e.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func waitForRun(t *testing.T, store history.Store, packageID, runID string) *history.Run {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		run, err := store.Get(packageID, runID)
+		if err == nil && !run.FinishedAt.IsZero() {
+			return run
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected run %s to finish, got %+v", runID, run)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeployer_Cancel(t *testing.T) {
+	executor := &cancellableExecutor{MockExecutor: &MockExecutor{Fs: afero.NewMemMapFs()}, started: make(chan struct{})}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{cfg: &config.Config{}, executor: executor, history: store}
+
+	done := make(chan error)
+	go func() { done <- deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDeploy)) }()
+	<-executor.started
+
+	active := deployer.Active()
+	if len(active) != 1 || active[0].PackageID != "test-package" || active[0].Status != models.StartDeploy {
+		t.Fatalf("Expected the run in progress, got %+v", active)
+	}
+	runID := active[0].RunID
+	if err := deployer.Cancel("test-package", "unknown"); !errors.Is(err, history.ErrNotFound) {
+		t.Errorf("Cancel() of an unknown run error = %v, want ErrNotFound", err)
+	}
+	if err := deployer.Cancel("test-package", runID); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), ErrCancelled.Error()) {
+		t.Fatalf("Expected the run to fail as cancelled, got %v", err)
+	}
+	run, _ := store.Get("test-package", runID)
+	if run.Status != models.Failed || !strings.HasPrefix(run.Error, ErrCancelled.Error()) {
+		t.Errorf("Expected a failed run, got %s: %s", run.Status, run.Error)
+	}
+	// the failure is still reported
+	last := executor.Payloads[len(executor.Payloads)-1]
+	if *last.DeployStatus != string(models.Failed) {
+		t.Errorf("Expected the failure to be reported, got %s", *last.DeployStatus)
+	}
+	if len(deployer.Active()) != 0 {
+		t.Errorf("Expected no runs in progress, got %+v", deployer.Active())
+	}
+	if err := deployer.Cancel("test-package", runID); !errors.Is(err, ErrRunNotActive) {
+		t.Errorf("Cancel() of a finished run error = %v, want ErrRunNotActive", err)
+	}
+}
+
+func TestDeployer_Retry(t *testing.T) {
+	executor := &cancellableExecutor{MockExecutor: &MockExecutor{Fs: afero.NewMemMapFs()}, failures: 1}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{cfg: &config.Config{}, executor: executor, history: store}
+
+	msg := lifecycleMessage(models.ActionDeploy)
+	msg.Secrets = map[string]string{"db_password": "hunter2-secret"}
+	if err := deployer.DeployPackage(context.Background(), msg); err == nil {
+		t.Fatal("Expected the first run to fail")
+	}
+	runs, _ := store.List("test-package")
+	failed := runs[0]
+
+	if _, err := deployer.Retry(context.Background(), "test-package", "unknown"); !errors.Is(err, history.ErrNotFound) {
+		t.Errorf("Retry() of an unknown run error = %v, want ErrNotFound", err)
+	}
+	runID, err := deployer.Retry(context.Background(), "test-package", failed.ID)
+	if err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	retried := waitForRun(t, store, "test-package", runID)
+	if retried.Status != models.Deployed {
+		t.Errorf("Expected the retry to deploy, got %s: %s", retried.Status, retried.Error)
+	}
+	if retried.Action != models.ActionDeploy || retried.PackageType != "test-type" {
+		t.Errorf("Expected the original message to be deployed, got %+v", retried)
+	}
+
+	if _, err := deployer.Retry(context.Background(), "test-package", failed.ID); !errors.Is(err, ErrNotRetryable) {
+		t.Errorf("Retry() of a superseded run error = %v, want ErrNotRetryable", err)
+	}
+	if _, err := deployer.Retry(context.Background(), "test-package", runID); !errors.Is(err, ErrNotRetryable) {
+		t.Errorf("Retry() of a successful run error = %v, want ErrNotRetryable", err)
+	}
+}
+
+func TestDeployer_LogTail(t *testing.T) {
+	executor := &cancellableExecutor{MockExecutor: &MockExecutor{Fs: afero.NewMemMapFs()}, failures: 1}
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{cfg: &config.Config{RunLogPath: t.TempDir()}, executor: executor, history: store}
+
+	if err := deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDeploy)); err == nil {
+		t.Fatal("Expected the run to fail")
+	}
+	runs, _ := store.List("test-package")
+
+	all, err := deployer.LogTail("test-package", runs[0].ID, 1000)
+	if err != nil {
+		t.Fatalf("LogTail() error = %v", err)
+	}
+	if len(all) < 2 || !strings.Contains(all[0], "Starting run") {
+		t.Fatalf("Expected the lines of the run, got %v", all)
+	}
+	tail, _ := deployer.LogTail("test-package", runs[0].ID, 1)
+	if len(tail) != 1 || tail[0] != all[len(all)-1] || !strings.Contains(tail[0], "terraform apply failed") {
+		t.Errorf("Expected the last line to report the failure, got %v", tail)
+	}
+
+	noLogs := &Deployer{cfg: &config.Config{}, history: store}
+	if _, err := noLogs.LogTail("test-package", runs[0].ID, 10); !errors.Is(err, ErrNoRunLog) {
+		t.Errorf("LogTail() without run logs error = %v, want ErrNoRunLog", err)
+	}
+}
+
+func TestDeployer_Files(t *testing.T) {
+	workspace := t.TempDir()
+	store := history.NewFileStore(t.TempDir())
+	deployer := &Deployer{cfg: &config.Config{WorkspacePath: workspace}, executor: &MockExecutor{Fs: afero.NewMemMapFs()}, history: store}
+
+	msg := lifecycleMessage(models.ActionDeploy)
+	msg.ConnectedInputData = map[string]interface{}{"db_password": "upstream-secret"}
+	if err := deployer.DeployPackage(context.Background(), msg); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	// the mock executor doesn't write to disk
+	os.WriteFile(filepath.Join(workspace, "test-package", "test-package_output.json"), []byte(`{"output1": "value1", "password": "hunter2"}`), 0644)
+	os.WriteFile(filepath.Join(workspace, "test-package", "test-package_inputs.auto.tfvars.json"), []byte(`{"region": "us-central1", "db_password": "upstream-secret"}`), 0644)
+	runs, _ := store.List("test-package")
+
+	files, err := deployer.Files("test-package", runs[0].ID)
+	if err != nil {
+		t.Fatalf("Files() error = %v", err)
+	}
+	output := files["test-package_output.json"]
+	if !strings.Contains(output, "value1") || strings.Contains(output, "hunter2") {
+		t.Errorf("Expected the sensitive output to be masked, got %s", output)
+	}
+	inputs := files["test-package_inputs.auto.tfvars.json"]
+	if !strings.Contains(inputs, "us-central1") || strings.Contains(inputs, "upstream-secret") {
+		t.Errorf("Expected the connected input to be masked, got %s", inputs)
+	}
+
+	if err := deployer.DeployPackage(context.Background(), lifecycleMessage(models.ActionDestroy)); err != nil {
+		t.Fatalf("DeployPackage() error = %v", err)
+	}
+	if _, err := deployer.Files("test-package", runs[0].ID); !errors.Is(err, ErrWorkspaceReused) {
+		t.Errorf("Files() of a superseded run error = %v, want ErrWorkspaceReused", err)
+	}
+}
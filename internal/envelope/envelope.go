@@ -0,0 +1,112 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+)
+
+// Version is the envelope format produced by Seal.
+const Version = 1
+
+// Envelope carries a payload encrypted with a random data key, and that data
+// key wrapped by a key held in a KMS.
+type Envelope struct {
+	Version    int    `json:"envelope_version"`
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// KMS wraps and unwraps data keys with a key encryption key it holds.
+type KMS interface {
+	Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// IsEnvelope reports whether data looks like a sealed envelope rather than a
+// plain JSON message.
+func IsEnvelope(data []byte) bool {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return false
+	}
+	var probe struct {
+		Version    int    `json:"envelope_version"`
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return false
+	}
+	return probe.Version != 0 && len(probe.Ciphertext) > 0
+}
+
+// Seal encrypts plaintext with a fresh data key wrapped by keyID.
+func Seal(ctx context.Context, kms KMS, keyID string, plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := kms.Encrypt(ctx, keyID, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+
+	return json.Marshal(Envelope{
+		Version:    Version,
+		KeyID:      keyID,
+		WrappedKey: wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, []byte(keyID)),
+	})
+}
+
+// Open unwraps the data key of a sealed envelope and decrypts its payload.
+func Open(ctx context.Context, kms KMS, data []byte) ([]byte, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %v", err)
+	}
+	if env.Version != Version {
+		return nil, fmt.Errorf("unsupported envelope version: %d", env.Version)
+	}
+
+	dataKey, err := kms.Decrypt(ctx, env.KeyID, env.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid envelope nonce")
+	}
+
+	plaintext, err := aead.Open(nil, env.Nonce, env.Ciphertext, []byte(env.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt envelope: %v", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
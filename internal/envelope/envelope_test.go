@@ -0,0 +1,153 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+func testKMS() *LocalKMS {
+	return NewLocalKMS(map[string][]byte{
+		"dev":   []byte("0123456789abcdef0123456789abcdef"),
+		"other": []byte("fedcba9876543210fedcba9876543210"),
+	})
+}
+
+func TestSealOpen(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte(`{"package_id": "test-package", "secrets": {"password": "hunter2"}}`)
+
+	sealed, err := Seal(ctx, testKMS(), "dev", plaintext)
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	if bytes.Contains(sealed, []byte("hunter2")) {
+		t.Fatal("Sealed envelope contains the plaintext")
+	}
+	if !IsEnvelope(sealed) {
+		t.Error("Expected IsEnvelope() to recognize a sealed envelope")
+	}
+
+	opened, err := Open(ctx, testKMS(), sealed)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open() = %s, want %s", opened, plaintext)
+	}
+}
+
+func TestOpen_Rejects(t *testing.T) {
+	ctx := context.Background()
+	sealed, err := Seal(ctx, testKMS(), "dev", []byte("payload"))
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+
+	var env Envelope
+	json.Unmarshal(sealed, &env)
+
+	tampered := env
+	tampered.Ciphertext = append([]byte{}, env.Ciphertext...)
+	tampered.Ciphertext[0] ^= 0xff
+
+	swappedKey := env
+	swappedKey.KeyID = "other"
+
+	unknownKey := env
+	unknownKey.KeyID = "missing"
+
+	futureVersion := env
+	futureVersion.Version = 2
+
+	for name, e := range map[string]Envelope{
+		"tampered ciphertext": tampered,
+		"swapped key id":      swappedKey,
+		"unknown key id":      unknownKey,
+		"unknown version":     futureVersion,
+	} {
+		data, _ := json.Marshal(e)
+		if _, err := Open(ctx, testKMS(), data); err == nil {
+			t.Errorf("Expected Open() to reject %s", name)
+		}
+	}
+}
+
+func TestIsEnvelope(t *testing.T) {
+	for data, want := range map[string]bool{
+		`{"project_id": "p", "package_id": "x"}`:        false,
+		`not json`:                                      false,
+		`{"envelope_version": 1}`:                       false,
+		`{"envelope_version": 1, "ciphertext": "AAEC"}`: true,
+	} {
+		if got := IsEnvelope([]byte(data)); got != want {
+			t.Errorf("IsEnvelope(%s) = %v, want %v", data, got, want)
+		}
+	}
+}
+
+func TestParseLocalKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	keys, err := ParseLocalKeys("dev:" + key + ", prod:" + key)
+	if err != nil {
+		t.Fatalf("ParseLocalKeys() error = %v", err)
+	}
+	if len(keys) != 2 || len(keys["dev"]) != 32 {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	for _, value := range []string{"no-separator", ":" + key, "dev:not base64!"} {
+		if _, err := ParseLocalKeys(value); err == nil {
+			t.Errorf("Expected ParseLocalKeys(%q) to fail", value)
+		}
+	}
+}
+
+func TestCloudKMS(t *testing.T) {
+	// a fake KMS that "encrypts" by reversing the base64 plaintext
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":encrypt"):
+			fmt.Fprintf(w, `{"ciphertext": %q}`, base64.StdEncoding.EncodeToString([]byte(reverse(body["plaintext"]))))
+		case strings.HasSuffix(r.URL.Path, ":decrypt"):
+			raw, _ := base64.StdEncoding.DecodeString(body["ciphertext"])
+			fmt.Fprintf(w, `{"plaintext": %q}`, reverse(string(raw)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	kms := NewCloudKMS(option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	keyID := "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+	sealed, err := Seal(context.Background(), kms, keyID, []byte("payload"))
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	opened, err := Open(context.Background(), kms, sealed)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if string(opened) != "payload" {
+		t.Errorf("Open() = %s, want payload", opened)
+	}
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
@@ -0,0 +1,145 @@
+package envelope
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// NewKMSFromConfig returns the KMS configured by MESSAGE_KMS, or nil when
+// encrypted messages are not supported.
+func NewKMSFromConfig(cfg *config.Config) (KMS, error) {
+	switch cfg.MessageKMS {
+	case "":
+		return nil, nil
+	case "local":
+		keys, err := ParseLocalKeys(cfg.MessageEncryptionKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MESSAGE_ENCRYPTION_KEYS: %v", err)
+		}
+		return NewLocalKMS(keys), nil
+	case "gcp":
+		return NewCloudKMS(), nil
+	default:
+		return nil, fmt.Errorf("unsupported MESSAGE_KMS: %s", cfg.MessageKMS)
+	}
+}
+
+// LocalKMS wraps data keys with AES keys held in memory. It is meant for
+// development and tests.
+type LocalKMS struct {
+	keys map[string][]byte
+}
+
+func NewLocalKMS(keys map[string][]byte) *LocalKMS {
+	return &LocalKMS{keys: keys}
+}
+
+// ParseLocalKeys parses "key-id:base64key,other-id:base64key".
+func ParseLocalKeys(value string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid local key entry, expected id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local key %s: %v", id, err)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+func (k *LocalKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %s", keyID)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(keyID)), nil
+}
+
+func (k *LocalKMS) Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %s", keyID)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	nonceSize := aead.NonceSize()
+	return aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], []byte(keyID))
+}
+
+// CloudKMS wraps data keys with Google Cloud KMS. Key IDs are crypto key
+// resource names, projects/p/locations/l/keyRings/r/cryptoKeys/k.
+type CloudKMS struct {
+	opts []option.ClientOption
+
+	once    sync.Once
+	service *cloudkms.Service
+	err     error
+}
+
+func NewCloudKMS(opts ...option.ClientOption) *CloudKMS {
+	return &CloudKMS{opts: opts}
+}
+
+func (k *CloudKMS) client() (*cloudkms.Service, error) {
+	k.once.Do(func() {
+		k.service, k.err = cloudkms.NewService(context.Background(), k.opts...)
+	})
+	return k.service, k.err
+}
+
+func (k *CloudKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	service, err := k.client()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kms client: %v", err)
+	}
+	resp, err := service.Projects.Locations.KeyRings.CryptoKeys.Encrypt(keyID, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Ciphertext)
+}
+
+func (k *CloudKMS) Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	service, err := k.client()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kms client: %v", err)
+	}
+	resp, err := service.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyID, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
@@ -1,49 +1,71 @@
 package terraform
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
 	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/metrics"
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
 	"github.com/radiatus-ai/package-provisioner/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ExecutorInterface interface {
-	CopyTerraformModules(packageType, deployDir string) error
-	CreateParameterFile(msg models.DeploymentMessage, deployDir string) error
-	CreateSecretsFile(msg models.DeploymentMessage, deployDir string) error
-	CreateBackendFile(msg models.DeploymentMessage, deployDir string) error
-	RunTerraformCommands(deployDir string, action models.DeploymentAction) error
-	ProcessTerraformOutputs(msg models.DeploymentMessage, deployDir string) (map[string]interface{}, error)
-	PostOutputToAPI(projectID string, packageID string, outputData map[string]interface{}, action models.DeployStatus) error
-	WriteOutputFile(packageID, deployDir string, outputData map[string]interface{}) error
+	CopyTerraformModules(ctx context.Context, packageType, deployDir string) error
+	CreateParameterFile(ctx context.Context, msg models.DeploymentMessage, deployDir string) ([]string, error)
+	CreateSecretsFile(ctx context.Context, msg models.DeploymentMessage, deployDir string) error
+	CleanupSecrets(ctx context.Context, deployDir string) error
+	CreateBackendFile(ctx context.Context, msg models.DeploymentMessage, deployDir string) error
+	RunTerraformCommands(ctx context.Context, deployDir string, action models.DeploymentAction) error
+	PlanTerraform(ctx context.Context, deployDir string, action models.DeploymentAction) (string, error)
+	ProcessTerraformOutputs(ctx context.Context, msg models.DeploymentMessage, deployDir string) (map[string]interface{}, []string, error)
+	PostPayloadToAPI(ctx context.Context, projectID string, packageID string, payload canvasapi.OutputPayloadBody, idempotencyKey string) error
+	WriteOutputFile(ctx context.Context, packageID, deployDir string, outputData map[string]interface{}) error
 }
 
 type Executor struct {
 	cfg                  *config.Config
 	terraformModulesPath string
+	api                  *canvasapi.Client
+
+	mu sync.Mutex
+	// extra environment for commands run in a deploy dir, used to hand
+	// secrets to terraform without writing them into the workspace
+	commandEnv map[string][]string
+	// tmpfs secret files to shred once the run is over, by deploy dir
+	secretFiles map[string]string
 }
 
 func NewExecutor(cfg *config.Config) *Executor {
-	log.Println("Creating new Terraform Executor")
 	return &Executor{
 		cfg:                  cfg,
 		terraformModulesPath: cfg.TerraformModulesPath,
+		api:                  canvasapi.NewClientFromConfig(cfg),
+		commandEnv:           make(map[string][]string),
+		secretFiles:          make(map[string]string),
 	}
 }
 
-func (e *Executor) CopyTerraformModules(packageType string, deployDir string) error {
+func (e *Executor) CopyTerraformModules(ctx context.Context, packageType string, deployDir string) error {
 	sourceDir := e.terraformModulesPath
-	log.Printf("Copying Terraform modules from %s to %s for package type %s", sourceDir, deployDir, packageType)
+	logger := logging.FromContext(ctx)
+	logger.Info("Copying terraform modules", "source", sourceDir, "dir", deployDir, "package_type", packageType)
 
 	// Construct the full path to the package-specific module
 	sourcePath := filepath.Join(sourceDir, packageType)
@@ -60,7 +82,7 @@ func (e *Executor) CopyTerraformModules(packageType string, deployDir string) er
 		return fmt.Errorf("failed to copy terraform modules: %v\nOutput: %s", err, output)
 	}
 
-	log.Printf("Successfully copied Terraform modules to %s", deployDir)
+	logger.Debug("Copied terraform modules", "dir", deployDir)
 	return nil
 }
 
@@ -85,54 +107,33 @@ func copyFile(src, dst string) error {
 	return nil
 }
 
-func (e *Executor) CreateParameterFile(msg models.DeploymentMessage, deployDir string) error {
-	log.Printf("Creating parameter file for package: %s in directory: %s", msg.PackageID, deployDir)
-	combinedData := make(map[string]interface{})
-	for k, v := range msg.Package.ParameterData {
-		combinedData[k] = v
-	}
-	for k, v := range msg.ConnectedInputData {
-		combinedData[k] = v
-	}
-
-	filePath := filepath.Join(deployDir, fmt.Sprintf("%s_inputs.auto.tfvars.json", msg.PackageID))
-	err := e.writeJSONFile(filePath, combinedData)
+func (e *Executor) CreateParameterFile(ctx context.Context, msg models.DeploymentMessage, deployDir string) ([]string, error) {
+	logger := logging.FromContext(ctx)
+	combinedData, overriddenKeys, err := MergeInputs(msg)
 	if err != nil {
-		log.Printf("Error creating parameter file: %v", err)
-	} else {
-		log.Printf("Successfully created parameter file: %s", filePath)
+		logger.Error("Failed to merge inputs", "error", err)
+		return overriddenKeys, err
 	}
-	return err
-}
-
-func (e *Executor) CreateSecretsFile(msg models.DeploymentMessage, deployDir string) error {
-	log.Printf("Creating secrets file for package: %s in directory: %s", msg.PackageID, deployDir)
-
-	secretsData := make(map[string]interface{})
-	for k, v := range msg.Secrets {
-		var jsonValue interface{}
-		err := json.Unmarshal([]byte(v), &jsonValue)
-		if err != nil {
-			log.Printf("Error unmarshaling secret value for key %s: %v", k, err)
-			jsonValue = v
-		}
-		secretsData[k] = jsonValue
+	if len(overriddenKeys) > 0 {
+		logger.Info("Merge policy resolved conflicting keys", "merge_policy", msg.Package.MergePolicy, "keys", overriddenKeys)
 	}
 
-	filePath := filepath.Join(deployDir, fmt.Sprintf("%s_secrets.auto.tfvars.json", msg.PackageID))
-	err := e.writeJSONFile(filePath, secretsData)
+	filePath := filepath.Join(deployDir, inputsFileName(msg.PackageID))
+	err = e.writeJSONFile(filePath, combinedData)
 	if err != nil {
-		log.Printf("Error creating secrets file: %v", err)
+		logger.Error("Failed to create parameter file", "error", err)
 	} else {
-		log.Printf("Successfully created secrets file: %s", filePath)
+		logger.Info("Created parameter file", "path", filePath)
 	}
-	return err
+	return overriddenKeys, err
 }
 
-func (e *Executor) CreateBackendFile(msg models.DeploymentMessage, deployDir string) error {
-	log.Printf("Creating backend file for package: %s in directory: %s", msg.PackageID, deployDir)
+func (e *Executor) CreateBackendFile(ctx context.Context, msg models.DeploymentMessage, deployDir string) error {
 	prefix := fmt.Sprintf("projects/%s/packages/%s", msg.ProjectID, msg.PackageID)
-	content := fmt.Sprintf(`
+	var content string
+	switch e.cfg.TerraformBackend {
+	case "", "gcs":
+		content = fmt.Sprintf(`
 terraform {
   backend "gcs" {
     bucket = "%s"
@@ -140,19 +141,35 @@ terraform {
   }
 }
 `, e.cfg.BucketName, prefix)
+	case "local":
+		// terraform resolves a relative path from the deploy dir
+		statePath, err := filepath.Abs(filepath.Join(e.cfg.LocalStatePath, prefix, "terraform.tfstate"))
+		if err != nil {
+			return fmt.Errorf("failed to resolve local state path: %v", err)
+		}
+		content = fmt.Sprintf(`
+terraform {
+  backend "local" {
+    path = "%s"
+  }
+}
+`, statePath)
+	default:
+		return fmt.Errorf("unsupported terraform backend: %s", e.cfg.TerraformBackend)
+	}
 
-	filePath := filepath.Join(deployDir, "backend.tf")
+	filePath := filepath.Join(deployDir, backendFileName)
 	err := os.WriteFile(filePath, []byte(content), 0644)
 	if err != nil {
-		log.Printf("Error creating backend file: %v", err)
+		logging.FromContext(ctx).Error("Failed to create backend file", "error", err)
 	} else {
-		log.Printf("Successfully created backend file: %s", filePath)
+		logging.FromContext(ctx).Info("Created backend file", "path", filePath, "backend", e.cfg.TerraformBackend, "bucket", e.cfg.BucketName, "prefix", prefix)
 	}
 	return err
 }
 
-func (e *Executor) RunTerraformCommands(deployDir string, action models.DeploymentAction) error {
-	log.Printf("Running Terraform commands in directory: %s for action: %s", deployDir, action)
+func (e *Executor) RunTerraformCommands(ctx context.Context, deployDir string, action models.DeploymentAction) error {
+	logger := logging.FromContext(ctx)
 	commands := []string{
 		"terraform init",
 		"terraform plan",
@@ -168,136 +185,172 @@ func (e *Executor) RunTerraformCommands(deployDir string, action models.Deployme
 	}
 
 	for _, cmd := range commands {
-		log.Printf("Executing command: %s", cmd)
-		output, err := e.runCommand(cmd, deployDir)
+		start := time.Now()
+		output, err := e.runCommand(ctx, cmd, deployDir)
+		// the terraform subcommand, e.g. init or apply
+		metrics.ObserveCommand(strings.Fields(cmd)[1], start, err)
 		if err != nil {
-			log.Printf("Command '%s' failed: %v\nOutput: %s", cmd, err, output)
+			// the output is part of the error, logged once the deployer has
+			// scrubbed it
 			return fmt.Errorf("command '%s' failed: %v\nOutput: %s", cmd, err, output)
 		}
-		log.Printf("Command '%s' executed successfully", cmd)
 	}
 
-	log.Println("All Terraform commands executed successfully")
+	logger.Info("Terraform commands completed", "action", action)
 	return nil
 }
 
-func (e *Executor) ProcessTerraformOutputs(msg models.DeploymentMessage, deployDir string) (map[string]interface{}, error) {
-	log.Printf("Processing Terraform outputs for package: %s in directory: %s", msg.PackageID, deployDir)
-	output, err := e.runCommand("terraform output -json", deployDir)
+// PlanTerraform initializes the workspace and returns the plan of action,
+// without changing anything.
+func (e *Executor) PlanTerraform(ctx context.Context, deployDir string, action models.DeploymentAction) (string, error) {
+	plan := "terraform plan -no-color"
+	switch action {
+	case models.ActionDeploy:
+	case models.ActionDestroy:
+		plan += " -destroy"
+	default:
+		return "", fmt.Errorf("unsupported action: %s", action)
+	}
+
+	var output string
+	for _, cmd := range []string{"terraform init -no-color", plan} {
+		start := time.Now()
+		var err error
+		output, err = e.runCommand(ctx, cmd, deployDir)
+		metrics.ObserveCommand(strings.Fields(cmd)[1], start, err)
+		if err != nil {
+			return "", fmt.Errorf("command '%s' failed: %v\nOutput: %s", cmd, err, output)
+		}
+	}
+	return output, nil
+}
+
+// ProcessTerraformOutputs returns the outputs declared by the package and the
+// keys of the ones terraform marks as sensitive.
+func (e *Executor) ProcessTerraformOutputs(ctx context.Context, msg models.DeploymentMessage, deployDir string) (map[string]interface{}, []string, error) {
+	start := time.Now()
+	// the output holds sensitive values in plaintext, the deployer only masks
+	// them once they are returned, so it isn't logged
+	output, err := e.run(ctx, "terraform output -json", deployDir, false)
+	metrics.ObserveCommand("output", start, err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get terraform outputs: %v", err)
+	}
+	outputData, sensitiveKeys, err := parseTerraformOutputs(msg, output)
 	if err != nil {
-		log.Printf("Failed to get Terraform outputs: %v", err)
-		return nil, fmt.Errorf("failed to get terraform outputs: %v", err)
+		return nil, nil, err
 	}
+	logging.FromContext(ctx).Info("Processed terraform outputs", "outputs", len(outputData), "sensitive", len(sensitiveKeys))
+	return outputData, sensitiveKeys, nil
+}
 
+func parseTerraformOutputs(msg models.DeploymentMessage, output string) (map[string]interface{}, []string, error) {
 	var outputJSON map[string]interface{}
 	if err := json.Unmarshal([]byte(output), &outputJSON); err != nil {
-		log.Printf("Failed to parse Terraform outputs: %v", err)
-		return nil, fmt.Errorf("failed to parse terraform outputs: %v", err)
+		return nil, nil, fmt.Errorf("failed to parse terraform outputs: %v", err)
 	}
 
 	processedOutput := make(map[string]interface{})
+	sensitiveOutput := make(map[string]bool)
 	for k, v := range outputJSON {
 		if m, ok := v.(map[string]interface{}); ok {
 			processedOutput[k] = m["value"]
+			sensitiveOutput[k], _ = m["sensitive"].(bool)
 		} else {
 			processedOutput[k] = v
 		}
 	}
 
 	outputData := make(map[string]interface{})
+	var sensitiveKeys []string
 	for k := range msg.Package.Outputs {
 		if v, ok := processedOutput[k]; ok {
 			outputData[k] = v
+			if sensitiveOutput[k] {
+				sensitiveKeys = append(sensitiveKeys, k)
+			}
 		}
 	}
-
-	log.Printf("Processed %d Terraform outputs", len(outputData))
-	return outputData, nil
+	sort.Strings(sensitiveKeys)
+	return outputData, sensitiveKeys, nil
 }
 
-func (e *Executor) WriteOutputFile(packageID, deployDir string, outputData map[string]interface{}) error {
-	log.Printf("Writing output file for package: %s in directory: %s", packageID, deployDir)
-	filePath := filepath.Join(deployDir, fmt.Sprintf("%s_output.json", packageID))
+func (e *Executor) WriteOutputFile(ctx context.Context, packageID, deployDir string, outputData map[string]interface{}) error {
+	filePath := filepath.Join(deployDir, outputFileName(packageID))
 	err := e.writeJSONFile(filePath, outputData)
 	if err != nil {
-		log.Printf("Error writing output file: %v", err)
+		logging.FromContext(ctx).Error("Failed to write output file", "error", err)
 	} else {
-		log.Printf("Successfully wrote output file: %s", filePath)
+		logging.FromContext(ctx).Info("Wrote output file", "path", filePath)
 	}
 	return err
 }
 
-// todo: move this to rad-labs
-type OutputPayloadBody struct {
-	DeployStatus *string                `json:"deploy_status,omitempty"`
-	OutputData   map[string]interface{} `json:"output_data,omitempty"`
-	// errors and logs are added to the output data, which we will add a struct for shortly
-	// ErrorMessage string                 `json:"error_message,omitempty"`
-}
-
-func (e *Executor) PostOutputToAPI(projectID string, packageID string, outputData map[string]interface{}, action models.DeployStatus) error {
-	url := fmt.Sprintf("%s/provisioner/projects/%s/packages/%s", e.cfg.APIURL, projectID, packageID)
-	log.Printf("Posting output data for package: %s to API", url)
-
-	apiURL := e.cfg.APIURL
-	if apiURL == "" {
-		return fmt.Errorf("API_URL environment variable is not set")
+func (e *Executor) PostPayloadToAPI(ctx context.Context, projectID string, packageID string, payload canvasapi.OutputPayloadBody, idempotencyKey string) error {
+	logger := logging.FromContext(ctx)
+	logPayload := payload
+	logPayload.OutputData = sensitive.Redact(payload.OutputData, payload.SensitiveKeys)
+	if logData, err := json.Marshal(logPayload); err == nil {
+		logger.Debug("Posting package update to API", "payload", string(logData))
 	}
 
-	deployStatus := string(action)
-	payload := OutputPayloadBody{
-		DeployStatus: &deployStatus,
-		OutputData:   outputData,
+	if err := e.api.UpdatePackage(ctx, projectID, packageID, payload, idempotencyKey); err != nil {
+		metrics.APIPostFailures.Inc()
+		return err
 	}
 
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("error marshaling output data: %v", err)
-	}
-	log.Printf("JSON payload: %s", string(jsonData))
+	logger.Info("Posted package update to API", "idempotency_key", idempotencyKey)
+	return nil
+}
 
-	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("error creating HTTP request: %v", err)
-	}
+// runCommand runs a shell command in a span of its own. When ctx is cancelled
+// the command is interrupted, which lets terraform stop cleanly and release
+// its state lock, and killed if it doesn't exit within commandStopTimeout.
+func (e *Executor) runCommand(ctx context.Context, command, dir string) (string, error) {
+	return e.run(ctx, command, dir, true)
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-canvas-token", e.cfg.CanvasToken)
+// run is runCommand, logging the output of the command only with logOutput.
+func (e *Executor) run(ctx context.Context, command, dir string, logOutput bool) (output string, err error) {
+	logger := logging.FromContext(ctx).With("command", command)
+	logger.Info("Running command", "dir", dir)
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, command, trace.WithAttributes(attribute.String("dir", dir)))
+	defer func() { tracing.End(span, err) }()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("error sending HTTP request: %v", err)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	// its own process group, so the interrupt reaches terraform and not just
+	// the shell
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
 	}
-	defer resp.Body.Close()
-	log.Printf("Response status: %s", resp.Status)
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API request failed with status code: %d", resp.StatusCode)
+	cmd.WaitDelay = commandStopTimeout
+	if env := e.envFor(dir); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 
-	log.Printf("Successfully patched output data for package: %s to API", packageID)
-	return nil
-}
-
-func (e *Executor) runCommand(command, dir string) (string, error) {
-	log.Printf("Running command: %s in directory: %s", command, dir)
-	cmd := exec.Command("sh", "-c", command)
-	cmd.Dir = dir
-
-	output, err := cmd.CombinedOutput()
+	combined, err := cmd.CombinedOutput()
+	// Clean up the output
+	cleanedOutput := cleanTerraformOutput(string(combined))
+	if logOutput {
+		// shows up in the run log, and in the service log at debug level
+		logger.Debug("Command output", "output", cleanedOutput)
+	}
 	if err != nil {
-		log.Printf("Command failed: %v", err)
-		return "", err
+		// the output explains the failure, callers add it to their error
+		// which is scrubbed of secrets before it leaves the deployer
+		logger.Warn("Command failed", "error", err, "duration", time.Since(start))
+		return cleanedOutput, err
 	}
 
-	// Clean up the output
-	cleanedOutput := cleanTerraformOutput(string(output))
-
-	log.Printf("Command executed successfully")
+	logger.Info("Command completed", "duration", time.Since(start))
 	return cleanedOutput, nil
 }
 
+const commandStopTimeout = time.Minute
+
 func cleanTerraformOutput(output string) string {
 	// Split output into lines
 	lines := strings.Split(output, "\n")
@@ -317,22 +370,20 @@ func cleanTerraformOutput(output string) string {
 	return strings.Join(cleanedLines, "\n")
 }
 
+// writeJSONFile writes data to a 0600 file, inputs and outputs can hold
+// secrets.
 func (e *Executor) writeJSONFile(filepath string, data interface{}) error {
-	log.Printf("Writing JSON file: %s", filepath)
-	file, err := os.Create(filepath)
+	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Printf("Error creating file: %v", err)
 		return err
 	}
 	defer file.Close()
+	// the file may be left from a run that wrote it readable by everyone
+	if err := file.Chmod(0600); err != nil {
+		return err
+	}
 
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "  ")
-	err = encoder.Encode(data)
-	if err != nil {
-		log.Printf("Error encoding JSON: %v", err)
-	} else {
-		log.Printf("Successfully wrote JSON file: %s", filepath)
-	}
-	return err
+	return encoder.Encode(data)
 }
@@ -1,11 +1,21 @@
 package terraform
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi/canvasapitest"
 	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
 	"github.com/radiatus-ai/package-provisioner/pkg/models"
 )
 
@@ -27,16 +37,288 @@ func TestExecutor_CreateParameterFile(t *testing.T) {
 		ConnectedInputData: map[string]interface{}{"input1": "value1"},
 	}
 
-	err = executor.CreateParameterFile(msg, tempDir)
+	_, err = executor.CreateParameterFile(context.Background(), msg, tempDir)
 	if err != nil {
 		t.Errorf("CreateParameterFile() error = %v", err)
 	}
 
 	// Check if the file was created
 	paramFile := filepath.Join(tempDir, "test-package_inputs.auto.tfvars.json")
-	if _, err := os.Stat(paramFile); os.IsNotExist(err) {
-		t.Errorf("Parameter file was not created")
+	info, err := os.Stat(paramFile)
+	if os.IsNotExist(err) {
+		t.Fatalf("Parameter file was not created")
+	}
+	// connected inputs can be another package's sensitive outputs
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the parameter file to be 0600, got %v", info.Mode().Perm())
 	}
 
 	// Add more checks here to verify the content of the file
 }
+
+func TestMergeInputs(t *testing.T) {
+	tests := []struct {
+		name           string
+		pkg            models.Package
+		connected      map[string]interface{}
+		want           map[string]interface{}
+		wantOverridden []string
+		wantErr        bool
+	}{
+		{
+			name:           "connection wins by default",
+			pkg:            models.Package{ParameterData: map[string]interface{}{"host": "param", "port": 5432.0}},
+			connected:      map[string]interface{}{"host": "connection"},
+			want:           map[string]interface{}{"host": "connection", "port": 5432.0},
+			wantOverridden: []string{"host"},
+		},
+		{
+			name: "parameter wins",
+			pkg: models.Package{
+				ParameterData: map[string]interface{}{"host": "param"},
+				MergePolicy:   models.MergeParameterWins,
+			},
+			connected:      map[string]interface{}{"host": "connection", "user": "admin"},
+			want:           map[string]interface{}{"host": "param", "user": "admin"},
+			wantOverridden: []string{"host"},
+		},
+		{
+			name: "error on conflict",
+			pkg: models.Package{
+				ParameterData: map[string]interface{}{"host": "param"},
+				MergePolicy:   models.MergeError,
+			},
+			connected:      map[string]interface{}{"host": "connection"},
+			wantOverridden: []string{"host"},
+			wantErr:        true,
+		},
+		{
+			name: "equal values are not conflicts",
+			pkg: models.Package{
+				ParameterData: map[string]interface{}{"host": "same"},
+				MergePolicy:   models.MergeError,
+			},
+			connected: map[string]interface{}{"host": "same"},
+			want:      map[string]interface{}{"host": "same"},
+		},
+		{
+			name: "namespaced connections",
+			pkg: models.Package{
+				ParameterData:        map[string]interface{}{"host": "param"},
+				NamespaceConnections: true,
+				MergePolicy:          models.MergeError,
+			},
+			connected: map[string]interface{}{"database": map[string]interface{}{"host": "connection"}},
+			want: map[string]interface{}{
+				"host":        "param",
+				"connections": map[string]interface{}{"database": map[string]interface{}{"host": "connection"}},
+			},
+		},
+		{
+			name:    "unknown policy",
+			pkg:     models.Package{MergePolicy: "LAST_WRITE"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := models.DeploymentMessage{Package: tt.pkg, ConnectedInputData: tt.connected}
+			got, overridden, err := MergeInputs(msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MergeInputs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(overridden, tt.wantOverridden) {
+				t.Errorf("MergeInputs() overridden = %v, want %v", overridden, tt.wantOverridden)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MergeInputs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectedKeys(t *testing.T) {
+	msg := models.DeploymentMessage{
+		Package:            models.Package{ParameterData: map[string]interface{}{"region": "us-central1"}},
+		ConnectedInputData: map[string]interface{}{"host": "10.0.0.1", "db_password": "hunter2"},
+	}
+	if got := ConnectedKeys(msg); !reflect.DeepEqual(got, []string{"db_password", "host"}) {
+		t.Errorf("ConnectedKeys() = %v", got)
+	}
+	msg.Package.NamespaceConnections = true
+	if got := ConnectedKeys(msg); !reflect.DeepEqual(got, []string{models.ConnectionsInputKey}) {
+		t.Errorf("ConnectedKeys() of namespaced connections = %v", got)
+	}
+	if got := ConnectedKeys(models.DeploymentMessage{}); got != nil {
+		t.Errorf("ConnectedKeys() without connected inputs = %v", got)
+	}
+}
+
+func TestExecutor_CreateParameterFile_ParameterWins(t *testing.T) {
+	executor := NewExecutor(&config.Config{})
+	tempDir := t.TempDir()
+
+	msg := models.DeploymentMessage{
+		PackageID: "test-package",
+		Package: models.Package{
+			ParameterData: map[string]interface{}{"host": "param"},
+			MergePolicy:   models.MergeParameterWins,
+		},
+		ConnectedInputData: map[string]interface{}{"host": "connection"},
+	}
+
+	overridden, err := executor.CreateParameterFile(context.Background(), msg, tempDir)
+	if err != nil {
+		t.Fatalf("CreateParameterFile() error = %v", err)
+	}
+	if len(overridden) != 1 || overridden[0] != "host" {
+		t.Errorf("Expected overridden keys [host], got %v", overridden)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "test-package_inputs.auto.tfvars.json"))
+	if err != nil {
+		t.Fatalf("Failed to read parameter file: %v", err)
+	}
+	var inputs map[string]interface{}
+	if err := json.Unmarshal(data, &inputs); err != nil {
+		t.Fatalf("Failed to parse parameter file: %v", err)
+	}
+	if inputs["host"] != "param" {
+		t.Errorf("Expected host to keep the parameter value, got %v", inputs["host"])
+	}
+}
+
+func TestParseTerraformOutputs(t *testing.T) {
+	msg := models.DeploymentMessage{
+		Package: models.Package{
+			Outputs: map[string]interface{}{"host": nil, "password": nil, "missing": nil},
+		},
+	}
+	output := `{
+  "host": {"sensitive": false, "type": "string", "value": "10.0.0.1"},
+  "password": {"sensitive": true, "type": "string", "value": "hunter2"},
+  "undeclared": {"sensitive": true, "type": "string", "value": "ignored"}
+}`
+
+	outputData, sensitiveKeys, err := parseTerraformOutputs(msg, output)
+	if err != nil {
+		t.Fatalf("parseTerraformOutputs() error = %v", err)
+	}
+
+	want := map[string]interface{}{"host": "10.0.0.1", "password": "hunter2"}
+	if !reflect.DeepEqual(outputData, want) {
+		t.Errorf("parseTerraformOutputs() outputs = %v, want %v", outputData, want)
+	}
+	if !reflect.DeepEqual(sensitiveKeys, []string{"password"}) {
+		t.Errorf("parseTerraformOutputs() sensitive keys = %v, want [password]", sensitiveKeys)
+	}
+}
+
+func TestExecutor_PostPayloadToAPI_RedactsSensitiveOutputs(t *testing.T) {
+	server := canvasapitest.NewServer()
+	defer server.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	executor := NewExecutor(&config.Config{APIURL: server.URL})
+	status := string(models.Deployed)
+	payload := canvasapi.OutputPayloadBody{
+		DeployStatus:  &status,
+		OutputData:    map[string]interface{}{"host": "10.0.0.1", "password": "hunter2"},
+		SensitiveKeys: []string{"password"},
+	}
+	if err := executor.PostPayloadToAPI(context.Background(), "test-project", "test-package", payload, "run-1:DEPLOYED"); err != nil {
+		t.Fatalf("PostPayloadToAPI() error = %v", err)
+	}
+
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("Sensitive output leaked into logs: %s", logs.String())
+	}
+	updates := server.Updates()
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0].Payload.SensitiveKeys, []string{"password"}) {
+		t.Fatalf("Expected sensitive keys in the payload, got %+v", updates)
+	}
+	if updates[0].IdempotencyKey != "run-1:DEPLOYED" {
+		t.Errorf("Expected the idempotency key to be sent, got %q", updates[0].IdempotencyKey)
+	}
+}
+
+func TestExecutor_ProcessTerraformOutputs_KeepsOutputsOutOfRunLog(t *testing.T) {
+	// a terraform that only knows output -json
+	bin := t.TempDir()
+	script := `#!/bin/sh
+echo '{"password": {"sensitive": true, "value": "hunter2"}, "host": {"sensitive": false, "value": "10.0.0.1"}}'
+`
+	if err := os.WriteFile(filepath.Join(bin, "terraform"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake terraform: %v", err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var runLog bytes.Buffer
+	ctx := logging.Tee(context.Background(), &runLog)
+	msg := models.DeploymentMessage{Package: models.Package{Outputs: map[string]interface{}{"password": nil, "host": nil}}}
+	outputs, sensitiveKeys, err := NewExecutor(&config.Config{}).ProcessTerraformOutputs(ctx, msg, t.TempDir())
+	if err != nil {
+		t.Fatalf("ProcessTerraformOutputs() error = %v", err)
+	}
+	if outputs["password"] != "hunter2" || !reflect.DeepEqual(sensitiveKeys, []string{"password"}) {
+		t.Errorf("Unexpected outputs %v, sensitive %v", outputs, sensitiveKeys)
+	}
+	if strings.Contains(runLog.String(), "hunter2") {
+		t.Errorf("Sensitive output leaked into the run log: %s", runLog.String())
+	}
+}
+
+func TestExecutor_RunCommand_InterruptsOnCancel(t *testing.T) {
+	executor := NewExecutor(&config.Config{})
+	workspace := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	// a shell that exits cleanly on the interrupt, like terraform does
+	start := time.Now()
+	output, err := executor.runCommand(ctx, `trap 'echo interrupted; exit 1' INT; while true; do sleep 0.1; done`, workspace)
+	if err == nil {
+		t.Fatal("Expected the cancelled command to fail")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("Expected the command to stop promptly, took %s", time.Since(start))
+	}
+	if !strings.Contains(output, "interrupted") {
+		t.Errorf("Expected the command to be interrupted, got output %q", output)
+	}
+}
+
+func TestExecutor_CreateBackendFile(t *testing.T) {
+	msg := models.DeploymentMessage{ProjectID: "test-project", PackageID: "test-package"}
+	stateDir := t.TempDir()
+	tests := []struct {
+		name    string
+		cfg     *config.Config
+		want    string
+		wantErr bool
+	}{
+		{"gcs", &config.Config{BucketName: "test-bucket"}, `prefix = "projects/test-project/packages/test-package"`, false},
+		{"local", &config.Config{TerraformBackend: "local", LocalStatePath: stateDir}, `path = "` + filepath.Join(stateDir, "projects/test-project/packages/test-package/terraform.tfstate") + `"`, false},
+		{"unsupported", &config.Config{TerraformBackend: "s3"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployDir := t.TempDir()
+			err := NewExecutor(tt.cfg).CreateBackendFile(context.Background(), msg, deployDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateBackendFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			content, _ := os.ReadFile(filepath.Join(deployDir, backendFileName))
+			if !strings.Contains(string(content), `backend "`+tt.name+`"`) || !strings.Contains(string(content), tt.want) {
+				t.Errorf("Expected a %s backend with %s, got %s", tt.name, tt.want, content)
+			}
+		})
+	}
+}
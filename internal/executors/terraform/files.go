@@ -0,0 +1,70 @@
+package terraform
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+)
+
+func inputsFileName(packageID string) string {
+	return fmt.Sprintf("%s_inputs.auto.tfvars.json", packageID)
+}
+
+func outputFileName(packageID string) string {
+	return fmt.Sprintf("%s_output.json", packageID)
+}
+
+const backendFileName = "backend.tf"
+
+// GeneratedFiles returns the contents of the files written into a workspace
+// for a package, by name. Secrets, the inputs listed in connectedKeys and the
+// outputs listed in sensitiveKeys are masked, files that don't exist are left
+// out.
+func GeneratedFiles(deployDir, packageID string, connectedKeys, sensitiveKeys []string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, name := range []string{inputsFileName(packageID), secretsFileName(packageID), backendFileName, outputFileName(packageID)} {
+		data, err := os.ReadFile(filepath.Join(deployDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+
+		switch name {
+		case inputsFileName(packageID):
+			if len(connectedKeys) > 0 {
+				data, err = maskJSON(data, connectedKeys)
+			}
+		case secretsFileName(packageID):
+			data, err = maskJSON(data, nil)
+		case outputFileName(packageID):
+			if len(sensitiveKeys) > 0 {
+				data, err = maskJSON(data, sensitiveKeys)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to redact %s: %v", name, err)
+		}
+		files[name] = string(data)
+	}
+	return files, nil
+}
+
+// maskJSON masks the values of keys in a JSON object, or every value when
+// keys is nil.
+func maskJSON(data []byte, keys []string) ([]byte, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		for k := range values {
+			keys = append(keys, k)
+		}
+	}
+	return json.MarshalIndent(sensitive.Redact(values, keys), "", "  ")
+}
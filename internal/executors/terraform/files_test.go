@@ -0,0 +1,85 @@
+package terraform
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+func TestGeneratedFiles(t *testing.T) {
+	executor := NewExecutor(&config.Config{BucketName: "state"})
+	workspace := t.TempDir()
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package:   models.Package{ParameterData: map[string]interface{}{"region": "us-central1"}},
+		// an upstream output, possibly a sensitive one
+		ConnectedInputData: map[string]interface{}{"database_url": "postgres://app:upstream-secret@db"},
+		Secrets:            map[string]string{"db_password": "hunter2-secret"},
+	}
+	ctx := context.Background()
+	if _, err := executor.CreateParameterFile(ctx, msg, workspace); err != nil {
+		t.Fatal(err)
+	}
+	if err := executor.CreateSecretsFile(ctx, msg, workspace); err != nil {
+		t.Fatal(err)
+	}
+	if err := executor.CreateBackendFile(ctx, msg, workspace); err != nil {
+		t.Fatal(err)
+	}
+	outputs := map[string]interface{}{"host": "10.0.0.1", "password": "also-secret"}
+	if err := executor.WriteOutputFile(ctx, msg.PackageID, workspace, outputs); err != nil {
+		t.Fatal(err)
+	}
+	// not generated by the executor
+	os.WriteFile(filepath.Join(workspace, "main.tf"), []byte(`resource "null_resource" "x" {}`), 0644)
+
+	files, err := GeneratedFiles(workspace, msg.PackageID, ConnectedKeys(msg), []string{"password"})
+	if err != nil {
+		t.Fatalf("GeneratedFiles() error = %v", err)
+	}
+	if len(files) != 4 {
+		t.Errorf("Expected the 4 generated files, got %v", files)
+	}
+	if _, ok := files["main.tf"]; ok {
+		t.Error("Expected module sources to be left out")
+	}
+	for name, content := range files {
+		if strings.Contains(content, "hunter2-secret") || strings.Contains(content, "also-secret") || strings.Contains(content, "upstream-secret") {
+			t.Errorf("Expected secrets to be masked in %s, got %s", name, content)
+		}
+	}
+	if !strings.Contains(files["test-package_secrets.auto.tfvars.json"], sensitive.Mask) {
+		t.Errorf("Expected masked secrets, got %s", files["test-package_secrets.auto.tfvars.json"])
+	}
+	if !strings.Contains(files["test-package_output.json"], "10.0.0.1") {
+		t.Errorf("Expected non sensitive outputs as is, got %s", files["test-package_output.json"])
+	}
+	if !strings.Contains(files["test-package_inputs.auto.tfvars.json"], "us-central1") || !strings.Contains(files["backend.tf"], "state") {
+		t.Errorf("Expected inputs and backend as is, got %v", files)
+	}
+}
+
+func TestGeneratedFiles_NoSensitiveOutputs(t *testing.T) {
+	executor := NewExecutor(&config.Config{BucketName: "state"})
+	workspace := t.TempDir()
+	outputs := map[string]interface{}{"host": "10.0.0.1", "port": float64(5432)}
+	if err := executor.WriteOutputFile(context.Background(), "test-package", workspace, outputs); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := GeneratedFiles(workspace, "test-package", nil, nil)
+	if err != nil {
+		t.Fatalf("GeneratedFiles() error = %v", err)
+	}
+	output := files["test-package_output.json"]
+	if strings.Contains(output, sensitive.Mask) || !strings.Contains(output, "10.0.0.1") || !strings.Contains(output, "5432") {
+		t.Errorf("Expected outputs as is when none are sensitive, got %s", output)
+	}
+}
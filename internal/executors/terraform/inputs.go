@@ -0,0 +1,81 @@
+package terraform
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+// MergeInputs combines a package's parameters with its connected inputs
+// according to the package merge policy. It returns the merged inputs and the
+// keys where one side was discarded in favor of the other.
+func MergeInputs(msg models.DeploymentMessage) (map[string]interface{}, []string, error) {
+	combinedData := make(map[string]interface{})
+	for k, v := range msg.Package.ParameterData {
+		combinedData[k] = v
+	}
+
+	connectedData := msg.ConnectedInputData
+	if msg.Package.NamespaceConnections && len(msg.ConnectedInputData) > 0 {
+		connectedData = map[string]interface{}{
+			models.ConnectionsInputKey: msg.ConnectedInputData,
+		}
+	}
+
+	var conflicts []string
+	for k, v := range connectedData {
+		if existing, ok := combinedData[k]; ok && !reflect.DeepEqual(existing, v) {
+			conflicts = append(conflicts, k)
+		}
+	}
+	sort.Strings(conflicts)
+
+	policy := msg.Package.MergePolicy
+	if policy == "" {
+		policy = models.MergeConnectionWins
+	}
+
+	switch policy {
+	case models.MergeConnectionWins:
+		for k, v := range connectedData {
+			combinedData[k] = v
+		}
+	case models.MergeParameterWins:
+		for k, v := range connectedData {
+			if _, ok := combinedData[k]; !ok {
+				combinedData[k] = v
+			}
+		}
+	case models.MergeError:
+		if len(conflicts) > 0 {
+			return nil, conflicts, fmt.Errorf("connected inputs conflict with parameters: %s", strings.Join(conflicts, ", "))
+		}
+		for k, v := range connectedData {
+			combinedData[k] = v
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported merge policy: %s", policy)
+	}
+
+	return combinedData, conflicts, nil
+}
+
+// ConnectedKeys returns the keys of the merged inputs that carry connected
+// inputs, which may be sensitive outputs of upstream packages.
+func ConnectedKeys(msg models.DeploymentMessage) []string {
+	if len(msg.ConnectedInputData) == 0 {
+		return nil
+	}
+	if msg.Package.NamespaceConnections {
+		return []string{models.ConnectionsInputKey}
+	}
+	keys := make([]string, 0, len(msg.ConnectedInputData))
+	for k := range msg.ConnectedInputData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
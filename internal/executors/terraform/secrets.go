@@ -0,0 +1,167 @@
+package terraform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+const (
+	// secrets are written to <PackageID>_secrets.auto.tfvars.json in the workspace
+	SecretsModeFile = "file"
+	// secrets are passed as TF_VAR_* variables to the terraform processes only
+	SecretsModeEnv = "env"
+	// secrets are written to a 0600 file on tmpfs that is shredded after the run
+	SecretsModeTmpfs = "tmpfs"
+)
+
+func secretsFileName(packageID string) string {
+	return fmt.Sprintf("%s_secrets.auto.tfvars.json", packageID)
+}
+
+func (e *Executor) CreateSecretsFile(ctx context.Context, msg models.DeploymentMessage, deployDir string) error {
+	logger := logging.FromContext(ctx)
+
+	mode := e.cfg.SecretsMode
+	if mode == "" {
+		mode = SecretsModeFile
+	}
+
+	filePath := filepath.Join(deployDir, secretsFileName(msg.PackageID))
+	if mode != SecretsModeFile {
+		// don't leave secrets behind from runs in file mode
+		if err := shredFile(filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove old secrets file: %v", err)
+		}
+	}
+
+	switch mode {
+	case SecretsModeFile:
+		err := e.writeJSONFile(filePath, secretsData(msg.Secrets))
+		if err != nil {
+			logger.Error("Failed to create secrets file", "error", err)
+		} else {
+			logger.Info("Created secrets file", "path", filePath)
+		}
+		return err
+
+	case SecretsModeEnv:
+		env := make([]string, 0, len(msg.Secrets))
+		for k, v := range msg.Secrets {
+			// terraform parses TF_VAR_ values itself, strings as is and
+			// complex types as HCL, which JSON is valid for
+			env = append(env, fmt.Sprintf("TF_VAR_%s=%s", k, v))
+		}
+		e.setCommandEnv(deployDir, env)
+		logger.Info("Passing secrets to terraform through the environment", "secrets", len(env))
+		return nil
+
+	case SecretsModeTmpfs:
+		file, err := os.CreateTemp(e.cfg.SecretsTmpfsDir, msg.PackageID+"-*.tfvars.json")
+		if err != nil {
+			return fmt.Errorf("failed to create tmpfs secrets file: %v", err)
+		}
+		tmpPath := file.Name()
+		e.mu.Lock()
+		e.secretFiles[deployDir] = tmpPath
+		e.mu.Unlock()
+
+		err = file.Chmod(0600)
+		if err == nil {
+			err = json.NewEncoder(file).Encode(secretsData(msg.Secrets))
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write tmpfs secrets file: %v", err)
+		}
+
+		// only the commands that evaluate variables accept -var-file
+		varFile := "-var-file=" + tmpPath
+		e.setCommandEnv(deployDir, []string{
+			"TF_CLI_ARGS_plan=" + varFile,
+			"TF_CLI_ARGS_apply=" + varFile,
+			"TF_CLI_ARGS_destroy=" + varFile,
+		})
+		logger.Info("Created tmpfs secrets file", "path", tmpPath)
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported secrets mode: %s", mode)
+	}
+}
+
+// CleanupSecrets forgets the secrets handed to terraform for a deploy dir and
+// shreds any tmpfs secrets file. Secrets files written in file mode are left
+// in place.
+func (e *Executor) CleanupSecrets(ctx context.Context, deployDir string) error {
+	e.mu.Lock()
+	delete(e.commandEnv, deployDir)
+	tmpPath, ok := e.secretFiles[deployDir]
+	delete(e.secretFiles, deployDir)
+	e.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if err := shredFile(tmpPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to shred secrets file: %v", err)
+	}
+	logging.FromContext(ctx).Info("Shredded tmpfs secrets file", "path", tmpPath)
+	return nil
+}
+
+func (e *Executor) setCommandEnv(deployDir string, env []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commandEnv[deployDir] = env
+}
+
+func (e *Executor) envFor(deployDir string) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.commandEnv[deployDir]
+}
+
+func secretsData(secrets map[string]string) map[string]interface{} {
+	data := make(map[string]interface{})
+	for k, v := range secrets {
+		var jsonValue interface{}
+		err := json.Unmarshal([]byte(v), &jsonValue)
+		if err != nil {
+			// plain strings aren't JSON, don't log the error, it quotes the value
+			jsonValue = v
+		}
+		data[k] = jsonValue
+	}
+	return data
+}
+
+// shredFile overwrites a file with zeros before removing it.
+func shredFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(make([]byte, info.Size()))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
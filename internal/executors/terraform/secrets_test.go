@@ -0,0 +1,134 @@
+package terraform
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+const testSecret = "s3cr3t-value-that-must-not-persist"
+
+func secretsMessage() models.DeploymentMessage {
+	return models.DeploymentMessage{
+		PackageID: "test-package",
+		Secrets:   map[string]string{"db_password": testSecret},
+	}
+}
+
+// assertNoSecretBytes fails if any file under dir contains the secret.
+func assertNoSecretBytes(t *testing.T, dir string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, []byte(testSecret)) {
+			t.Errorf("Secret found on disk in %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk %s: %v", dir, err)
+	}
+}
+
+func TestExecutor_CreateSecretsFile_FileMode(t *testing.T) {
+	executor := NewExecutor(&config.Config{SecretsMode: SecretsModeFile})
+	workspace := t.TempDir()
+
+	if err := executor.CreateSecretsFile(context.Background(), secretsMessage(), workspace); err != nil {
+		t.Fatalf("CreateSecretsFile() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(workspace, "test-package_secrets.auto.tfvars.json"))
+	if err != nil {
+		t.Fatalf("Expected secrets file in the workspace: %v", err)
+	}
+	if !strings.Contains(string(data), testSecret) {
+		t.Errorf("Expected secrets file to contain the secret, got %s", data)
+	}
+}
+
+func TestExecutor_CreateSecretsFile_EnvMode(t *testing.T) {
+	executor := NewExecutor(&config.Config{SecretsMode: SecretsModeEnv})
+	workspace := t.TempDir()
+
+	// a secrets file left over from an earlier run in file mode
+	stale := filepath.Join(workspace, "test-package_secrets.auto.tfvars.json")
+	if err := os.WriteFile(stale, []byte(`{"db_password": "`+testSecret+`"}`), 0644); err != nil {
+		t.Fatalf("Failed to write stale secrets file: %v", err)
+	}
+
+	if err := executor.CreateSecretsFile(context.Background(), secretsMessage(), workspace); err != nil {
+		t.Fatalf("CreateSecretsFile() error = %v", err)
+	}
+
+	output, err := executor.runCommand(context.Background(), "printenv TF_VAR_db_password", workspace)
+	if err != nil || output != testSecret {
+		t.Errorf("Expected TF_VAR_db_password in the command environment, got %q (err %v)", output, err)
+	}
+	assertNoSecretBytes(t, workspace)
+
+	if err := executor.CleanupSecrets(context.Background(), workspace); err != nil {
+		t.Fatalf("CleanupSecrets() error = %v", err)
+	}
+	if output, _ := executor.runCommand(context.Background(), "printenv TF_VAR_db_password || true", workspace); output != "" {
+		t.Errorf("Expected the secret to be gone from the environment after cleanup, got %q", output)
+	}
+	if _, ok := os.LookupEnv("TF_VAR_db_password"); ok {
+		t.Error("Secret leaked into the provisioner's own environment")
+	}
+}
+
+func TestExecutor_CreateSecretsFile_TmpfsMode(t *testing.T) {
+	tmpfs := t.TempDir()
+	executor := NewExecutor(&config.Config{SecretsMode: SecretsModeTmpfs, SecretsTmpfsDir: tmpfs})
+	workspace := t.TempDir()
+
+	if err := executor.CreateSecretsFile(context.Background(), secretsMessage(), workspace); err != nil {
+		t.Fatalf("CreateSecretsFile() error = %v", err)
+	}
+	assertNoSecretBytes(t, workspace)
+
+	files, _ := filepath.Glob(filepath.Join(tmpfs, "test-package-*.tfvars.json"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one tmpfs secrets file, got %v", files)
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatalf("Failed to stat tmpfs secrets file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected tmpfs secrets file mode 0600, got %v", info.Mode().Perm())
+	}
+
+	output, err := executor.runCommand(context.Background(), "printenv TF_CLI_ARGS_apply", workspace)
+	if err != nil || output != "-var-file="+files[0] {
+		t.Errorf("Expected apply to be pointed at the tmpfs file, got %q (err %v)", output, err)
+	}
+
+	if err := executor.CleanupSecrets(context.Background(), workspace); err != nil {
+		t.Fatalf("CleanupSecrets() error = %v", err)
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("Expected tmpfs secrets file to be shredded, stat error = %v", err)
+	}
+	assertNoSecretBytes(t, tmpfs)
+	assertNoSecretBytes(t, workspace)
+}
+
+func TestExecutor_CreateSecretsFile_UnknownMode(t *testing.T) {
+	executor := NewExecutor(&config.Config{SecretsMode: "carrier-pigeon"})
+	if err := executor.CreateSecretsFile(context.Background(), secretsMessage(), t.TempDir()); err == nil {
+		t.Error("Expected an unknown secrets mode to fail")
+	}
+}
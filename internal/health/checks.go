@@ -0,0 +1,114 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+// TerraformVersion checks that the terraform binary runs.
+func TerraformVersion(binary string) Check {
+	return func(ctx context.Context) error {
+		output, err := exec.CommandContext(ctx, binary, "version", "-json").Output()
+		if err != nil {
+			return fmt.Errorf("failed to run %s version: %v", binary, err)
+		}
+		var version struct {
+			TerraformVersion string `json:"terraform_version"`
+		}
+		if err := json.Unmarshal(output, &version); err != nil || version.TerraformVersion == "" {
+			return fmt.Errorf("unexpected %s version output: %q", binary, output)
+		}
+		return nil
+	}
+}
+
+// ReadableDir checks that path is a directory that can be listed and isn't
+// empty, an unmounted volume usually shows up as an empty directory.
+func ReadableDir(path string) Check {
+	return func(ctx context.Context) error {
+		dir, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		if _, err := dir.Readdirnames(1); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%s is empty", path)
+			}
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		return nil
+	}
+}
+
+// DiskSpace checks that the filesystem of path has at least minFree bytes
+// available.
+func DiskSpace(path string, minFree uint64) Check {
+	return func(ctx context.Context) error {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err != nil {
+			return fmt.Errorf("failed to stat filesystem of %s: %v", path, err)
+		}
+		free := stat.Bavail * uint64(stat.Bsize)
+		if free < minFree {
+			return fmt.Errorf("%d MB free in %s, need %d MB", free>>20, path, minFree>>20)
+		}
+		return nil
+	}
+}
+
+// Fresh checks that last, the time a worker last made progress, is no older
+// than maxAge.
+func Fresh(last func() time.Time, maxAge time.Duration) Check {
+	return func(ctx context.Context) error {
+		t := last()
+		if t.IsZero() {
+			return fmt.Errorf("not started")
+		}
+		if age := time.Since(t); age > maxAge {
+			return fmt.Errorf("no progress for %s", age.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// BucketProber reports whether the state backend bucket can be used.
+type BucketProber interface {
+	ProbeBucket(ctx context.Context, bucket string) error
+}
+
+func Bucket(prober BucketProber, bucket string) Check {
+	return func(ctx context.Context) error {
+		return prober.ProbeBucket(ctx, bucket)
+	}
+}
+
+// GCSProber lists a single object, which needs the same access the terraform
+// gcs backend does.
+type GCSProber struct {
+	service *storage.Service
+}
+
+func NewGCSProber(ctx context.Context) (*GCSProber, error) {
+	service, err := storage.NewService(ctx, option.WithScopes(storage.DevstorageReadOnlyScope))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %v", err)
+	}
+	return &GCSProber{service: service}, nil
+}
+
+func (p *GCSProber) ProbeBucket(ctx context.Context, bucket string) error {
+	if _, err := p.service.Objects.List(bucket).MaxResults(1).Fields("items/name").Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to list bucket %s: %v", bucket, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "terraform")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTerraformVersion(t *testing.T) {
+	ok := writeScript(t, `echo '{"terraform_version":"1.5.7"}'`)
+	if err := TerraformVersion(ok)(context.Background()); err != nil {
+		t.Errorf("Expected the check to pass, got %v", err)
+	}
+
+	garbled := writeScript(t, `echo 'Terraform v1.5.7'`)
+	if err := TerraformVersion(garbled)(context.Background()); err == nil {
+		t.Error("Expected the check to fail on unexpected output")
+	}
+
+	missing := filepath.Join(t.TempDir(), "terraform")
+	if err := TerraformVersion(missing)(context.Background()); err == nil {
+		t.Error("Expected the check to fail without a binary")
+	}
+}
+
+func TestReadableDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := ReadableDir(dir)(context.Background()); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("Expected an empty directory to fail, got %v", err)
+	}
+
+	os.Mkdir(filepath.Join(dir, "postgres"), 0755)
+	if err := ReadableDir(dir)(context.Background()); err != nil {
+		t.Errorf("Expected the check to pass, got %v", err)
+	}
+
+	if err := ReadableDir(filepath.Join(dir, "missing"))(context.Background()); err == nil {
+		t.Error("Expected a missing directory to fail")
+	}
+}
+
+func TestDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	if err := DiskSpace(dir, 1)(context.Background()); err != nil {
+		t.Errorf("Expected the check to pass, got %v", err)
+	}
+	if err := DiskSpace(dir, 1<<62)(context.Background()); err == nil {
+		t.Error("Expected the check to fail when too little space is free")
+	}
+	if err := DiskSpace(filepath.Join(dir, "missing"), 1)(context.Background()); err == nil {
+		t.Error("Expected a missing path to fail")
+	}
+}
+
+func TestFresh(t *testing.T) {
+	var last time.Time
+	check := Fresh(func() time.Time { return last }, time.Minute)
+
+	if err := check(context.Background()); err == nil {
+		t.Error("Expected a worker that never ran to fail")
+	}
+	last = time.Now()
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Expected the check to pass, got %v", err)
+	}
+	last = time.Now().Add(-time.Hour)
+	if err := check(context.Background()); err == nil {
+		t.Error("Expected a stale worker to fail")
+	}
+}
+
+type fakeProber struct {
+	err    error
+	bucket string
+}
+
+func (p *fakeProber) ProbeBucket(ctx context.Context, bucket string) error {
+	p.bucket = bucket
+	return p.err
+}
+
+func TestBucket(t *testing.T) {
+	prober := &fakeProber{}
+	if err := Bucket(prober, "state")(context.Background()); err != nil || prober.bucket != "state" {
+		t.Errorf("Expected the state bucket to be probed, got %v for %q", err, prober.bucket)
+	}
+	prober.err = errors.New("forbidden")
+	if err := Bucket(prober, "state")(context.Background()); err == nil {
+		t.Error("Expected the probe error")
+	}
+}
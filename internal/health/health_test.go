@@ -0,0 +1,70 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChecker_Run(t *testing.T) {
+	checker := NewChecker(50 * time.Millisecond)
+	checker.Add("ok", func(ctx context.Context) error { return nil })
+	checker.Add("broken", func(ctx context.Context) error { return errors.New("boom") })
+	checker.Add("hung", func(ctx context.Context) error {
+		select {}
+	})
+	checker.Add("panics", func(ctx context.Context) error { panic("oops") })
+
+	report := checker.Run(context.Background())
+	if report.Status != StatusFail {
+		t.Errorf("Expected the report to fail, got %s", report.Status)
+	}
+	if report.Checks["ok"].Status != StatusOK {
+		t.Errorf("Expected ok to pass, got %+v", report.Checks["ok"])
+	}
+	if r := report.Checks["broken"]; r.Status != StatusFail || r.Error != "boom" {
+		t.Errorf("Expected broken to fail with its error, got %+v", r)
+	}
+	for _, name := range []string{"hung", "panics"} {
+		if report.Checks[name].Status != StatusFail {
+			t.Errorf("Expected %s to fail, got %+v", name, report.Checks[name])
+		}
+	}
+}
+
+func TestChecker_Handler(t *testing.T) {
+	healthy := true
+	checker := NewChecker(time.Second)
+	checker.Add("worker", func(ctx context.Context) error {
+		if !healthy {
+			return errors.New("stuck")
+		}
+		return nil
+	})
+
+	for _, tc := range []struct {
+		healthy    bool
+		wantStatus int
+	}{
+		{true, http.StatusOK},
+		{false, http.StatusServiceUnavailable},
+	} {
+		healthy = tc.healthy
+		rec := httptest.NewRecorder()
+		checker.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("healthy=%v: expected status %d, got %d", tc.healthy, tc.wantStatus, rec.Code)
+		}
+		var report Report
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatalf("Failed to decode report: %v", err)
+		}
+		if _, ok := report.Checks["worker"]; !ok {
+			t.Errorf("Expected the worker check in the report, got %+v", report)
+		}
+	}
+}
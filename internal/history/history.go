@@ -0,0 +1,219 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+// Run is the record of a single deployment or destroy of a package.
+type Run struct {
+	ID          string                  `json:"id"`
+	ProjectID   string                  `json:"project_id"`
+	PackageID   string                  `json:"package_id"`
+	PackageType string                  `json:"package_type"`
+	Action      models.DeploymentAction `json:"action"`
+	Status      models.DeployStatus     `json:"status"`
+	// the generation of the message the run is for, zero when it had none
+	Generation  int64               `json:"generation,omitempty"`
+	Connections []models.Connection `json:"connections,omitempty"`
+	// keys whose value was discarded when merging parameters and connected inputs
+	OverriddenKeys []string `json:"overridden_keys,omitempty"`
+	// input keys set from connected packages, masked when showing the inputs
+	ConnectedKeys []string `json:"connected_keys,omitempty"`
+	// as sent to the API, with the values of SensitiveKeys protected
+	Outputs       map[string]interface{} `json:"outputs,omitempty"`
+	SensitiveKeys []string               `json:"sensitive_keys,omitempty"`
+	Error         string                 `json:"error,omitempty"`
+	// every status change of the package during the run, oldest first
+	Transitions []models.StatusTransition `json:"transitions,omitempty"`
+	StartedAt   time.Time                 `json:"started_at"`
+	FinishedAt  time.Time                 `json:"finished_at,omitempty"`
+}
+
+func NewRun(msg models.DeploymentMessage) *Run {
+	return &Run{
+		ID:          uuid.NewString(),
+		ProjectID:   msg.ProjectID,
+		PackageID:   msg.PackageID,
+		PackageType: msg.Package.Type,
+		Action:      msg.Action,
+		Generation:  msg.Generation,
+		Connections: msg.Connections,
+		StartedAt:   time.Now().UTC(),
+	}
+}
+
+// Transition moves the run to a new status if the package lifecycle allows
+// it and records when it happened.
+func (r *Run) Transition(to models.DeployStatus) (models.StatusTransition, error) {
+	if err := models.ValidateTransition(r.Status, to); err != nil {
+		return models.StatusTransition{}, err
+	}
+	transition := models.StatusTransition{From: r.Status, To: to, At: time.Now().UTC()}
+	r.Status = to
+	r.Transitions = append(r.Transitions, transition)
+	return transition, nil
+}
+
+// ErrNotFound is returned for a run the store has no record of.
+var ErrNotFound = errors.New("run not found")
+
+type Store interface {
+	Save(run *Run) error
+	Get(packageID, runID string) (*Run, error)
+	List(packageID string) ([]*Run, error)
+	LastDeployed(packageID string) (*Run, error)
+	Dependents(projectID, packageID string) ([]*Run, error)
+}
+
+// FileStore keeps one JSON file per run under <root>/<packageID>/.
+type FileStore struct {
+	root string
+	mu   sync.Mutex
+}
+
+func NewFileStore(root string) *FileStore {
+	return &FileStore{root: root}
+}
+
+func (s *FileStore) Save(run *Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.root, run.PackageID)
+	// runs hold the outputs of a package, sensitive ones only protected as
+	// much as SensitiveOutputMode asks for
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create history directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal run: %v", err)
+	}
+
+	// write then rename so readers never see a partial record
+	path := filepath.Join(dir, run.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write run: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get returns a single run of a package, or ErrNotFound.
+func (s *FileStore) Get(packageID, runID string) (*Run, error) {
+	if !models.ValidID(packageID) || !models.ValidID(runID) {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(filepath.Join(s.root, packageID, runID+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run %s: %v", runID, err)
+	}
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse run %s: %v", runID, err)
+	}
+	return &run, nil
+}
+
+// List returns the runs of a package, oldest first.
+func (s *FileStore) List(packageID string) ([]*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(s.root, packageID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history directory: %v", err)
+	}
+
+	var runs []*Run
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.root, packageID, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read run %s: %v", entry.Name(), err)
+		}
+		var run Run
+		if err := json.Unmarshal(data, &run); err != nil {
+			return nil, fmt.Errorf("failed to parse run %s: %v", entry.Name(), err)
+		}
+		runs = append(runs, &run)
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt.Before(runs[j].StartedAt)
+	})
+	return runs, nil
+}
+
+// LastDeployed returns the most recent successful deploy of a package, or nil
+// if it has never been deployed or was destroyed since.
+func (s *FileStore) LastDeployed(packageID string) (*Run, error) {
+	runs, err := s.List(packageID)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(runs) - 1; i >= 0; i-- {
+		switch runs[i].Status {
+		case models.Deployed:
+			return runs[i], nil
+		case models.Destroyed:
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+// Dependents returns the last deployed run of every package in the project
+// that is connected to the given package.
+func (s *FileStore) Dependents(projectID, packageID string) ([]*Run, error) {
+	entries, err := os.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history directory: %v", err)
+	}
+
+	var dependents []*Run
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == packageID {
+			continue
+		}
+		run, err := s.LastDeployed(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if run == nil || run.ProjectID != projectID {
+			continue
+		}
+		for _, conn := range run.Connections {
+			if conn.SourcePackageID == packageID {
+				dependents = append(dependents, run)
+				break
+			}
+		}
+	}
+	return dependents, nil
+}
@@ -0,0 +1,122 @@
+package history
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+func TestFileStore_SaveAndList(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package:   models.Package{Type: "test-type"},
+		Action:    models.ActionDeploy,
+	}
+
+	first := NewRun(msg)
+	first.Status = models.Deployed
+	first.Outputs = map[string]interface{}{"host": "10.0.0.1"}
+
+	second := NewRun(msg)
+	second.StartedAt = first.StartedAt.Add(time.Minute)
+	second.Status = models.Failed
+
+	for _, run := range []*Run{second, first} {
+		if err := store.Save(run); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+
+	runs, err := store.List("test-package")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(runs) != 2 || runs[0].ID != first.ID || runs[1].ID != second.ID {
+		t.Fatalf("Expected runs ordered by start time, got %+v", runs)
+	}
+
+	last, err := store.LastDeployed("test-package")
+	if err != nil {
+		t.Fatalf("LastDeployed() error = %v", err)
+	}
+	if last == nil || last.ID != first.ID {
+		t.Fatalf("Expected last deployed run %s, got %+v", first.ID, last)
+	}
+	if last.Outputs["host"] != "10.0.0.1" {
+		t.Errorf("Expected outputs to round trip, got %v", last.Outputs)
+	}
+	if info, err := os.Stat(filepath.Join(store.root, "test-package", first.ID+".json")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the run to be readable by the provisioner only, got %v (err %v)", info.Mode(), err)
+	}
+}
+
+func TestFileStore_LastDeployed_Destroyed(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	msg := models.DeploymentMessage{ProjectID: "test-project", PackageID: "test-package", Action: models.ActionDeploy}
+	deployed := NewRun(msg)
+	deployed.Status = models.Deployed
+	destroyed := NewRun(msg)
+	destroyed.StartedAt = deployed.StartedAt.Add(time.Minute)
+	destroyed.Status = models.Destroyed
+	for _, run := range []*Run{deployed, destroyed} {
+		store.Save(run)
+	}
+
+	run, err := store.LastDeployed("test-package")
+	if err != nil || run != nil {
+		t.Errorf("Expected no deployed run after a destroy, got %+v (err %v)", run, err)
+	}
+
+	// a failed deploy after the destroy still leaves nothing deployed
+	failed := NewRun(msg)
+	failed.StartedAt = destroyed.StartedAt.Add(time.Minute)
+	failed.Status = models.Failed
+	store.Save(failed)
+	if run, _ := store.LastDeployed("test-package"); run != nil {
+		t.Errorf("Expected no deployed run, got %+v", run)
+	}
+}
+
+func TestFileStore_LastDeployed_Missing(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	run, err := store.LastDeployed("unknown")
+	if err != nil {
+		t.Fatalf("LastDeployed() error = %v", err)
+	}
+	if run != nil {
+		t.Errorf("Expected no run, got %+v", run)
+	}
+}
+
+func TestFileStore_Get(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	run := NewRun(models.DeploymentMessage{ProjectID: "test-project", PackageID: "test-package", Action: models.ActionDeploy})
+	run.Status = models.Failed
+	if err := store.Save(run); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	got, err := store.Get("test-package", run.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.ID != run.ID || got.Status != models.Failed {
+		t.Errorf("Expected the saved run, got %+v", got)
+	}
+
+	for _, ids := range [][2]string{
+		{"test-package", "unknown"},
+		{"other-package", run.ID},
+		{"..", "test-package/" + run.ID},
+	} {
+		if _, err := store.Get(ids[0], ids[1]); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q, %q) error = %v, want ErrNotFound", ids[0], ids[1], err)
+		}
+	}
+}
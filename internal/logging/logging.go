@@ -0,0 +1,184 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LevelCritical is above slog.LevelError, for failures that need a human.
+const LevelCritical = slog.Level(12)
+
+// Cloud Logging picks these keys up from JSON lines written to stderr.
+const (
+	severityKey = "severity"
+	messageKey  = "message"
+	traceKey    = "logging.googleapis.com/trace"
+	spanKey     = "logging.googleapis.com/spanId"
+	sampledKey  = "logging.googleapis.com/trace_sampled"
+)
+
+// Field names attached to every line logged for a message or run.
+const (
+	MessageID = "message_id"
+	RunID     = "run_id"
+	ProjectID = "project_id"
+	PackageID = "package_id"
+	Action    = "action"
+)
+
+// New returns a logger writing JSON lines in the Cloud Logging format, or
+// plain text for local development.
+func New(w io.Writer, level slog.Level, format, gcpProject string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceAttr}
+	var handler slog.Handler
+	if format == "text" {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(&traceHandler{Handler: handler, project: gcpProject})
+}
+
+// NewFromConfig logs to w, which should scrub secrets, at the configured level
+// and format.
+func NewFromConfig(cfg *config.Config, w io.Writer) (*slog.Logger, error) {
+	level, err := ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.LogFormat {
+	case "", "json", "text":
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", cfg.LogFormat)
+	}
+	return New(w, level, cfg.LogFormat, cfg.ProjectID), nil
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %s", s)
+}
+
+// replaceAttr renames the level and message keys to the ones Cloud Logging
+// expects and maps the levels to its severities.
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		a.Key = severityKey
+		a.Value = slog.StringValue(severity(a.Value.Any().(slog.Level)))
+	case slog.MessageKey:
+		a.Key = messageKey
+	}
+	return a
+}
+
+func severity(level slog.Level) string {
+	switch {
+	case level >= LevelCritical:
+		return "CRITICAL"
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// traceHandler links lines logged with a traced context to the trace, so
+// Cloud Logging shows them alongside it.
+type traceHandler struct {
+	slog.Handler
+	project string
+}
+
+func (h *traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		traceID := sc.TraceID().String()
+		if h.project != "" {
+			traceID = fmt.Sprintf("projects/%s/traces/%s", h.project, traceID)
+		}
+		r.AddAttrs(
+			slog.String(traceKey, traceID),
+			slog.String(spanKey, sc.SpanID().String()),
+			slog.Bool(sampledKey, sc.IsSampled()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &traceHandler{Handler: h.Handler.WithAttrs(attrs), project: h.project}
+}
+
+func (h *traceHandler) WithGroup(name string) slog.Handler {
+	return &traceHandler{Handler: h.Handler.WithGroup(name), project: h.project}
+}
+
+type loggerKey struct{}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With returns a context whose logger adds args to every line.
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, FromContext(ctx).With(args...))
+}
+
+// Tee returns a context whose logger also writes every line, down to debug,
+// as JSON to w, e.g. the log of a single run.
+func Tee(ctx context.Context, w io.Writer) context.Context {
+	handler := &teeHandler{FromContext(ctx).Handler(), New(w, slog.LevelDebug, "json", "").Handler()}
+	return context.WithValue(ctx, loggerKey{}, slog.New(handler))
+}
+
+type teeHandler [2]slog.Handler
+
+func (h *teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h[0].Enabled(ctx, level) || h[1].Enabled(ctx, level)
+}
+
+func (h *teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, handler := range h {
+		if handler.Enabled(ctx, r.Level) {
+			if handleErr := handler.Handle(ctx, r.Clone()); handleErr != nil {
+				err = handleErr
+			}
+		}
+	}
+	return err
+}
+
+func (h *teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &teeHandler{h[0].WithAttrs(attrs), h[1].WithAttrs(attrs)}
+}
+
+func (h *teeHandler) WithGroup(name string) slog.Handler {
+	return &teeHandler{h[0].WithGroup(name), h[1].WithGroup(name)}
+}
@@ -0,0 +1,170 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/scrub"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Failed to decode log line %q: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestNew_Severity(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelDebug, "json", "")
+
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+	logger.Log(context.Background(), LevelCritical, "critical")
+
+	want := []string{"DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL"}
+	lines := decodeLines(t, &buf)
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d lines, got %d", len(want), len(lines))
+	}
+	for i, line := range lines {
+		if line["severity"] != want[i] {
+			t.Errorf("Line %d: expected severity %s, got %v", i, want[i], line["severity"])
+		}
+		if line["message"] == nil || line["msg"] != nil || line["level"] != nil {
+			t.Errorf("Line %d: expected Cloud Logging keys, got %v", i, line)
+		}
+	}
+}
+
+func TestNew_Level(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelWarn, "json", "")
+
+	logger.Info("dropped")
+	logger.Warn("kept")
+
+	lines := decodeLines(t, &buf)
+	if len(lines) != 1 || lines[0]["message"] != "kept" {
+		t.Errorf("Expected only the warning, got %v", lines)
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(logger *slog.Logger) { slog.SetDefault(logger) }(slog.Default())
+	slog.SetDefault(New(&buf, slog.LevelInfo, "json", ""))
+
+	ctx := With(context.Background(), MessageID, "msg-1")
+	ctx = With(ctx, RunID, "run-1", PackageID, "pkg-1")
+	FromContext(ctx).Info("hello", "extra", 1)
+	FromContext(context.Background()).Info("bare")
+
+	lines := decodeLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	for key, want := range map[string]string{MessageID: "msg-1", RunID: "run-1", PackageID: "pkg-1"} {
+		if lines[0][key] != want {
+			t.Errorf("Expected %s = %s, got %v", key, want, lines[0][key])
+		}
+	}
+	if lines[1][RunID] != nil {
+		t.Errorf("Expected no run fields without a context logger, got %v", lines[1])
+	}
+}
+
+func TestNew_TraceFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo, "json", "my-project")
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	logger.InfoContext(ctx, "traced")
+	logger.Info("untraced")
+
+	lines := decodeLines(t, &buf)
+	wantTrace := "projects/my-project/traces/" + sc.TraceID().String()
+	if lines[0][traceKey] != wantTrace {
+		t.Errorf("Expected trace %s, got %v", wantTrace, lines[0][traceKey])
+	}
+	if lines[0][spanKey] != sc.SpanID().String() || lines[0][sampledKey] != true {
+		t.Errorf("Expected span fields, got %v", lines[0])
+	}
+	if lines[1][traceKey] != nil {
+		t.Errorf("Expected no trace fields without a span, got %v", lines[1])
+	}
+}
+
+func TestNew_Scrubbed(t *testing.T) {
+	registry := scrub.NewRegistry()
+	release := registry.Register("hunter2-secret")
+	defer release()
+
+	var buf bytes.Buffer
+	logger := New(scrub.NewWriter(registry, &buf), slog.LevelInfo, "json", "")
+	logger.Error("Run failed", "error", "bad password hunter2-secret")
+
+	if strings.Contains(buf.String(), "hunter2-secret") {
+		t.Errorf("Expected the secret to be scrubbed, got %s", buf.String())
+	}
+	decodeLines(t, &buf)
+}
+
+func TestNewFromConfig(t *testing.T) {
+	if _, err := NewFromConfig(&config.Config{LogLevel: "verbose"}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+	if _, err := NewFromConfig(&config.Config{LogFormat: "xml"}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+
+	var buf bytes.Buffer
+	logger, err := NewFromConfig(&config.Config{LogLevel: "debug", LogFormat: "text"}, &buf)
+	if err != nil {
+		t.Fatalf("NewFromConfig() error = %v", err)
+	}
+	logger.Debug("hello")
+	if !strings.Contains(buf.String(), "severity=DEBUG") || !strings.Contains(buf.String(), "message=hello") {
+		t.Errorf("Expected a text line, got %q", buf.String())
+	}
+}
+
+func TestTee(t *testing.T) {
+	var main, run bytes.Buffer
+	defer func(logger *slog.Logger) { slog.SetDefault(logger) }(slog.Default())
+	slog.SetDefault(New(&main, slog.LevelInfo, "json", ""))
+
+	ctx := With(context.Background(), RunID, "run-1")
+	ctx = Tee(ctx, &run)
+	logger := FromContext(ctx).With("command", "terraform plan")
+	logger.Debug("Command output", "output", "No changes.")
+	logger.Info("Command completed")
+
+	mainLines := decodeLines(t, &main)
+	if len(mainLines) != 1 || mainLines[0]["message"] != "Command completed" || mainLines[0][RunID] != "run-1" {
+		t.Errorf("Expected only the info line with run fields in the main log, got %v", mainLines)
+	}
+	runLines := decodeLines(t, &run)
+	if len(runLines) != 2 || runLines[0]["output"] != "No changes." || runLines[1]["command"] != "terraform plan" {
+		t.Errorf("Expected every line in the run log, got %v", runLines)
+	}
+}
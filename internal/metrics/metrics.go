@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "provisioner"
+
+// Registry holds every provisioner metric, along with the go runtime and
+// process collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Pub/Sub push messages received, by result.",
+	}, []string{"result"})
+
+	DeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dead_letters_total",
+		Help:      "Messages handed to the dead letter sink, by reason.",
+	}, []string{"reason"})
+
+	// messages acknowledged to Pub/Sub and not processed yet
+	QueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Messages accepted and waiting for or being processed.",
+	})
+
+	Deployments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deployments_total",
+		Help:      "Package runs finished, by action, final status and package type.",
+	}, []string{"action", "status", "package_type"})
+
+	DeploymentDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "deployment_duration_seconds",
+		Help:      "Duration of package runs, by action and package type.",
+		Buckets:   []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"action", "package_type"})
+
+	ActiveRuns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_runs",
+		Help:      "Package runs in progress.",
+	})
+
+	CommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "terraform_command_duration_seconds",
+		Help:      "Duration of terraform commands, by phase and result.",
+		Buckets:   []float64{0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	}, []string{"phase", "result"})
+
+	APIPostFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_post_failures_total",
+		Help:      "Status updates the API or another reporter failed to accept.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		MessagesReceived,
+		DeadLetters,
+		QueueDepth,
+		Deployments,
+		DeploymentDuration,
+		ActiveRuns,
+		CommandDuration,
+		APIPostFailures,
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Result labels the outcome of an operation.
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// ObserveCommand records how long a terraform command of a phase took.
+func ObserveCommand(phase string, start time.Time, err error) {
+	CommandDuration.WithLabelValues(phase, Result(err)).Observe(time.Since(start).Seconds())
+}
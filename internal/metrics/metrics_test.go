@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandler(t *testing.T) {
+	Deployments.WithLabelValues("DEPLOY", "DEPLOYED", "test-type").Inc()
+	ObserveCommand("apply", time.Now().Add(-time.Second), errors.New("exit status 1"))
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rr.Body)
+
+	for _, want := range []string{
+		`provisioner_deployments_total{action="DEPLOY",package_type="test-type",status="DEPLOYED"} 1`,
+		`provisioner_terraform_command_duration_seconds_count{phase="apply",result="error"} 1`,
+		"provisioner_queue_depth 0",
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected %q in the metrics output", want)
+		}
+	}
+}
+
+func TestObserveCommand(t *testing.T) {
+	before := testutil.CollectAndCount(CommandDuration)
+	ObserveCommand("plan", time.Now(), nil)
+	if got := testutil.CollectAndCount(CommandDuration); got != before+1 {
+		t.Errorf("Expected a new plan series, got %d series after %d", got, before)
+	}
+}
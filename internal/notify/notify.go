@@ -0,0 +1,307 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/report"
+	"github.com/radiatus-ai/package-provisioner/internal/webhook"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+// Hook is an outbound webhook fired on package status transitions.
+type Hook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// base64 HMAC-SHA256 key the body is signed with, see webhook.Sign
+	Secret string `json:"secret,omitempty"`
+	// only fire for this project, every project when empty
+	ProjectID string `json:"project_id,omitempty"`
+	// statuses to fire on, by default the ones a run finishes with
+	Events []models.DeployStatus `json:"events,omitempty"`
+	// text/template for the body, executed with the Event. The Event is sent
+	// as JSON when empty.
+	Template    string `json:"template,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+var defaultEvents = []models.DeployStatus{models.Deployed, models.Destroyed, models.Failed}
+
+func (h Hook) matches(event Event) bool {
+	if h.ProjectID != "" && h.ProjectID != event.ProjectID {
+		return false
+	}
+	events := h.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+	for _, status := range events {
+		if status == event.Status {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is a status transition of a package.
+type Event struct {
+	ProjectID   string                  `json:"project_id"`
+	PackageID   string                  `json:"package_id"`
+	PackageType string                  `json:"package_type"`
+	RunID       string                  `json:"run_id"`
+	Action      models.DeploymentAction `json:"action"`
+	From        models.DeployStatus     `json:"from,omitempty"`
+	Status      models.DeployStatus     `json:"status"`
+	At          time.Time               `json:"at"`
+	Error       string                  `json:"error,omitempty"`
+}
+
+// Delivery is the record of a webhook delivery, successful or not.
+type Delivery struct {
+	ID         string              `json:"id"`
+	Hook       string              `json:"hook"`
+	ProjectID  string              `json:"project_id"`
+	PackageID  string              `json:"package_id"`
+	RunID      string              `json:"run_id"`
+	Status     models.DeployStatus `json:"status"`
+	Attempts   int                 `json:"attempts"`
+	StatusCode int                 `json:"status_code,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	Delivered  bool                `json:"delivered"`
+	FinishedAt time.Time           `json:"finished_at"`
+}
+
+type hook struct {
+	Hook
+	template *template.Template
+	client   *webhook.Client
+}
+
+// Notifier fires the configured hooks in the background, retrying failed
+// deliveries, and appends every delivery to a JSON lines log.
+type Notifier struct {
+	hooks       []hook
+	logPath     string
+	maxAttempts int
+	backoff     time.Duration
+
+	logMu sync.Mutex
+	wg    sync.WaitGroup
+}
+
+type Option func(*Notifier)
+
+func WithRetries(maxAttempts int, backoff time.Duration) Option {
+	return func(n *Notifier) {
+		n.maxAttempts = maxAttempts
+		n.backoff = backoff
+	}
+}
+
+var templateFuncs = template.FuncMap{
+	// json quotes a value for use inside a JSON template
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func NewNotifier(hooks []Hook, logPath string, opts ...Option) (*Notifier, error) {
+	n := &Notifier{
+		logPath:     logPath,
+		maxAttempts: 5,
+		backoff:     time.Second,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	for _, h := range hooks {
+		if h.URL == "" {
+			return nil, fmt.Errorf("hook %q has no url", h.Name)
+		}
+		secret, err := base64.StdEncoding.DecodeString(h.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret for hook %q: %v", h.Name, err)
+		}
+		parsed := hook{Hook: h, client: webhook.NewClient(h.URL, secret)}
+		if h.Template != "" {
+			tmpl, err := template.New(h.Name).Funcs(templateFuncs).Option("missingkey=error").Parse(h.Template)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template for hook %q: %v", h.Name, err)
+			}
+			parsed.template = tmpl
+		}
+		n.hooks = append(n.hooks, parsed)
+	}
+	return n, nil
+}
+
+// LoadHooks reads a JSON list of hooks.
+func LoadHooks(path string) ([]Hook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hooks file: %v", err)
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("failed to parse hooks file: %v", err)
+	}
+	return hooks, nil
+}
+
+// NewFromConfig returns nil when no hooks are configured.
+func NewFromConfig(cfg *config.Config) (*Notifier, error) {
+	if cfg.NotifyHooksFile == "" {
+		return nil, nil
+	}
+	hooks, err := LoadHooks(cfg.NotifyHooksFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewNotifier(hooks, cfg.NotifyDeliveryLog, WithRetries(cfg.NotifyMaxAttempts, time.Second))
+}
+
+// Notify fires every hook interested in the event without waiting for the
+// deliveries. It is safe to call on a nil Notifier.
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+	for _, h := range n.hooks {
+		if !h.matches(event) {
+			continue
+		}
+		n.wg.Add(1)
+		go func(h hook) {
+			defer n.wg.Done()
+			n.record(n.deliver(h, event))
+		}(h)
+	}
+}
+
+// Wait blocks until every delivery started so far is done.
+func (n *Notifier) Wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+func (n *Notifier) deliver(h hook, event Event) Delivery {
+	delivery := Delivery{
+		ID:        uuid.NewString(),
+		Hook:      h.Name,
+		ProjectID: event.ProjectID,
+		PackageID: event.PackageID,
+		RunID:     event.RunID,
+		Status:    event.Status,
+	}
+	defer func() { delivery.FinishedAt = time.Now().UTC() }()
+
+	body, err := h.render(event)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	headers := http.Header{}
+	// the same for every attempt so receivers can drop duplicates
+	headers.Set("X-Delivery-ID", delivery.ID)
+	if h.ContentType != "" {
+		headers.Set("Content-Type", h.ContentType)
+	}
+
+	wait := n.backoff
+	for delivery.Attempts < n.maxAttempts {
+		delivery.Attempts++
+		err = h.client.Send(context.Background(), body, headers)
+		delivery.StatusCode = 0
+		var statusErr *webhook.StatusError
+		if errors.As(err, &statusErr) {
+			delivery.StatusCode = statusErr.StatusCode
+		}
+		if err == nil {
+			delivery.Delivered = true
+			delivery.Error = ""
+			return delivery
+		}
+		delivery.Error = err.Error()
+		if !report.Retryable(err) {
+			break
+		}
+		if delivery.Attempts < n.maxAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	slog.Error("Failed to deliver notification", "hook", h.Name, "status", event.Status, "package_id", event.PackageID, "run_id", event.RunID, "attempts", delivery.Attempts, "error", delivery.Error)
+	return delivery
+}
+
+func (h hook) render(event Event) ([]byte, error) {
+	if h.template == nil {
+		return json.Marshal(event)
+	}
+	var buf bytes.Buffer
+	if err := h.template.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("failed to render template for hook %q: %v", h.Name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *Notifier) record(delivery Delivery) {
+	if n.logPath == "" {
+		return
+	}
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return
+	}
+
+	n.logMu.Lock()
+	defer n.logMu.Unlock()
+	f, err := os.OpenFile(n.logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("Failed to open notification delivery log", "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		slog.Error("Failed to write notification delivery log", "error", err)
+	}
+}
+
+// Deliveries reads back the delivery log, oldest first.
+func (n *Notifier) Deliveries() ([]Delivery, error) {
+	n.logMu.Lock()
+	defer n.logMu.Unlock()
+	data, err := os.ReadFile(n.logPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delivery log: %v", err)
+	}
+	var deliveries []Delivery
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var delivery Delivery
+		if err := json.Unmarshal(line, &delivery); err != nil {
+			return nil, fmt.Errorf("failed to parse delivery log: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,222 @@
+package notify
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/webhook"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	bodies   []string
+	headers  []http.Header
+	failures []int
+}
+
+func newReceiver(t *testing.T, failures ...int) *receiver {
+	r := &receiver{failures: failures}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.bodies = append(r.bodies, string(body))
+		r.headers = append(r.headers, req.Header.Clone())
+		if len(r.failures) > 0 {
+			w.WriteHeader(r.failures[0])
+			r.failures = r.failures[1:]
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func testEvent(status models.DeployStatus) Event {
+	return Event{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		RunID:     "run-1",
+		Action:    models.ActionDeploy,
+		From:      models.StartDeploy,
+		Status:    status,
+		At:        time.Now().UTC(),
+	}
+}
+
+func TestNotifier_Notify(t *testing.T) {
+	secret := []byte("shared-secret")
+	server := newReceiver(t)
+	logPath := filepath.Join(t.TempDir(), "deliveries.jsonl")
+	notifier, err := NewNotifier([]Hook{{
+		Name:   "ci",
+		URL:    server.URL,
+		Secret: base64.StdEncoding.EncodeToString(secret),
+	}}, logPath)
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+
+	// only the statuses a run finishes with by default
+	notifier.Notify(testEvent(models.StartDeploy))
+	notifier.Notify(testEvent(models.Deployed))
+	notifier.Wait()
+
+	if len(server.bodies) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d", len(server.bodies))
+	}
+	if err := webhook.Verify(secret, server.headers[0], []byte(server.bodies[0]), time.Minute); err != nil {
+		t.Errorf("Receiver failed to verify the signature: %v", err)
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(server.bodies[0]), &event); err != nil || event.Status != models.Deployed || event.RunID != "run-1" {
+		t.Errorf("Unexpected body %s: %v", server.bodies[0], err)
+	}
+
+	deliveries, err := notifier.Deliveries()
+	if err != nil {
+		t.Fatalf("Deliveries() error = %v", err)
+	}
+	if len(deliveries) != 1 || !deliveries[0].Delivered || deliveries[0].Hook != "ci" || deliveries[0].Attempts != 1 {
+		t.Errorf("Unexpected delivery log %+v", deliveries)
+	}
+}
+
+func TestNotifier_Template(t *testing.T) {
+	server := newReceiver(t)
+	notifier, err := NewNotifier([]Hook{{
+		Name:        "slack",
+		URL:         server.URL,
+		Events:      []models.DeployStatus{models.Failed},
+		Template:    `{"text": {{printf "%s failed: %s" .PackageID .Error | json}}}`,
+		ContentType: "application/vnd.slack+json",
+	}}, "")
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+
+	event := testEvent(models.Failed)
+	event.Error = `terraform said "no"`
+	notifier.Notify(event)
+	notifier.Wait()
+
+	if len(server.bodies) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d", len(server.bodies))
+	}
+	var body map[string]string
+	if err := json.Unmarshal([]byte(server.bodies[0]), &body); err != nil {
+		t.Fatalf("Rendered body %s is not JSON: %v", server.bodies[0], err)
+	}
+	if body["text"] != `test-package failed: terraform said "no"` {
+		t.Errorf("Unexpected text %q", body["text"])
+	}
+	if got := server.headers[0].Get("Content-Type"); got != "application/vnd.slack+json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
+
+func TestNotifier_ProjectHooks(t *testing.T) {
+	global := newReceiver(t)
+	scoped := newReceiver(t)
+	notifier, err := NewNotifier([]Hook{
+		{Name: "global", URL: global.URL},
+		{Name: "other", URL: scoped.URL, ProjectID: "other-project"},
+	}, "")
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+
+	notifier.Notify(testEvent(models.Deployed))
+	notifier.Wait()
+
+	if len(global.bodies) != 1 || len(scoped.bodies) != 0 {
+		t.Errorf("Expected only the global hook to fire, got %d and %d deliveries", len(global.bodies), len(scoped.bodies))
+	}
+}
+
+func TestNotifier_Retries(t *testing.T) {
+	server := newReceiver(t, http.StatusBadGateway, http.StatusTooManyRequests)
+	logPath := filepath.Join(t.TempDir(), "deliveries.jsonl")
+	notifier, err := NewNotifier([]Hook{{Name: "ci", URL: server.URL}}, logPath, WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+
+	notifier.Notify(testEvent(models.Deployed))
+	notifier.Wait()
+
+	if len(server.bodies) != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", len(server.bodies))
+	}
+	if first, last := server.headers[0].Get("X-Delivery-ID"), server.headers[2].Get("X-Delivery-ID"); first == "" || first != last {
+		t.Errorf("Expected every attempt to carry the same delivery id, got %q and %q", first, last)
+	}
+	deliveries, _ := notifier.Deliveries()
+	if len(deliveries) != 1 || !deliveries[0].Delivered || deliveries[0].Attempts != 3 {
+		t.Errorf("Unexpected delivery log %+v", deliveries)
+	}
+}
+
+func TestNotifier_GivesUpOnRejection(t *testing.T) {
+	server := newReceiver(t, http.StatusBadRequest)
+	logPath := filepath.Join(t.TempDir(), "deliveries.jsonl")
+	notifier, err := NewNotifier([]Hook{{Name: "ci", URL: server.URL}}, logPath, WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+
+	notifier.Notify(testEvent(models.Failed))
+	notifier.Wait()
+
+	deliveries, _ := notifier.Deliveries()
+	if len(server.bodies) != 1 || len(deliveries) != 1 {
+		t.Fatalf("Expected a single attempt, got %d requests and %+v", len(server.bodies), deliveries)
+	}
+	if deliveries[0].Delivered || deliveries[0].StatusCode != http.StatusBadRequest || deliveries[0].Error == "" {
+		t.Errorf("Expected the rejection in the delivery log, got %+v", deliveries[0])
+	}
+}
+
+func TestNewNotifier_InvalidHooks(t *testing.T) {
+	tests := []struct {
+		name string
+		hook Hook
+	}{
+		{"no url", Hook{Name: "ci"}},
+		{"bad secret", Hook{Name: "ci", URL: "http://example.com", Secret: "not base64!"}},
+		{"bad template", Hook{Name: "ci", URL: "http://example.com", Template: "{{.PackageID"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewNotifier([]Hook{tt.hook}, ""); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hooks.json")
+	os.WriteFile(path, []byte(`[{"name": "pagerduty", "url": "https://events.example.com", "project_id": "prod", "events": ["FAILED"]}]`), 0600)
+
+	hooks, err := LoadHooks(path)
+	if err != nil {
+		t.Fatalf("LoadHooks() error = %v", err)
+	}
+	if len(hooks) != 1 || hooks[0].ProjectID != "prod" || hooks[0].Events[0] != models.Failed {
+		t.Errorf("Unexpected hooks %+v", hooks)
+	}
+
+	var nilNotifier *Notifier
+	nilNotifier.Notify(testEvent(models.Failed))
+	nilNotifier.Wait()
+}
@@ -0,0 +1,301 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type DeployFunc func(context.Context, models.DeploymentMessage) error
+
+// Orchestrator deploys or destroys a whole project graph. Packages are ordered
+// by their connections: on deploy an upstream package finishes before anything
+// wired to it starts, on destroy the order is reversed. Packages whose
+// prerequisites are done run in parallel. Each package reports its own
+// status through the deploy function.
+type Orchestrator struct {
+	deployFn DeployFunc
+
+	mu sync.Mutex
+	// packages of project actions in progress waiting on their prerequisites
+	queued map[*node]Queued
+}
+
+// Queued is a package of a project action that hasn't started yet.
+type Queued struct {
+	ProjectID string                  `json:"project_id"`
+	PackageID string                  `json:"package_id"`
+	Action    models.DeploymentAction `json:"action"`
+	// packages that have to finish first
+	WaitingOn []string  `json:"waiting_on"`
+	QueuedAt  time.Time `json:"queued_at"`
+}
+
+func NewOrchestrator(deployFn DeployFunc) *Orchestrator {
+	return &Orchestrator{
+		deployFn: deployFn,
+	}
+}
+
+// Handle runs project actions through the graph and passes single package
+// messages straight to the deploy function.
+func (o *Orchestrator) Handle(ctx context.Context, msg models.DeploymentMessage) error {
+	switch msg.Action {
+	case models.ActionDeployProject:
+		return o.run(ctx, msg, models.ActionDeploy)
+	case models.ActionDestroyProject:
+		return o.run(ctx, msg, models.ActionDestroy)
+	default:
+		return o.deployFn(ctx, msg)
+	}
+}
+
+type graphKey struct{}
+
+// GraphPackages returns the packages of the project action a package is run
+// as part of, nil when it is run on its own.
+func GraphPackages(ctx context.Context) []string {
+	ids, _ := ctx.Value(graphKey{}).([]string)
+	return ids
+}
+
+type node struct {
+	msg models.DeploymentMessage
+	// upstream packages in the same graph
+	dependencies []string
+	// downstream packages in the same graph
+	dependents []string
+}
+
+type result struct {
+	packageID string
+	err       error
+}
+
+func (o *Orchestrator) run(ctx context.Context, msg models.DeploymentMessage, action models.DeploymentAction) (err error) {
+	ctx, span := tracing.Start(ctx, "orchestrate "+string(msg.Action), trace.WithAttributes(
+		attribute.String("project_id", msg.ProjectID),
+		attribute.Int("packages", len(msg.Packages)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	nodes, order, err := buildGraph(msg)
+	if err != nil {
+		return fmt.Errorf("invalid package graph for project %s: %v", msg.ProjectID, err)
+	}
+	if action == models.ActionDestroy {
+		for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+			order[i], order[j] = order[j], order[i]
+		}
+	}
+	ctx = context.WithValue(ctx, graphKey{}, order)
+	logger := logging.FromContext(ctx).With(logging.ProjectID, msg.ProjectID, logging.Action, msg.Action)
+	logger.Info("Running package graph", "packages", len(order), "order", strings.Join(order, ", "))
+
+	// on destroy a package waits for its dependents instead of its dependencies
+	waitsOn := func(n *node) []string { return n.dependencies }
+	unblocks := func(n *node) []string { return n.dependents }
+	if action == models.ActionDestroy {
+		waitsOn, unblocks = unblocks, waitsOn
+	}
+
+	pending := make(map[string]int, len(nodes))
+	for id, n := range nodes {
+		pending[id] = len(waitsOn(n))
+	}
+	o.enqueue(msg.ProjectID, action, nodes, waitsOn)
+	defer o.dequeue(nodes)
+
+	results := make(chan result)
+	start := func(id string) {
+		o.dequeue(map[string]*node{id: nodes[id]})
+		pkgMsg := nodes[id].msg
+		pkgMsg.Action = action
+		if pkgMsg.ProjectID == "" {
+			pkgMsg.ProjectID = msg.ProjectID
+		}
+		go func() {
+			results <- result{packageID: id, err: o.deployFn(ctx, pkgMsg)}
+		}()
+	}
+
+	running := 0
+	for _, id := range order {
+		if pending[id] == 0 {
+			start(id)
+			running++
+		}
+	}
+
+	var errs []error
+	skipped := make(map[string]bool)
+	for running > 0 {
+		res := <-results
+		running--
+
+		if res.err != nil {
+			logger.Error("Package failed", logging.PackageID, res.packageID, "error", res.err)
+			errs = append(errs, fmt.Errorf("package %s: %v", res.packageID, res.err))
+			skip(logger, nodes, unblocks(nodes[res.packageID]), res.packageID, unblocks, skipped)
+			for id := range skipped {
+				o.dequeue(map[string]*node{id: nodes[id]})
+			}
+			continue
+		}
+
+		for _, next := range unblocks(nodes[res.packageID]) {
+			pending[next]--
+			if pending[next] == 0 && !skipped[next] {
+				start(next)
+				running++
+			}
+		}
+	}
+
+	for _, id := range order {
+		if skipped[id] {
+			errs = append(errs, fmt.Errorf("package %s: skipped after an upstream failure", id))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	logger.Info("Package graph completed")
+	return nil
+}
+
+func (o *Orchestrator) enqueue(projectID string, action models.DeploymentAction, nodes map[string]*node, waitsOn func(*node) []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.queued == nil {
+		o.queued = make(map[*node]Queued)
+	}
+	now := time.Now().UTC()
+	for id, n := range nodes {
+		o.queued[n] = Queued{ProjectID: projectID, PackageID: id, Action: action, WaitingOn: waitsOn(n), QueuedAt: now}
+	}
+}
+
+func (o *Orchestrator) dequeue(nodes map[string]*node) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, n := range nodes {
+		delete(o.queued, n)
+	}
+}
+
+// Queued returns the packages of project actions in progress that are
+// waiting on their prerequisites, oldest first.
+func (o *Orchestrator) Queued() []Queued {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	queued := make([]Queued, 0, len(o.queued))
+	for _, q := range o.queued {
+		queued = append(queued, q)
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if !queued[i].QueuedAt.Equal(queued[j].QueuedAt) {
+			return queued[i].QueuedAt.Before(queued[j].QueuedAt)
+		}
+		return queued[i].PackageID < queued[j].PackageID
+	})
+	return queued
+}
+
+// skip marks every package transitively blocked by a failed one so it never
+// starts. Skipped packages keep whatever state they were in.
+func skip(logger *slog.Logger, nodes map[string]*node, ids []string, failedID string, unblocks func(*node) []string, skipped map[string]bool) {
+	for _, id := range ids {
+		if skipped[id] {
+			continue
+		}
+		skipped[id] = true
+		logger.Warn("Skipping package after an upstream failure", logging.PackageID, id, "failed_package_id", failedID)
+		skip(logger, nodes, unblocks(nodes[id]), failedID, unblocks, skipped)
+	}
+}
+
+// buildGraph indexes the packages of a project message and returns them in
+// dependency order. Connections to packages outside the graph are ignored,
+// their outputs are expected to be recorded already.
+func buildGraph(msg models.DeploymentMessage) (map[string]*node, []string, error) {
+	nodes := make(map[string]*node, len(msg.Packages))
+	for _, pkgMsg := range msg.Packages {
+		if pkgMsg.PackageID == "" {
+			return nil, nil, fmt.Errorf("package without package_id")
+		}
+		if _, ok := nodes[pkgMsg.PackageID]; ok {
+			return nil, nil, fmt.Errorf("duplicate package %s", pkgMsg.PackageID)
+		}
+		nodes[pkgMsg.PackageID] = &node{msg: pkgMsg}
+	}
+
+	for id, n := range nodes {
+		seen := make(map[string]bool)
+		for _, conn := range n.msg.Connections {
+			upstream, ok := nodes[conn.SourcePackageID]
+			if !ok || seen[conn.SourcePackageID] {
+				continue
+			}
+			if conn.SourcePackageID == id {
+				return nil, nil, fmt.Errorf("package %s is connected to itself", id)
+			}
+			seen[conn.SourcePackageID] = true
+			n.dependencies = append(n.dependencies, conn.SourcePackageID)
+			upstream.dependents = append(upstream.dependents, id)
+		}
+	}
+
+	// Kahn's algorithm, with sorted ids so the order is stable
+	inDegree := make(map[string]int, len(nodes))
+	var ready []string
+	for id, n := range nodes {
+		inDegree[id] = len(n.dependencies)
+		if inDegree[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+	sort.Strings(ready)
+
+	var order []string
+	for len(ready) > 0 {
+		id := ready[0]
+		ready = ready[1:]
+		order = append(order, id)
+
+		var unlocked []string
+		for _, next := range nodes[id].dependents {
+			inDegree[next]--
+			if inDegree[next] == 0 {
+				unlocked = append(unlocked, next)
+			}
+		}
+		sort.Strings(unlocked)
+		ready = append(ready, unlocked...)
+	}
+
+	if len(order) != len(nodes) {
+		var cyclic []string
+		for id, degree := range inDegree {
+			if degree > 0 {
+				cyclic = append(cyclic, id)
+			}
+		}
+		sort.Strings(cyclic)
+		return nil, nil, fmt.Errorf("connections form a cycle between packages %s", strings.Join(cyclic, ", "))
+	}
+
+	return nodes, order, nil
+}
@@ -0,0 +1,250 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+// recorder logs the order packages are handed to the deploy function and
+// fails the ones listed in failing.
+type recorder struct {
+	mu      sync.Mutex
+	calls   []string
+	failing map[string]bool
+}
+
+func (r *recorder) deploy(ctx context.Context, msg models.DeploymentMessage) error {
+	r.mu.Lock()
+	r.calls = append(r.calls, msg.PackageID)
+	r.mu.Unlock()
+	if msg.ProjectID != "test-project" {
+		return fmt.Errorf("unexpected project %s", msg.ProjectID)
+	}
+	if r.failing[msg.PackageID] {
+		return fmt.Errorf("boom")
+	}
+	return nil
+}
+
+func (r *recorder) index(id string) int {
+	for i, call := range r.calls {
+		if call == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func connectedTo(ids ...string) []models.Connection {
+	var conns []models.Connection
+	for _, id := range ids {
+		conns = append(conns, models.Connection{Name: id, SourcePackageID: id})
+	}
+	return conns
+}
+
+// network <- db <- app, network <- cache <- app
+func projectMessage(action models.DeploymentAction) models.DeploymentMessage {
+	return models.DeploymentMessage{
+		ProjectID: "test-project",
+		Action:    action,
+		Packages: []models.DeploymentMessage{
+			{PackageID: "app", Connections: connectedTo("db", "cache")},
+			{PackageID: "db", Connections: connectedTo("network")},
+			{PackageID: "cache", Connections: connectedTo("network", "external")},
+			{PackageID: "network"},
+		},
+	}
+}
+
+func TestBuildGraph(t *testing.T) {
+	_, order, err := buildGraph(projectMessage(models.ActionDeployProject))
+	if err != nil {
+		t.Fatalf("buildGraph() error = %v", err)
+	}
+	want := []string{"network", "cache", "db", "app"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("buildGraph() order = %v, want %v", order, want)
+	}
+}
+
+func TestBuildGraph_Cycle(t *testing.T) {
+	msg := models.DeploymentMessage{
+		Packages: []models.DeploymentMessage{
+			{PackageID: "a", Connections: connectedTo("b")},
+			{PackageID: "b", Connections: connectedTo("a")},
+			{PackageID: "c"},
+		},
+	}
+	if _, _, err := buildGraph(msg); err == nil {
+		t.Error("Expected buildGraph() to reject a cycle")
+	}
+}
+
+func TestOrchestrator_DeployProject(t *testing.T) {
+	rec := &recorder{}
+	o := NewOrchestrator(rec.deploy)
+
+	if err := o.Handle(context.Background(), projectMessage(models.ActionDeployProject)); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+
+	if len(rec.calls) != 4 {
+		t.Fatalf("Expected 4 deployments, got %v", rec.calls)
+	}
+	for _, edge := range [][2]string{{"network", "db"}, {"network", "cache"}, {"db", "app"}, {"cache", "app"}} {
+		if rec.index(edge[0]) > rec.index(edge[1]) {
+			t.Errorf("Expected %s to deploy before %s, got %v", edge[0], edge[1], rec.calls)
+		}
+	}
+}
+
+func TestOrchestrator_PassesTheGraph(t *testing.T) {
+	var mu sync.Mutex
+	graphs := make(map[string][]string)
+	o := NewOrchestrator(func(ctx context.Context, msg models.DeploymentMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		graphs[msg.PackageID] = GraphPackages(ctx)
+		return nil
+	})
+
+	if err := o.Handle(context.Background(), projectMessage(models.ActionDeployProject)); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	for _, id := range []string{"app", "db", "cache", "network"} {
+		if got := graphs[id]; len(got) != 4 {
+			t.Errorf("Expected %s to run with the 4 packages of the graph, got %v", id, got)
+		}
+	}
+	if got := GraphPackages(context.Background()); got != nil {
+		t.Errorf("Expected no graph outside of a project action, got %v", got)
+	}
+}
+
+func TestOrchestrator_DestroyProject(t *testing.T) {
+	rec := &recorder{}
+	o := NewOrchestrator(rec.deploy)
+
+	if err := o.Handle(context.Background(), projectMessage(models.ActionDestroyProject)); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+
+	for _, edge := range [][2]string{{"app", "db"}, {"app", "cache"}, {"db", "network"}, {"cache", "network"}} {
+		if rec.index(edge[0]) > rec.index(edge[1]) {
+			t.Errorf("Expected %s to be destroyed before %s, got %v", edge[0], edge[1], rec.calls)
+		}
+	}
+}
+
+func TestOrchestrator_StopsDependentsOnFailure(t *testing.T) {
+	rec := &recorder{failing: map[string]bool{"db": true}}
+	o := NewOrchestrator(rec.deploy)
+
+	if err := o.Handle(context.Background(), projectMessage(models.ActionDeployProject)); err == nil {
+		t.Fatal("Expected Handle() to return the failure")
+	}
+
+	if rec.index("app") != -1 {
+		t.Errorf("Expected app to be skipped, got %v", rec.calls)
+	}
+	if rec.index("cache") == -1 {
+		t.Errorf("Expected the independent cache branch to still deploy, got %v", rec.calls)
+	}
+}
+
+func TestOrchestrator_RunsIndependentBranchesInParallel(t *testing.T) {
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	deploy := func(ctx context.Context, msg models.DeploymentMessage) error {
+		started <- msg.PackageID
+		<-release
+		return nil
+	}
+	o := NewOrchestrator(deploy)
+
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		Action:    models.ActionDeployProject,
+		Packages:  []models.DeploymentMessage{{PackageID: "a"}, {PackageID: "b"}},
+	}
+
+	done := make(chan error)
+	go func() { done <- o.Handle(context.Background(), msg) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("Expected both independent packages to start before either finished")
+		}
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+}
+
+func TestOrchestrator_PassesSinglePackageMessagesThrough(t *testing.T) {
+	rec := &recorder{}
+	o := NewOrchestrator(rec.deploy)
+
+	msg := models.DeploymentMessage{ProjectID: "test-project", PackageID: "db", Action: models.ActionDeploy}
+	if err := o.Handle(context.Background(), msg); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	if !reflect.DeepEqual(rec.calls, []string{"db"}) {
+		t.Errorf("Expected a single deployment of db, got %v", rec.calls)
+	}
+}
+
+func TestOrchestrator_Queued(t *testing.T) {
+	started := make(chan string)
+	release := make(chan struct{})
+	deploy := func(ctx context.Context, msg models.DeploymentMessage) error {
+		started <- msg.PackageID
+		<-release
+		return nil
+	}
+	o := NewOrchestrator(deploy)
+
+	done := make(chan error)
+	go func() { done <- o.Handle(context.Background(), projectMessage(models.ActionDeployProject)) }()
+
+	if id := <-started; id != "network" {
+		t.Fatalf("Expected network to start first, got %s", id)
+	}
+	queued := o.Queued()
+	var ids []string
+	for _, q := range queued {
+		ids = append(ids, q.PackageID)
+		if q.ProjectID != "test-project" || q.Action != models.ActionDeploy {
+			t.Errorf("Unexpected queued package %+v", q)
+		}
+		if q.PackageID == "app" && !reflect.DeepEqual(q.WaitingOn, []string{"db", "cache"}) {
+			t.Errorf("Expected app to wait on db and cache, got %v", q.WaitingOn)
+		}
+	}
+	if !reflect.DeepEqual(ids, []string{"app", "cache", "db"}) {
+		t.Errorf("Expected the packages behind network to be queued, got %v", ids)
+	}
+
+	close(release)
+	go func() {
+		for range started {
+		}
+	}()
+	if err := <-done; err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	close(started)
+	if queued := o.Queued(); len(queued) != 0 {
+		t.Errorf("Expected nothing queued once the project is done, got %+v", queued)
+	}
+}
@@ -0,0 +1,349 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/metrics"
+	"github.com/radiatus-ai/package-provisioner/internal/report"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Entry is a package update waiting to be delivered.
+type Entry struct {
+	ID  string `json:"id"`
+	Seq uint64 `json:"seq"`
+	report.Update
+	CreatedAt time.Time `json:"created_at"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	// trace context of the run the update belongs to, so its delivery shows
+	// up in the same trace
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// failedDir holds entries the receiver rejected, they are kept for inspection
+// instead of blocking the updates queued after them.
+const failedDir = "_failed"
+
+// Outbox persists package updates and delivers them in order per package,
+// retrying until the reporter behind it accepts them. It is the retry loop, the
+// reporter is expected to make a single attempt per update. Entries are stored as
+// <dir>/<packageID>/<seq>.json so they survive restarts.
+type Outbox struct {
+	dir      string
+	reporter report.Reporter
+	interval time.Duration
+
+	mu  sync.Mutex
+	seq uint64
+	// serializes deliveries so a package's entries are never sent concurrently
+	flushMu sync.Mutex
+	wake    chan struct{}
+	// unix nanos of the last pass of Run over the queue
+	lastActive atomic.Int64
+}
+
+func New(dir string, reporter report.Reporter, interval time.Duration) (*Outbox, error) {
+	o := &Outbox{
+		dir:      dir,
+		reporter: reporter,
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+
+	// continue numbering after whatever is left from before a restart
+	packages, err := o.packages()
+	if err != nil {
+		return nil, err
+	}
+	for _, packageID := range append(packages, failedDir) {
+		files, err := o.files(packageID)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range files {
+			if seq := seqOf(name); seq > o.seq {
+				o.seq = seq
+			}
+		}
+	}
+	return o, nil
+}
+
+func NewFromConfig(cfg *config.Config, reporter report.Reporter) (*Outbox, error) {
+	return New(cfg.OutboxPath, reporter, time.Duration(cfg.OutboxRetrySeconds)*time.Second)
+}
+
+// Report queues an update, so an Outbox can stand in for the reporter it
+// delivers to.
+func (o *Outbox) Report(ctx context.Context, update report.Update) error {
+	return o.enqueue(update, tracing.Carrier(ctx))
+}
+
+// Enqueue stores an update for delivery. Once it returns the update is
+// persisted and will be delivered eventually.
+func (o *Outbox) Enqueue(update report.Update) error {
+	return o.enqueue(update, nil)
+}
+
+func (o *Outbox) enqueue(update report.Update, traceContext map[string]string) error {
+	o.mu.Lock()
+	o.seq++
+	entry := &Entry{
+		ID:           uuid.NewString(),
+		Seq:          o.seq,
+		Update:       update,
+		CreatedAt:    time.Now().UTC(),
+		TraceContext: traceContext,
+	}
+	err := o.write(entry)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	status := ""
+	if update.Payload.DeployStatus != nil {
+		status = *update.Payload.DeployStatus
+	}
+	slog.Info("Queued status update", "status", status, "seq", entry.Seq, "package_id", update.PackageID)
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers queued updates until ctx is cancelled, right after they are
+// enqueued and every interval while some are still pending.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		o.lastActive.Store(time.Now().UnixNano())
+		if err := o.Flush(ctx); err != nil {
+			slog.Warn("Outbox delivery incomplete", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// LastActive returns when Run last went over the queue, zero if it isn't
+// running. A delivery that hangs keeps it from advancing.
+func (o *Outbox) LastActive() time.Time {
+	if nanos := o.lastActive.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// Flush tries to deliver every pending update, packages concurrently. A
+// package whose oldest update can't be delivered keeps the rest of its updates
+// queued behind it, other packages are not held up.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+
+	packages, err := o.packages()
+	if err != nil {
+		return err
+	}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		blocked []string
+	)
+	for _, packageID := range packages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := o.flushPackage(ctx, packageID); err != nil {
+				mu.Lock()
+				blocked = append(blocked, fmt.Sprintf("%s: %v", packageID, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(blocked) > 0 {
+		sort.Strings(blocked)
+		return fmt.Errorf("%d packages with undelivered updates: %s", len(blocked), strings.Join(blocked, "; "))
+	}
+	return nil
+}
+
+func (o *Outbox) flushPackage(ctx context.Context, packageID string) error {
+	entries, err := o.Pending(packageID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		sendErr := o.deliver(ctx, entry)
+		if sendErr == nil {
+			if err := os.Remove(o.path(entry.PackageID, entry.Seq)); err != nil {
+				return fmt.Errorf("failed to remove delivered update %d: %v", entry.Seq, err)
+			}
+			slog.Info("Delivered status update", "seq", entry.Seq, "package_id", packageID, "attempts", entry.Attempts+1)
+			continue
+		}
+
+		metrics.APIPostFailures.Inc()
+		entry.Attempts++
+		entry.LastError = sendErr.Error()
+		// anything short of the receiver refusing the update is retried,
+		// dropping a final status would leave the package stuck
+		if report.Rejected(sendErr) {
+			slog.Error("Status update rejected, moving it aside", "seq", entry.Seq, "package_id", packageID, "error", sendErr)
+			if err := o.moveToFailed(entry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		o.mu.Lock()
+		err := o.write(entry)
+		o.mu.Unlock()
+		if err != nil {
+			slog.Error("Failed to record delivery attempt", "seq", entry.Seq, "package_id", packageID, "error", err)
+		}
+		return sendErr
+	}
+	return nil
+}
+
+func (o *Outbox) deliver(ctx context.Context, entry *Entry) error {
+	ctx, span := tracing.Start(tracing.Extract(ctx, entry.TraceContext), "deliver update", trace.WithAttributes(
+		attribute.String("package_id", entry.PackageID),
+		attribute.Int64("seq", int64(entry.Seq)),
+		attribute.Int("attempt", entry.Attempts+1),
+	))
+	err := o.reporter.Report(ctx, entry.Update)
+	tracing.End(span, err)
+	return err
+}
+
+// Pending returns the updates queued for a package, oldest first.
+func (o *Outbox) Pending(packageID string) ([]*Entry, error) {
+	files, err := o.files(packageID)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0, len(files))
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(o.dir, packageID, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read update %s: %v", name, err)
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse update %s: %v", name, err)
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+// Failed returns the updates the receiver rejected, oldest first.
+func (o *Outbox) Failed() ([]*Entry, error) {
+	return o.Pending(failedDir)
+}
+
+func (o *Outbox) moveToFailed(entry *Entry) error {
+	if err := os.MkdirAll(filepath.Join(o.dir, failedDir), 0700); err != nil {
+		return fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(o.path(failedDir, entry.Seq), data, 0600); err != nil {
+		return fmt.Errorf("failed to write rejected update %d: %v", entry.Seq, err)
+	}
+	return os.Remove(o.path(entry.PackageID, entry.Seq))
+}
+
+// write must be called with mu held.
+func (o *Outbox) write(entry *Entry) error {
+	dir := filepath.Join(o.dir, entry.PackageID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal update: %v", err)
+	}
+
+	// write then rename so a crash never leaves a partial entry
+	path := o.path(entry.PackageID, entry.Seq)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write update: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func (o *Outbox) path(packageID string, seq uint64) string {
+	// zero padded so the file names sort in queue order
+	return filepath.Join(o.dir, packageID, fmt.Sprintf("%020d.json", seq))
+}
+
+func seqOf(name string) uint64 {
+	seq, _ := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+	return seq
+}
+
+func (o *Outbox) packages() ([]string, error) {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox directory: %v", err)
+	}
+	var packages []string
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != failedDir {
+			packages = append(packages, entry.Name())
+		}
+	}
+	return packages, nil
+}
+
+func (o *Outbox) files(packageID string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(o.dir, packageID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox directory: %v", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			files = append(files, entry.Name())
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
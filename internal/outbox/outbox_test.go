@@ -0,0 +1,240 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
+	"github.com/radiatus-ai/package-provisioner/internal/report"
+)
+
+// fakeReporter records delivered updates and fails while err is set.
+type fakeReporter struct {
+	mu        sync.Mutex
+	err       error
+	delivered []string
+}
+
+func (f *fakeReporter) Report(ctx context.Context, update report.Update) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.delivered = append(f.delivered, update.PackageID+"/"+*update.Payload.DeployStatus)
+	return nil
+}
+
+func (f *fakeReporter) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func update(packageID, status, idempotencyKey string) report.Update {
+	return report.Update{
+		ProjectID:      "p",
+		PackageID:      packageID,
+		IdempotencyKey: idempotencyKey,
+		Payload:        canvasapi.OutputPayloadBody{DeployStatus: &status},
+	}
+}
+
+func TestOutbox_DeliversInOrderAfterOutage(t *testing.T) {
+	sender := &fakeReporter{err: errors.New("connection refused")}
+	outbox, err := New(t.TempDir(), sender, time.Hour)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	for _, s := range []string{"DEPLOYING", "DEPLOYED"} {
+		if err := outbox.Enqueue(update("app", s, "run-1:"+s)); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	if err := outbox.Enqueue(update("db", "DEPLOYING", "")); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	if err := outbox.Flush(context.Background()); err == nil {
+		t.Fatal("Expected Flush() to report undelivered updates")
+	}
+	pending, _ := outbox.Pending("app")
+	if len(pending) != 2 {
+		t.Fatalf("Expected 2 pending updates, got %d", len(pending))
+	}
+	// later updates wait behind the first one instead of being tried
+	if pending[0].Attempts != 1 || pending[1].Attempts != 0 {
+		t.Errorf("Unexpected attempts %d, %d", pending[0].Attempts, pending[1].Attempts)
+	}
+	if pending[0].LastError == "" {
+		t.Error("Expected the last error to be recorded")
+	}
+
+	sender.setErr(nil)
+	if err := outbox.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	// packages are delivered concurrently, the order only holds per package
+	var app []string
+	for _, d := range sender.delivered {
+		if strings.HasPrefix(d, "app/") {
+			app = append(app, d)
+		}
+	}
+	if len(sender.delivered) != 3 || !slices.Equal(app, []string{"app/DEPLOYING", "app/DEPLOYED"}) || !slices.Contains(sender.delivered, "db/DEPLOYING") {
+		t.Errorf("Delivered %v, want app/DEPLOYING before app/DEPLOYED and db/DEPLOYING", sender.delivered)
+	}
+	if pending, _ := outbox.Pending("app"); len(pending) != 0 {
+		t.Errorf("Expected no pending updates, got %d", len(pending))
+	}
+}
+
+func TestOutbox_SurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	sender := &fakeReporter{err: errors.New("connection refused")}
+	first, _ := New(dir, sender, time.Hour)
+	first.Enqueue(update("app", "DEPLOYING", ""))
+	first.Enqueue(update("app", "DEPLOYED", ""))
+
+	second, err := New(dir, sender, time.Hour)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := second.Enqueue(update("app", "DESTROYING", "")); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	pending, _ := second.Pending("app")
+	if len(pending) != 3 || *pending[2].Payload.DeployStatus != "DESTROYING" {
+		t.Fatalf("Expected updates from before the restart to stay first, got %+v", pending)
+	}
+	if pending[2].Seq <= pending[1].Seq {
+		t.Errorf("Expected numbering to continue, got %d after %d", pending[2].Seq, pending[1].Seq)
+	}
+}
+
+func TestOutbox_SetsAsideRejectedUpdates(t *testing.T) {
+	sender := &fakeReporter{err: &canvasapi.StatusError{StatusCode: http.StatusBadRequest}}
+	outbox, _ := New(t.TempDir(), sender, time.Hour)
+	outbox.Enqueue(update("app", "DEPLOYING", ""))
+
+	if err := outbox.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if pending, _ := outbox.Pending("app"); len(pending) != 0 {
+		t.Errorf("Expected the rejected update to leave the queue, got %d", len(pending))
+	}
+	failed, err := outbox.Failed()
+	if err != nil || len(failed) != 1 || failed[0].LastError == "" {
+		t.Errorf("Expected the rejected update to be kept, got %+v (err %v)", failed, err)
+	}
+}
+
+func TestOutbox_KeepsTimedOutUpdates(t *testing.T) {
+	sender := &fakeReporter{err: fmt.Errorf("error sending HTTP request: %w", context.DeadlineExceeded)}
+	outbox, _ := New(t.TempDir(), sender, time.Hour)
+	outbox.Enqueue(update("app", "DEPLOYED", ""))
+
+	if err := outbox.Flush(context.Background()); err == nil {
+		t.Fatal("Expected Flush() to report the undelivered update")
+	}
+	if failed, _ := outbox.Failed(); len(failed) != 0 {
+		t.Errorf("Expected a timed out update not to be set aside, got %+v", failed)
+	}
+	if pending, _ := outbox.Pending("app"); len(pending) != 1 || pending[0].Attempts != 1 {
+		t.Fatalf("Expected the update to stay queued, got %+v", pending)
+	}
+
+	sender.setErr(nil)
+	if err := outbox.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if len(sender.delivered) != 1 {
+		t.Errorf("Expected the update to be delivered once canvas-api answers, got %v", sender.delivered)
+	}
+}
+
+// hangingReporter never answers for one package, like a request left to time
+// out.
+type hangingReporter struct {
+	fakeReporter
+	packageID string
+	release   chan struct{}
+}
+
+func (h *hangingReporter) Report(ctx context.Context, update report.Update) error {
+	if update.PackageID == h.packageID {
+		<-h.release
+		return errors.New("timeout")
+	}
+	return h.fakeReporter.Report(ctx, update)
+}
+
+func TestOutbox_FlushDoesNotWaitForOtherPackages(t *testing.T) {
+	sender := &hangingReporter{packageID: "app", release: make(chan struct{})}
+	outbox, _ := New(t.TempDir(), sender, time.Hour)
+	outbox.Enqueue(update("app", "DEPLOYED", ""))
+	outbox.Enqueue(update("db", "DEPLOYED", ""))
+
+	done := make(chan error)
+	go func() { done <- outbox.Flush(context.Background()) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sender.mu.Lock()
+		n := len(sender.delivered)
+		sender.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected db to be delivered while app hangs")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(sender.release)
+	if err := <-done; err == nil {
+		t.Error("Expected Flush() to report the undelivered app update")
+	}
+}
+
+func TestOutbox_Run(t *testing.T) {
+	sender := &fakeReporter{}
+	outbox, _ := New(t.TempDir(), sender, time.Hour)
+	if !outbox.LastActive().IsZero() {
+		t.Error("Expected no activity before Run()")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		outbox.Run(ctx)
+		close(done)
+	}()
+
+	outbox.Enqueue(update("app", "DEPLOYED", ""))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sender.mu.Lock()
+		n := len(sender.delivered)
+		sender.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected Run() to deliver the update")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if time.Since(outbox.LastActive()) > 5*time.Second {
+		t.Errorf("Expected Run() to record activity, got %v", outbox.LastActive())
+	}
+	cancel()
+	<-done
+}
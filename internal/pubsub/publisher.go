@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	gpubsub "cloud.google.com/go/pubsub"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+type Publisher interface {
+	Publish(ctx context.Context, data []byte, attributes map[string]string) error
+}
+
+// TopicPublisher publishes to a Google Cloud Pub/Sub topic and waits for the
+// server to acknowledge each message.
+type TopicPublisher struct {
+	client *gpubsub.Client
+	topic  *gpubsub.Topic
+}
+
+func NewTopicPublisher(ctx context.Context, projectID, topicID string) (*TopicPublisher, error) {
+	client, err := gpubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client: %v", err)
+	}
+	return &TopicPublisher{
+		client: client,
+		topic:  client.Topic(topicID),
+	}, nil
+}
+
+func (p *TopicPublisher) Publish(ctx context.Context, data []byte, attributes map[string]string) error {
+	// subscribers pick the trace up from the attributes
+	withTrace := make(map[string]string, len(attributes))
+	for k, v := range attributes {
+		withTrace[k] = v
+	}
+	tracing.Inject(ctx, withTrace)
+	result := p.topic.Publish(ctx, &gpubsub.Message{
+		Data:       data,
+		Attributes: withTrace,
+	})
+	id, err := result.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to publish to %s: %v", p.topic.ID(), err)
+	}
+	logging.FromContext(ctx).Info("Published message", "published_message_id", id, "topic", p.topic.ID())
+	return nil
+}
+
+func (p *TopicPublisher) Close() error {
+	p.topic.Stop()
+	return p.client.Close()
+}
+
+// RedeployPublisher sends redeploy requests for downstream packages to a
+// topic canvas-api listens on.
+type RedeployPublisher struct {
+	publisher Publisher
+}
+
+func NewRedeployPublisher(publisher Publisher) *RedeployPublisher {
+	return &RedeployPublisher{publisher: publisher}
+}
+
+func (p *RedeployPublisher) RequestRedeploy(req models.RedeployRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("error marshaling redeploy request: %v", err)
+	}
+	return p.publisher.Publish(context.Background(), data, map[string]string{
+		"type":       "REDEPLOY_REQUEST",
+		"project_id": req.ProjectID,
+		"package_id": req.PackageID,
+	})
+}
@@ -0,0 +1,46 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/radiatus-ai/package-provisioner/pkg/models"
+)
+
+type mockPublisher struct {
+	data       []byte
+	attributes map[string]string
+}
+
+func (m *mockPublisher) Publish(ctx context.Context, data []byte, attributes map[string]string) error {
+	m.data = data
+	m.attributes = attributes
+	return nil
+}
+
+func TestRedeployPublisher_RequestRedeploy(t *testing.T) {
+	publisher := &mockPublisher{}
+	req := models.RedeployRequest{
+		ProjectID:        "test-project",
+		PackageID:        "app",
+		SourcePackageID:  "db",
+		ChangedOutputs:   []string{"host"},
+		PropagationChain: []string{"db"},
+	}
+
+	if err := NewRedeployPublisher(publisher).RequestRedeploy(req); err != nil {
+		t.Fatalf("RequestRedeploy() error = %v", err)
+	}
+
+	var got models.RedeployRequest
+	if err := json.Unmarshal(publisher.data, &got); err != nil {
+		t.Fatalf("Failed to decode published data: %v", err)
+	}
+	if got.PackageID != "app" || got.SourcePackageID != "db" {
+		t.Errorf("Unexpected published request: %+v", got)
+	}
+	if publisher.attributes["type"] != "REDEPLOY_REQUEST" || publisher.attributes["package_id"] != "app" {
+		t.Errorf("Unexpected attributes: %v", publisher.attributes)
+	}
+}
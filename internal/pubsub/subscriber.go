@@ -1,91 +1,360 @@
 package pubsub
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync"
+	"time"
 
 	// Added import for io
 	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/deadletter"
+	"github.com/radiatus-ai/package-provisioner/internal/dedup"
+	"github.com/radiatus-ai/package-provisioner/internal/envelope"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/metrics"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
 	"github.com/radiatus-ai/package-provisioner/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type Executor interface {
-	PostOutputToAPI(projectID string, packageID string, outputData map[string]interface{}, action models.DeployStatus) error
-}
-
 type Subscriber struct {
 	cfg      *config.Config
-	deployFn func(models.DeploymentMessage) error
-	executor Executor // Changed from *Executor to Executor
+	deployFn func(context.Context, models.DeploymentMessage) error
+	// opens encrypted messages, nil when they are not supported
+	kms envelope.KMS
+	// takes the messages that can't be processed, nil drops them
+	deadLetters deadletter.Sink
+	// remembers the messages processed recently, nil processes every delivery
+	dedup dedup.Store
+	wg    sync.WaitGroup
+
+	mu sync.Mutex
+	// the last message received of each ordering key, closed once processed
+	tails map[string]chan struct{}
+}
+
+// message is a Pub/Sub message as pushed.
+type message struct {
+	Data       []byte            `json:"data,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Pub/Sub sends the id as both messageId and message_id
+	ID       string `json:"messageId"`
+	LegacyID string `json:"message_id,omitempty"`
+	Ack      string `json:"ack_id,omitempty"`
+	// set when the subscription delivers messages in order
+	OrderingKey string `json:"orderingKey,omitempty"`
+	// the dead letter a replayed message came from
+	replayOf string
+}
+
+type Option func(*Subscriber)
+
+func WithKMS(kms envelope.KMS) Option {
+	return func(s *Subscriber) {
+		s.kms = kms
+	}
+}
+
+func WithDeadLetters(sink deadletter.Sink) Option {
+	return func(s *Subscriber) {
+		s.deadLetters = sink
+	}
+}
+
+func WithDedup(store dedup.Store) Option {
+	return func(s *Subscriber) {
+		s.dedup = store
+	}
 }
 
-func NewSubscriber(cfg *config.Config, deployFn func(models.DeploymentMessage) error, executor Executor) *Subscriber {
-	return &Subscriber{
+func NewSubscriber(cfg *config.Config, deployFn func(context.Context, models.DeploymentMessage) error, opts ...Option) *Subscriber {
+	s := &Subscriber{
 		cfg:      cfg,
 		deployFn: deployFn,
-		executor: executor,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *Subscriber) HandlePush(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received push request: %s %s", r.Method, r.URL.Path)
-
 	if r.Method != http.MethodPost {
-		log.Printf("Method not allowed: %s", r.Method)
+		slog.Warn("Method not allowed", "method", r.Method)
+		metrics.MessagesReceived.WithLabelValues("invalid").Inc()
 		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
+		slog.Warn("Failed to read push request", "error", err)
+		metrics.MessagesReceived.WithLabelValues("invalid").Inc()
 		http.Error(w, "Error reading request", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
 	var pushRequest struct {
-		Message struct {
-			Data []byte `json:"data,omitempty"`
-			ID   string `json:"id"`
-			Ack  string `json:"ack_id,omitempty"`
-		} `json:"message"`
-		Subscription string `json:"subscription"`
+		Message      message `json:"message"`
+		Subscription string  `json:"subscription"`
 	}
 
 	if err := json.Unmarshal(body, &pushRequest); err != nil {
-		log.Printf("Error unmarshaling push request: %v", err)
+		slog.Warn("Failed to parse push request", "error", err)
+		metrics.MessagesReceived.WithLabelValues("invalid").Inc()
 		http.Error(w, "Error processing message", http.StatusBadRequest)
 		return
 	}
+	if pushRequest.Message.ID == "" {
+		pushRequest.Message.ID = pushRequest.Message.LegacyID
+	}
+
+	// continue the trace of whoever published the message. The request
+	// context ends with the response, processing goes on after that.
+	ctx, span := tracing.Start(tracing.Extract(context.Background(), pushRequest.Message.Attributes), "HandlePush",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("message_id", pushRequest.Message.ID)))
+	defer span.End()
+	ctx = logging.With(ctx, logging.MessageID, pushRequest.Message.ID)
+	if pushRequest.Message.OrderingKey != "" {
+		ctx = logging.With(ctx, "ordering_key", pushRequest.Message.OrderingKey)
+	}
 
 	// Acknowledge the message immediately
 	w.WriteHeader(http.StatusOK)
 
 	// Process the message asynchronously
+	s.processAsync(ctx, pushRequest.Message, 1)
+}
+
+// Replay processes a dead-lettered message again, in the background. The dead
+// letter is removed once the message is processed, and updated in place if it
+// fails again, so a replay cut short by a restart can be replayed again.
+func (s *Subscriber) Replay(ctx context.Context, entry deadletter.Entry) {
+	// processing outlives the request that asked for it
+	ctx = logging.With(context.WithoutCancel(ctx), logging.MessageID, entry.MessageID, "replay_of", entry.ID)
+	s.processAsync(ctx, message{Data: entry.Data, Attributes: entry.Attributes, ID: entry.MessageID, replayOf: entry.ID}, entry.Attempts+1)
+}
+
+// Resume processes again, in the background, the messages a restart stopped
+// processing. They were acked when they arrived, so Pub/Sub won't deliver
+// them again. It returns how many it resumed.
+func (s *Subscriber) Resume(ctx context.Context) (int, error) {
+	if s.dedup == nil {
+		return 0, nil
+	}
+	records, err := s.dedup.Interrupted()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list interrupted messages: %v", err)
+	}
+	resumed := 0
+	for _, record := range records {
+		var msg message
+		if err := json.Unmarshal(record.Message, &msg); err != nil {
+			logging.FromContext(ctx).Warn("Failed to parse interrupted message", "dedup_key", record.Key, "error", err)
+			continue
+		}
+		ctx := logging.With(ctx, logging.MessageID, msg.ID)
+		logging.FromContext(ctx).Info("Resuming interrupted message", "dedup_key", record.Key, "claimed_at", record.ClaimedAt)
+		s.processAsync(ctx, msg, 1)
+		resumed++
+	}
+	return resumed, nil
+}
+
+// processAsync processes a message in the background. Pub/Sub only pushes the
+// next message of an ordering key once this one is acked, which is right away,
+// so messages with an ordering key wait for the ones that arrived before them.
+func (s *Subscriber) processAsync(ctx context.Context, msg message, attempt int) {
+	metrics.QueueDepth.Inc()
+	s.wg.Add(1)
+	previous, done := s.enqueue(msg.OrderingKey)
 	go func() {
-		log.Printf("Processing message ID: %s", pushRequest.Message.ID)
-		log.Printf("Received message data: %.100s", string(pushRequest.Message.Data))
+		defer s.wg.Done()
+		defer metrics.QueueDepth.Dec()
+		defer s.dequeue(msg.OrderingKey, done)
+		if previous != nil {
+			<-previous
+		}
+		s.process(ctx, msg, attempt)
+	}()
+}
+
+// enqueue makes a message the last of its ordering key. It returns what closes
+// once the message before it is processed, and what to close once this one is.
+func (s *Subscriber) enqueue(orderingKey string) (previous, done chan struct{}) {
+	if orderingKey == "" {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tails == nil {
+		s.tails = make(map[string]chan struct{})
+	}
+	previous, done = s.tails[orderingKey], make(chan struct{})
+	s.tails[orderingKey] = done
+	return previous, done
+}
+
+func (s *Subscriber) dequeue(orderingKey string, done chan struct{}) {
+	if done == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(done)
+	if s.tails[orderingKey] == done {
+		delete(s.tails, orderingKey)
+	}
+}
 
-		var deploymentMsg models.DeploymentMessage
-		if err := json.Unmarshal(pushRequest.Message.Data, &deploymentMsg); err != nil {
-			log.Printf("Error unmarshaling deployment message: %v", err)
+func (s *Subscriber) process(ctx context.Context, msg message, attempt int) {
+	ctx, span := tracing.Start(ctx, "process message")
+	var err error
+	defer func() { tracing.End(span, err) }()
+	logger := logging.FromContext(ctx)
+	// the payload carries secrets the scrubber doesn't know about yet
+	logger.Info("Processing message", "bytes", len(msg.Data), "attempt", attempt)
+
+	var data []byte
+	data, err = s.openMessage(msg.Data)
+	if err != nil {
+		logger.Warn("Rejecting message", "error", err)
+		metrics.MessagesReceived.WithLabelValues("rejected").Inc()
+		s.deadLetter(ctx, msg, deadletter.ReasonRejected, err, attempt)
+		return
+	}
+
+	var deploymentMsg models.DeploymentMessage
+	if deploymentMsg, err = models.DecodeDeploymentMessage(data); err == nil {
+		err = deploymentMsg.Validate()
+	}
+	if err != nil {
+		logger.Warn("Failed to parse deployment message", "error", err)
+		metrics.MessagesReceived.WithLabelValues("rejected").Inc()
+		s.deadLetter(ctx, msg, deadletter.ReasonInvalid, err, attempt)
+		return
+	}
+
+	// don't log the deploymentMsg, it has secrets
+	logger.Info("Received deployment message", logging.Action, deploymentMsg.Action, logging.ProjectID, deploymentMsg.ProjectID, logging.PackageID, deploymentMsg.PackageID, "schema_version", deploymentMsg.SchemaVersion)
+
+	// a replay is meant to run the message again
+	key := dedupKey(msg, deploymentMsg)
+	deduplicated := s.dedup != nil && key != "" && attempt == 1
+	if deduplicated {
+		// kept until processed, to resume the message if a restart cuts it short
+		delivered, _ := json.Marshal(msg)
+		record, claimed, claimErr := s.dedup.Claim(key, delivered)
+		if claimErr != nil {
+			// processing twice beats not processing at all
+			logger.Warn("Failed to check for a duplicate message", "error", claimErr)
+			deduplicated = false
+		} else if !claimed {
+			logger.Info("Skipping duplicate message", "dedup_key", key, "state", record.State, "result", record.Error, "claimed_at", record.ClaimedAt)
+			metrics.MessagesReceived.WithLabelValues("duplicate").Inc()
 			return
 		}
+	}
 
-		// don't print the deploymentMsg, it has secrets
-		// log.Printf("%s package: %+v", deploymentMsg.Action, deploymentMsg)
-		log.Printf("%s package: %s", deploymentMsg.Action, deploymentMsg.PackageID)
-		if err := s.deployFn(deploymentMsg); err != nil {
-			log.Printf("Error deploying package: %v", err)
-			errorDeployData := map[string]interface{}{
-				"error": err.Error(),
-			}
-			if postErr := s.executor.PostOutputToAPI(deploymentMsg.ProjectID, deploymentMsg.PackageID, errorDeployData, models.Failed); postErr != nil {
-				log.Printf("Failed to post error to API: %v", postErr)
-			}
+	metrics.MessagesReceived.WithLabelValues("accepted").Inc()
+	// the deployer reports failures itself, as part of the package lifecycle.
+	// The message was acked, so it is only tried again from here.
+	for {
+		if err = s.deployFn(ctx, deploymentMsg); err == nil || attempt >= s.cfg.DeadLetterMaxAttempts {
+			break
 		}
-	}()
+		delay := time.Duration(attempt*s.cfg.MessageRetrySeconds) * time.Second
+		logger.Warn("Retrying failed message", "error", err, "attempt", attempt, "retry_in", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		attempt++
+	}
+	if err != nil {
+		logger.Error("Failed to process message", "error", err, "attempts", attempt)
+		s.deadLetter(ctx, msg, deadletter.ReasonFailed, err, attempt)
+	} else {
+		s.replayed(ctx, msg)
+	}
+	if deduplicated {
+		if completeErr := s.dedup.Complete(key, err); completeErr != nil {
+			logger.Warn("Failed to record the result of the message", "error", completeErr)
+		}
+	}
+}
+
+// dedupKey identifies a message across deliveries, by its idempotency key or
+// else its Pub/Sub message id.
+func dedupKey(msg message, deploymentMsg models.DeploymentMessage) string {
+	if deploymentMsg.IdempotencyKey != "" {
+		return "idempotency_key:" + deploymentMsg.IdempotencyKey
+	}
+	if msg.ID != "" {
+		return "message_id:" + msg.ID
+	}
+	return ""
+}
+
+// deadLetter hands a message that couldn't be processed to the dead letter
+// sink, so it can be replayed.
+func (s *Subscriber) deadLetter(ctx context.Context, msg message, reason deadletter.Reason, err error, attempts int) {
+	if s.deadLetters == nil {
+		return
+	}
+	logger := logging.FromContext(ctx)
+	entry := deadletter.NewEntry(msg.ID, msg.Data, msg.Attributes, reason, err, attempts)
+	if msg.replayOf != "" {
+		entry.ID = msg.replayOf
+	}
+	if err := s.deadLetters.Put(ctx, entry); err != nil {
+		logger.Error("Failed to dead-letter message", "error", err)
+		return
+	}
+	metrics.DeadLetters.WithLabelValues(string(reason)).Inc()
+	logger.Info("Dead-lettered message", "dead_letter_id", entry.ID, "reason", reason)
+}
+
+// replayed removes the dead letter a message was replayed from once it has
+// been processed.
+func (s *Subscriber) replayed(ctx context.Context, msg message) {
+	store, ok := s.deadLetters.(interface{ Delete(id string) error })
+	if msg.replayOf == "" || !ok {
+		return
+	}
+	if err := store.Delete(msg.replayOf); err != nil && !errors.Is(err, deadletter.ErrNotFound) {
+		logging.FromContext(ctx).Error("Failed to remove replayed dead letter", "dead_letter_id", msg.replayOf, "error", err)
+	}
+}
+
+// Wait blocks until every message accepted so far has been processed.
+func (s *Subscriber) Wait() {
+	s.wg.Wait()
+}
+
+// openMessage decrypts an enveloped message payload. Plain payloads are
+// returned as is unless encrypted messages are required.
+func (s *Subscriber) openMessage(data []byte) ([]byte, error) {
+	if !envelope.IsEnvelope(data) {
+		if s.cfg.RequireEncryptedMessages {
+			return nil, fmt.Errorf("unencrypted messages are not accepted")
+		}
+		return data, nil
+	}
+	if s.kms == nil {
+		return nil, fmt.Errorf("received an encrypted message but no kms is configured")
+	}
+	return envelope.Open(context.Background(), s.kms, data)
 }
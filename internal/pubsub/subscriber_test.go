@@ -2,15 +2,25 @@ package pubsub
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"encoding/base64"
 
 	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/deadletter"
+	"github.com/radiatus-ai/package-provisioner/internal/dedup"
+	"github.com/radiatus-ai/package-provisioner/internal/envelope"
+	"github.com/radiatus-ai/package-provisioner/internal/tracing"
 	"github.com/radiatus-ai/package-provisioner/pkg/models"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestSubscriber_HandlePush(t *testing.T) {
@@ -21,13 +31,13 @@ func TestSubscriber_HandlePush(t *testing.T) {
 	}
 
 	deploymentCount := 0
-	testDeployFn := func(msg models.DeploymentMessage) error {
+	testDeployFn := func(ctx context.Context, msg models.DeploymentMessage) error {
 		deploymentCount++
 		t.Logf("Deployment function called with message: %+v", msg)
 		return nil
 	}
 
-	subscriber := NewSubscriber(cfg, testDeployFn, nil)
+	subscriber := NewSubscriber(cfg, testDeployFn)
 
 	// Create a test message
 	testMsg := models.DeploymentMessage{
@@ -36,6 +46,7 @@ func TestSubscriber_HandlePush(t *testing.T) {
 		Package: models.Package{
 			Type: "test-package",
 		},
+		Action: models.ActionDeploy,
 	}
 	msgBytes, _ := json.Marshal(testMsg)
 
@@ -46,12 +57,12 @@ func TestSubscriber_HandlePush(t *testing.T) {
 	pushRequest := struct {
 		Message struct {
 			Data string `json:"data"`
-			ID   string `json:"id"`
+			ID   string `json:"messageId"`
 		} `json:"message"`
 	}{
 		Message: struct {
 			Data string `json:"data"`
-			ID   string `json:"id"`
+			ID   string `json:"messageId"`
 		}{
 			Data: encodedData,
 			ID:   "test-message-id",
@@ -71,6 +82,7 @@ func TestSubscriber_HandlePush(t *testing.T) {
 
 	// Call the HandlePush method
 	subscriber.HandlePush(rr, req)
+	subscriber.Wait()
 
 	// Check the status code
 	if status := rr.Code; status != http.StatusOK {
@@ -87,7 +99,7 @@ func TestSubscriber_HandlePush(t *testing.T) {
 }
 
 func TestSubscriber_HandlePush_InvalidMethod(t *testing.T) {
-	subscriber := NewSubscriber(&config.Config{}, func(msg models.DeploymentMessage) error { return nil }, nil)
+	subscriber := NewSubscriber(&config.Config{}, func(ctx context.Context, msg models.DeploymentMessage) error { return nil })
 
 	req, err := http.NewRequest("GET", "/push", nil)
 	if err != nil {
@@ -103,7 +115,7 @@ func TestSubscriber_HandlePush_InvalidMethod(t *testing.T) {
 }
 
 func TestSubscriber_HandlePush_InvalidBody(t *testing.T) {
-	subscriber := NewSubscriber(&config.Config{}, func(msg models.DeploymentMessage) error { return nil }, nil)
+	subscriber := NewSubscriber(&config.Config{}, func(ctx context.Context, msg models.DeploymentMessage) error { return nil })
 
 	req, err := http.NewRequest("POST", "/push", bytes.NewBufferString("invalid json"))
 	if err != nil {
@@ -117,3 +129,385 @@ func TestSubscriber_HandlePush_InvalidBody(t *testing.T) {
 		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
 	}
 }
+
+// pushBody wraps message data in a Pub/Sub push request.
+func pushBody(t *testing.T, data []byte) *bytes.Buffer {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"data":        base64.StdEncoding.EncodeToString(data),
+			"messageId":   "test-message-id",
+			"message_id":  "test-message-id",
+			"publishTime": "2024-01-01T00:00:00.000Z",
+		},
+		"subscription": "projects/test-project/subscriptions/provisioner",
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal push request: %v", err)
+	}
+	return bytes.NewBuffer(body)
+}
+
+func TestSubscriber_HandlePush_EncryptedMessage(t *testing.T) {
+	kms := envelope.NewLocalKMS(map[string][]byte{"dev": []byte("0123456789abcdef0123456789abcdef")})
+	cfg := &config.Config{RequireEncryptedMessages: true}
+
+	var received []models.DeploymentMessage
+	subscriber := NewSubscriber(cfg, func(ctx context.Context, msg models.DeploymentMessage) error {
+		received = append(received, msg)
+		return nil
+	}, WithKMS(kms))
+
+	msg := testMessage(models.ActionDeploy)
+	msg.Secrets = map[string]string{"password": "hunter2"}
+	msgBytes, _ := json.Marshal(msg)
+	sealed, err := envelope.Seal(context.Background(), kms, "dev", msgBytes)
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+
+	for _, data := range [][]byte{sealed, msgBytes} {
+		req := httptest.NewRequest(http.MethodPost, "/push", pushBody(t, data))
+		rr := httptest.NewRecorder()
+		subscriber.HandlePush(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+	}
+	subscriber.Wait()
+
+	// the plaintext copy is rejected in strict mode
+	if len(received) != 1 {
+		t.Fatalf("Expected only the encrypted message to be deployed, got %d", len(received))
+	}
+	if received[0].PackageID != "test-package" || received[0].Secrets["password"] != "hunter2" {
+		t.Errorf("Unexpected decrypted message: %+v", received[0])
+	}
+}
+
+func TestSubscriber_HandlePush_EncryptedMessageWithoutKMS(t *testing.T) {
+	kms := envelope.NewLocalKMS(map[string][]byte{"dev": []byte("0123456789abcdef0123456789abcdef")})
+	deployed := 0
+	subscriber := NewSubscriber(&config.Config{}, func(ctx context.Context, msg models.DeploymentMessage) error {
+		deployed++
+		return nil
+	})
+
+	sealed, _ := envelope.Seal(context.Background(), kms, "dev", mustMarshal(t, testMessage(models.ActionDeploy)))
+	subscriber.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", pushBody(t, sealed)))
+	subscriber.Wait()
+
+	if deployed != 0 {
+		t.Errorf("Expected an encrypted message to be rejected without a kms, got %d deployments", deployed)
+	}
+}
+
+func TestSubscriber_HandlePush_ContinuesTrace(t *testing.T) {
+	_, restore := tracing.UseInMemory()
+	defer restore()
+
+	var deployCtx context.Context
+	subscriber := NewSubscriber(&config.Config{}, func(ctx context.Context, msg models.DeploymentMessage) error {
+		deployCtx = ctx
+		return nil
+	})
+
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	body, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"data":       base64.StdEncoding.EncodeToString(mustMarshal(t, testMessage(models.ActionDeploy))),
+			"attributes": map[string]string{"traceparent": traceParent},
+			"messageId":  "test-message-id",
+		},
+	})
+	subscriber.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", bytes.NewBuffer(body)))
+	subscriber.Wait()
+
+	if deployCtx == nil {
+		t.Fatal("Expected the message to be deployed")
+	}
+	if got := trace.SpanContextFromContext(deployCtx).TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Deploy trace id = %s, want the publisher's", got)
+	}
+}
+
+func TestSubscriber_HandlePush_DeadLetters(t *testing.T) {
+	store := deadletter.NewFileStore(t.TempDir())
+	failing := true
+	deployed, attempts := 0, 0
+	subscriber := NewSubscriber(&config.Config{DeadLetterMaxAttempts: 3}, func(ctx context.Context, msg models.DeploymentMessage) error {
+		attempts++
+		if failing {
+			return errors.New("terraform apply failed")
+		}
+		deployed++
+		return nil
+	}, WithDeadLetters(store))
+
+	subscriber.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", pushBody(t, []byte("not json"))))
+	subscriber.Wait()
+	entry, err := store.Get("test-message-id")
+	if err != nil {
+		t.Fatalf("Expected the invalid message to be dead-lettered, got %v", err)
+	}
+	if entry.Reason != deadletter.ReasonInvalid || string(entry.Data) != "not json" || entry.Attempts != 1 {
+		t.Errorf("Unexpected dead letter %+v", entry)
+	}
+
+	msgBytes, _ := json.Marshal(testMessage(models.ActionDeploy))
+	subscriber.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", pushBody(t, msgBytes)))
+	subscriber.Wait()
+	entry, _ = store.Get("test-message-id")
+	if entry.Reason != deadletter.ReasonFailed || entry.Error != "terraform apply failed" || entry.Attempts != 3 {
+		t.Fatalf("Expected the failed message to be dead-lettered after 3 attempts, got %+v", entry)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected the failed message to be tried 3 times, got %d", attempts)
+	}
+
+	// a replay that still fails updates the dead letter it came from, it is
+	// past the attempt limit already
+	subscriber.Replay(context.Background(), *entry)
+	subscriber.Wait()
+	if entries, _ := store.List(); len(entries) != 1 || entries[0].ID != entry.ID || entries[0].Attempts != 4 {
+		t.Errorf("Expected the dead letter to be kept after 4 attempts, got %+v", entries)
+	}
+	if attempts != 4 {
+		t.Errorf("Expected a replay to be tried once, got %d attempts", attempts)
+	}
+
+	// and is removed once the replay goes through
+	failing = false
+	subscriber.Replay(context.Background(), *entry)
+	subscriber.Wait()
+	if deployed != 1 {
+		t.Errorf("Expected the replay to deploy, got %d deployments", deployed)
+	}
+	if entries, _ := store.List(); len(entries) != 0 {
+		t.Errorf("Expected no dead letters after a successful replay, got %+v", entries)
+	}
+}
+
+func TestSubscriber_HandlePush_RetriesFailedMessages(t *testing.T) {
+	store := deadletter.NewFileStore(t.TempDir())
+	attempts := 0
+	subscriber := NewSubscriber(&config.Config{DeadLetterMaxAttempts: 3}, func(ctx context.Context, msg models.DeploymentMessage) error {
+		attempts++
+		if attempts < 2 {
+			return errors.New("terraform apply failed")
+		}
+		return nil
+	}, WithDeadLetters(store))
+
+	subscriber.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", pushBody(t, mustMarshal(t, testMessage(models.ActionDeploy)))))
+	subscriber.Wait()
+	if attempts != 2 {
+		t.Errorf("Expected the message to be tried until it deployed, got %d attempts", attempts)
+	}
+	if entries, _ := store.List(); len(entries) != 0 {
+		t.Errorf("Expected a message that went through on a retry not to be dead-lettered, got %+v", entries)
+	}
+}
+
+func TestSubscriber_HandlePush_RejectsInvalidMessages(t *testing.T) {
+	store := deadletter.NewFileStore(t.TempDir())
+	deployed := 0
+	subscriber := NewSubscriber(&config.Config{}, func(ctx context.Context, msg models.DeploymentMessage) error {
+		deployed++
+		return nil
+	}, WithDeadLetters(store))
+
+	traversal := testMessage(models.ActionDeploy)
+	traversal.PackageID = "../../etc"
+	missing := testMessage(models.ActionDeploy)
+	missing.PackageID = ""
+	for _, data := range [][]byte{
+		mustMarshal(t, traversal),
+		mustMarshal(t, missing),
+		[]byte(`{"schema_version": 99, "project_id": "test-project", "package_id": "test-package", "action": "DEPLOY"}`),
+	} {
+		subscriber.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", pushBody(t, data)))
+		subscriber.Wait()
+		entry, err := store.Get("test-message-id")
+		if err != nil || entry.Reason != deadletter.ReasonInvalid {
+			t.Errorf("Expected %s to be dead-lettered as invalid, got %+v, %v", data, entry, err)
+		}
+		store.Delete("test-message-id")
+	}
+	if deployed != 0 {
+		t.Errorf("Expected no invalid message to be deployed, got %d deployments", deployed)
+	}
+}
+
+func TestSubscriber_HandlePush_SkipsDuplicates(t *testing.T) {
+	store := dedup.NewFileStore(t.TempDir(), time.Hour)
+	var deployed []models.DeploymentMessage
+	failing := false
+	subscriber := NewSubscriber(&config.Config{}, func(ctx context.Context, msg models.DeploymentMessage) error {
+		deployed = append(deployed, msg)
+		if failing {
+			return errors.New("terraform apply failed")
+		}
+		return nil
+	}, WithDedup(store))
+
+	push := func(id string, msg models.DeploymentMessage) {
+		data, _ := json.Marshal(msg)
+		body, _ := json.Marshal(map[string]interface{}{
+			"message": map[string]interface{}{"data": base64.StdEncoding.EncodeToString(data), "messageId": id},
+		})
+		subscriber.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", bytes.NewBuffer(body)))
+		subscriber.Wait()
+	}
+
+	msg := testMessage(models.ActionDeploy)
+	push("message-1", msg)
+	push("message-1", msg)
+	if len(deployed) != 1 {
+		t.Fatalf("Expected a redelivery to be skipped, got %d deployments", len(deployed))
+	}
+	push("message-2", msg)
+	if len(deployed) != 2 {
+		t.Fatalf("Expected another message to be deployed, got %d deployments", len(deployed))
+	}
+	// the id is read from message_id when messageId is missing
+	body := mustMarshal(t, map[string]interface{}{
+		"message": map[string]interface{}{"data": base64.StdEncoding.EncodeToString(mustMarshal(t, msg)), "message_id": "message-2"},
+	})
+	subscriber.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", bytes.NewBuffer(body)))
+	subscriber.Wait()
+	if len(deployed) != 2 {
+		t.Fatalf("Expected a redelivery with message_id to be skipped, got %d deployments", len(deployed))
+	}
+
+	// published twice under the same idempotency key
+	msg.IdempotencyKey = "request-1"
+	failing = true
+	push("message-3", msg)
+	push("message-4", msg)
+	if len(deployed) != 3 {
+		t.Fatalf("Expected a republished message to be skipped, got %d deployments", len(deployed))
+	}
+	record, _, _ := store.Claim("idempotency_key:request-1", nil)
+	if record.State != dedup.StateFailed || record.Error != "terraform apply failed" {
+		t.Errorf("Expected the failure to be recorded, got %+v", record)
+	}
+
+	// replays aren't duplicates
+	subscriber.Replay(context.Background(), deadletter.Entry{ID: "message-3", MessageID: "message-3", Data: mustMarshal(t, msg), Attempts: 1})
+	subscriber.Wait()
+	if len(deployed) != 4 {
+		t.Errorf("Expected the replay to be deployed, got %d deployments", len(deployed))
+	}
+}
+
+func TestSubscriber_Resume(t *testing.T) {
+	root := t.TempDir()
+	started, release := make(chan struct{}), make(chan struct{})
+	before := NewSubscriber(&config.Config{}, func(ctx context.Context, msg models.DeploymentMessage) error {
+		close(started)
+		<-release
+		return nil
+	}, WithDedup(dedup.NewFileStore(root, time.Hour)))
+	defer before.Wait()
+	defer close(release)
+	before.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", pushBody(t, mustMarshal(t, testMessage(models.ActionDeploy)))))
+	<-started
+
+	// the process stopped with the message in progress
+	var deployed []models.DeploymentMessage
+	after := NewSubscriber(&config.Config{}, func(ctx context.Context, msg models.DeploymentMessage) error {
+		deployed = append(deployed, msg)
+		return nil
+	}, WithDedup(dedup.NewFileStore(root, time.Hour)))
+	resumed, err := after.Resume(context.Background())
+	if err != nil || resumed != 1 {
+		t.Fatalf("Resume() = %d, %v, want 1 message resumed", resumed, err)
+	}
+	after.Wait()
+	if len(deployed) != 1 || deployed[0].PackageID != "test-package" {
+		t.Fatalf("Expected the interrupted message to be deployed, got %v", deployed)
+	}
+
+	// processed now, neither resumed nor deployed again
+	if resumed, _ := after.Resume(context.Background()); resumed != 0 {
+		t.Errorf("Expected nothing left to resume, got %d", resumed)
+	}
+	after.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", pushBody(t, mustMarshal(t, testMessage(models.ActionDeploy)))))
+	after.Wait()
+	if len(deployed) != 1 {
+		t.Errorf("Expected a redelivery to be skipped, got %d deployments", len(deployed))
+	}
+}
+
+// testMessage returns a valid message for action.
+func testMessage(action models.DeploymentAction) models.DeploymentMessage {
+	msg := models.DeploymentMessage{
+		ProjectID: "test-project",
+		PackageID: "test-package",
+		Package:   models.Package{Type: "test-type"},
+		Action:    action,
+	}
+	if action.IsProjectAction() {
+		msg.PackageID, msg.Package = "", models.Package{}
+		msg.Packages = []models.DeploymentMessage{testMessage(models.ActionDeploy)}
+	}
+	return msg
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	return data
+}
+
+func TestSubscriber_HandlePush_OrderingKey(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []models.DeploymentAction
+	subscriber := NewSubscriber(&config.Config{}, func(ctx context.Context, msg models.DeploymentMessage) error {
+		if msg.Action == models.ActionDeploy {
+			// the deploy is slow, a destroy racing it would win
+			<-release
+		}
+		mu.Lock()
+		order = append(order, msg.Action)
+		mu.Unlock()
+		return nil
+	})
+
+	push := func(id, orderingKey string, action models.DeploymentAction) {
+		data := mustMarshal(t, testMessage(action))
+		body := mustMarshal(t, map[string]interface{}{
+			"message": map[string]interface{}{"data": base64.StdEncoding.EncodeToString(data), "messageId": id, "orderingKey": orderingKey},
+		})
+		subscriber.HandlePush(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", bytes.NewBuffer(body)))
+	}
+	push("message-1", "test-package", models.ActionDeploy)
+	push("message-2", "test-package", models.ActionDestroy)
+	// a message without a key doesn't wait
+	push("message-3", "", models.ActionDestroyProject)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(order)
+		mu.Unlock()
+		if n == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	subscriber.Wait()
+
+	want := []models.DeploymentAction{models.ActionDestroyProject, models.ActionDeploy, models.ActionDestroy}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("Processed %v, want %v", order, want)
+	}
+	if len(subscriber.tails) != 0 {
+		t.Errorf("Expected no ordering keys left, got %v", subscriber.tails)
+	}
+}
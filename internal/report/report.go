@@ -0,0 +1,182 @@
+package report
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/pubsub"
+	"github.com/radiatus-ai/package-provisioner/internal/webhook"
+)
+
+const (
+	// PATCH canvas-api directly
+	TransportHTTP = "http"
+	// publish result events to a Pub/Sub topic
+	TransportPubSub = "pubsub"
+	// post signed events to a webhook
+	TransportWebhook = "webhook"
+	// only log updates, for running without anything tracking package state
+	TransportLog = "log"
+)
+
+// Update is a status update of a package, the unit every transport sends.
+type Update struct {
+	ProjectID      string                      `json:"project_id"`
+	PackageID      string                      `json:"package_id"`
+	IdempotencyKey string                      `json:"idempotency_key,omitempty"`
+	Payload        canvasapi.OutputPayloadBody `json:"payload"`
+}
+
+func (u Update) status() string {
+	if u.Payload.DeployStatus == nil {
+		return ""
+	}
+	return *u.Payload.DeployStatus
+}
+
+// Reporter delivers status updates to wherever package state is tracked.
+type Reporter interface {
+	Report(ctx context.Context, update Update) error
+}
+
+// Retryable reports whether delivering an update again could succeed. The
+// receiver rejecting an update is final, anything else is assumed transient.
+func Retryable(err error) bool {
+	var webhookErr *webhook.StatusError
+	if errors.As(err, &webhookErr) {
+		return webhookErr.StatusCode >= 500 || webhookErr.StatusCode == http.StatusTooManyRequests
+	}
+	return canvasapi.Retryable(err)
+}
+
+// Rejected reports whether the receiver refused an update, so delivering it
+// again would fail the same way. Only a 4xx answer is a refusal, an error that
+// doesn't say, e.g. a timeout, is not, and neither is an auth failure, which
+// is about the provisioner's credentials rather than the update.
+func Rejected(err error) bool {
+	if errors.Is(err, canvasapi.ErrNotFound) {
+		return true
+	}
+	var apiErr *canvasapi.StatusError
+	if errors.As(err, &apiErr) {
+		return refused(apiErr.StatusCode)
+	}
+	var webhookErr *webhook.StatusError
+	if errors.As(err, &webhookErr) {
+		return refused(webhookErr.StatusCode)
+	}
+	return false
+}
+
+// a request timing out, being throttled or sent with expired or rotated
+// credentials may go through later
+func refused(statusCode int) bool {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return statusCode >= 400 && statusCode < 500
+}
+
+func NewFromConfig(ctx context.Context, cfg *config.Config) (Reporter, error) {
+	switch cfg.ReportTransport {
+	case "", TransportHTTP:
+		return NewHTTPReporter(canvasapi.NewClientFromConfig(cfg)), nil
+	case TransportPubSub:
+		if cfg.ReportTopicID == "" {
+			return nil, fmt.Errorf("REPORT_TOPIC_ID is required for the pubsub transport")
+		}
+		publisher, err := pubsub.NewTopicPublisher(ctx, cfg.ProjectID, cfg.ReportTopicID)
+		if err != nil {
+			return nil, err
+		}
+		return NewPubSubReporter(publisher), nil
+	case TransportWebhook:
+		if cfg.ReportWebhookURL == "" || cfg.ReportWebhookSecret == "" {
+			return nil, fmt.Errorf("REPORT_WEBHOOK_URL and REPORT_WEBHOOK_SECRET are required for the webhook transport")
+		}
+		secret, err := base64.StdEncoding.DecodeString(cfg.ReportWebhookSecret)
+		if err != nil {
+			return nil, fmt.Errorf("REPORT_WEBHOOK_SECRET is not valid base64: %v", err)
+		}
+		return NewWebhookReporter(webhook.NewClient(cfg.ReportWebhookURL, secret)), nil
+	case TransportLog:
+		return LogReporter{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported report transport: %s", cfg.ReportTransport)
+	}
+}
+
+// HTTPReporter PATCHes updates to canvas-api.
+type HTTPReporter struct {
+	client *canvasapi.Client
+}
+
+func NewHTTPReporter(client *canvasapi.Client) *HTTPReporter {
+	return &HTTPReporter{client: client}
+}
+
+func (r *HTTPReporter) Report(ctx context.Context, update Update) error {
+	return r.client.UpdatePackage(ctx, update.ProjectID, update.PackageID, update.Payload, update.IdempotencyKey)
+}
+
+// PubSubReporter publishes updates as result events for whoever tracks
+// package state to consume, for when the provisioner can't reach the API.
+type PubSubReporter struct {
+	publisher pubsub.Publisher
+}
+
+func NewPubSubReporter(publisher pubsub.Publisher) *PubSubReporter {
+	return &PubSubReporter{publisher: publisher}
+}
+
+func (r *PubSubReporter) Report(ctx context.Context, update Update) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("error marshaling status update: %v", err)
+	}
+	return r.publisher.Publish(ctx, data, map[string]string{
+		"type":            "STATUS_UPDATE",
+		"project_id":      update.ProjectID,
+		"package_id":      update.PackageID,
+		"deploy_status":   update.status(),
+		"idempotency_key": update.IdempotencyKey,
+	})
+}
+
+// WebhookReporter posts updates to a webhook, signed with a shared secret.
+type WebhookReporter struct {
+	client *webhook.Client
+}
+
+func NewWebhookReporter(client *webhook.Client) *WebhookReporter {
+	return &WebhookReporter{client: client}
+}
+
+func (r *WebhookReporter) Report(ctx context.Context, update Update) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("error marshaling status update: %v", err)
+	}
+	headers := http.Header{}
+	if update.IdempotencyKey != "" {
+		headers.Set("Idempotency-Key", update.IdempotencyKey)
+	}
+	return r.client.Send(ctx, data, headers)
+}
+
+// LogReporter logs updates instead of delivering them, the package is already
+// on the logger of a run.
+type LogReporter struct{}
+
+func (LogReporter) Report(ctx context.Context, update Update) error {
+	logging.FromContext(ctx).Info("Status update", "deploy_status", update.status(), "idempotency_key", update.IdempotencyKey)
+	return nil
+}
@@ -0,0 +1,186 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi"
+	"github.com/radiatus-ai/package-provisioner/internal/canvasapi/canvasapitest"
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+	"github.com/radiatus-ai/package-provisioner/internal/webhook"
+)
+
+func deployedUpdate() Update {
+	status := "DEPLOYED"
+	return Update{
+		ProjectID:      "test-project",
+		PackageID:      "test-package",
+		IdempotencyKey: "run-1:DEPLOYED",
+		Payload: canvasapi.OutputPayloadBody{
+			DeployStatus: &status,
+			OutputData:   map[string]interface{}{"host": "10.0.0.1"},
+		},
+	}
+}
+
+func TestHTTPReporter(t *testing.T) {
+	server := canvasapitest.NewServer()
+	defer server.Close()
+
+	reporter, err := NewFromConfig(context.Background(), &config.Config{APIURL: server.URL})
+	if err != nil {
+		t.Fatalf("NewFromConfig() error = %v", err)
+	}
+	if err := reporter.Report(context.Background(), deployedUpdate()); err != nil {
+		t.Fatalf("Report() error = %v", err)
+	}
+
+	updates := server.Updates()
+	if len(updates) != 1 || updates[0].IdempotencyKey != "run-1:DEPLOYED" || *updates[0].Payload.DeployStatus != "DEPLOYED" {
+		t.Errorf("Unexpected updates %+v", updates)
+	}
+}
+
+type fakePublisher struct {
+	data       []byte
+	attributes map[string]string
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, data []byte, attributes map[string]string) error {
+	f.data = data
+	f.attributes = attributes
+	return nil
+}
+
+func TestPubSubReporter(t *testing.T) {
+	publisher := &fakePublisher{}
+	if err := NewPubSubReporter(publisher).Report(context.Background(), deployedUpdate()); err != nil {
+		t.Fatalf("Report() error = %v", err)
+	}
+
+	if publisher.attributes["type"] != "STATUS_UPDATE" || publisher.attributes["deploy_status"] != "DEPLOYED" || publisher.attributes["package_id"] != "test-package" {
+		t.Errorf("Unexpected attributes %v", publisher.attributes)
+	}
+	var event Update
+	if err := json.Unmarshal(publisher.data, &event); err != nil {
+		t.Fatalf("Failed to parse event: %v", err)
+	}
+	if event.ProjectID != "test-project" || event.Payload.OutputData["host"] != "10.0.0.1" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestWebhookReporter(t *testing.T) {
+	secret := []byte("shared-secret")
+	var received Update
+	var verifyErr error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		verifyErr = webhook.Verify(secret, r.Header, body, time.Minute)
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	reporter, err := NewFromConfig(context.Background(), &config.Config{
+		ReportTransport:     TransportWebhook,
+		ReportWebhookURL:    server.URL,
+		ReportWebhookSecret: base64.StdEncoding.EncodeToString(secret),
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig() error = %v", err)
+	}
+	if err := reporter.Report(context.Background(), deployedUpdate()); err != nil {
+		t.Fatalf("Report() error = %v", err)
+	}
+	if verifyErr != nil {
+		t.Errorf("Receiver failed to verify the webhook: %v", verifyErr)
+	}
+	if received.PackageID != "test-package" || received.IdempotencyKey != "run-1:DEPLOYED" {
+		t.Errorf("Unexpected webhook body %+v", received)
+	}
+}
+
+func TestLogReporter(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := logging.Tee(context.Background(), &buf)
+	reporter, err := NewFromConfig(ctx, &config.Config{ReportTransport: TransportLog})
+	if err != nil {
+		t.Fatalf("NewFromConfig() error = %v", err)
+	}
+	if err := reporter.Report(ctx, deployedUpdate()); err != nil {
+		t.Fatalf("Report() error = %v", err)
+	}
+	if !strings.Contains(buf.String(), `"deploy_status":"DEPLOYED"`) {
+		t.Errorf("Expected the update to be logged, got %s", buf.String())
+	}
+}
+
+func TestNewFromConfig_Invalid(t *testing.T) {
+	for _, cfg := range []*config.Config{
+		{ReportTransport: "carrier-pigeon"},
+		{ReportTransport: TransportPubSub},
+		{ReportTransport: TransportWebhook, ReportWebhookURL: "https://example.com/hook"},
+		{ReportTransport: TransportWebhook, ReportWebhookURL: "https://example.com/hook", ReportWebhookSecret: "not base64!"},
+	} {
+		if _, err := NewFromConfig(context.Background(), cfg); err == nil {
+			t.Errorf("Expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection refused"), false},
+		{fmt.Errorf("error sending HTTP request: %w", context.DeadlineExceeded), false},
+		{context.Canceled, false},
+		{&canvasapi.StatusError{StatusCode: http.StatusBadGateway}, false},
+		{&canvasapi.StatusError{StatusCode: http.StatusBadRequest}, true},
+		{&canvasapi.StatusError{StatusCode: http.StatusTooManyRequests}, false},
+		{canvasapi.ErrNotFound, true},
+		{&webhook.StatusError{StatusCode: http.StatusServiceUnavailable}, false},
+		{&webhook.StatusError{StatusCode: http.StatusRequestTimeout}, false},
+		{&webhook.StatusError{StatusCode: http.StatusUnauthorized}, false},
+		{&canvasapi.StatusError{StatusCode: http.StatusForbidden}, false},
+		{&webhook.StatusError{StatusCode: http.StatusUnprocessableEntity}, true},
+	}
+	for _, tt := range tests {
+		if got := Rejected(tt.err); got != tt.want {
+			t.Errorf("Rejected(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection refused"), true},
+		{fmt.Errorf("error sending HTTP request: %w", context.DeadlineExceeded), true},
+		{&canvasapi.StatusError{StatusCode: http.StatusBadGateway}, true},
+		{&canvasapi.StatusError{StatusCode: http.StatusBadRequest}, false},
+		{canvasapi.ErrNotFound, false},
+		{&webhook.StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&webhook.StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&webhook.StatusError{StatusCode: http.StatusUnauthorized}, false},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("Retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
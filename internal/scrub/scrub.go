@@ -0,0 +1,230 @@
+package scrub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+)
+
+// values shorter than this are not scrubbed, masking every "1" or "on" in the
+// logs would make them unreadable without protecting anything
+const minLength = 4
+
+// Registry knows the secret values in use by the runs in progress and masks
+// them, and the encoded forms they commonly show up in, wherever they appear.
+type Registry struct {
+	mu sync.RWMutex
+	// registered values, counted since concurrent runs may share a secret
+	values   map[string]int
+	replacer *strings.Replacer
+}
+
+func NewRegistry() *Registry {
+	return &Registry{values: make(map[string]int)}
+}
+
+// Default is the registry behind the process wide log output.
+var Default = NewRegistry()
+
+// Register adds values to the registry until the returned release func is
+// called. It is safe to call on a nil Registry.
+func (r *Registry) Register(values ...string) (release func()) {
+	var added []string
+	for _, v := range values {
+		if len(v) >= minLength {
+			added = append(added, v)
+		}
+	}
+	if r == nil || len(added) == 0 {
+		return func() {}
+	}
+
+	r.mu.Lock()
+	for _, v := range added {
+		r.values[v]++
+	}
+	r.rebuild()
+	r.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			for _, v := range added {
+				if r.values[v]--; r.values[v] <= 0 {
+					delete(r.values, v)
+				}
+			}
+			r.rebuild()
+		})
+	}
+}
+
+// RegisterValue registers the string leaves of an arbitrary value, such as a
+// terraform output, along with its JSON form.
+func (r *Registry) RegisterValue(v interface{}) (release func()) {
+	var values []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case string:
+			values = append(values, t)
+		case map[string]interface{}:
+			for _, item := range t {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range t {
+				walk(item)
+			}
+		}
+	}
+	walk(v)
+	if _, ok := v.(string); !ok && v != nil {
+		if data, err := json.Marshal(v); err == nil {
+			values = append(values, string(data))
+		}
+	}
+	return r.Register(values...)
+}
+
+// rebuild must be called with mu held.
+func (r *Registry) rebuild() {
+	variants := make(map[string]bool)
+	for v := range r.values {
+		for _, variant := range encodings(v) {
+			if len(variant) >= minLength {
+				variants[variant] = true
+			}
+		}
+	}
+	if len(variants) == 0 {
+		r.replacer = nil
+		return
+	}
+
+	// longest first so a value is never partially masked by a shorter one
+	sorted := make([]string, 0, len(variants))
+	for v := range variants {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, v := range sorted {
+		pairs = append(pairs, v, sensitive.Mask)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// encodings returns the forms a value takes when it ends up in a JSON
+// document or base64 encoded, e.g. in a kubeconfig or a basic auth header.
+func encodings(v string) []string {
+	variants := []string{v}
+	if quoted, err := json.Marshal(v); err == nil {
+		variants = append(variants, string(quoted[1:len(quoted)-1]))
+	}
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.RawURLEncoding,
+	} {
+		variants = append(variants, enc.EncodeToString([]byte(v)))
+	}
+	return variants
+}
+
+// Scrub masks every registered value in s.
+func (r *Registry) Scrub(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+	if replacer == nil {
+		return s
+	}
+	return replacer.Replace(s)
+}
+
+// Error returns err with every registered value masked in its message.
+func (r *Registry) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if scrubbed := r.Scrub(err.Error()); scrubbed != err.Error() {
+		return errors.New(scrubbed)
+	}
+	return err
+}
+
+// Writer scrubs everything written through it. It is meant to sit under the
+// standard logger, which writes one complete line per call.
+type Writer struct {
+	registry *Registry
+	w        io.Writer
+}
+
+func NewWriter(registry *Registry, w io.Writer) *Writer {
+	return &Writer{registry: registry, w: w}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.registry.Scrub(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Scope collects the values registered for a single run so they can be
+// released together once the run is over.
+type Scope struct {
+	registry *Registry
+	mu       sync.Mutex
+	releases []func()
+}
+
+func (r *Registry) NewScope() *Scope {
+	return &Scope{registry: r}
+}
+
+func (s *Scope) Register(values ...string) {
+	s.add(s.registry.Register(values...))
+}
+
+func (s *Scope) RegisterValue(v interface{}) {
+	s.add(s.registry.RegisterValue(v))
+}
+
+func (s *Scope) add(release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releases = append(s.releases, release)
+}
+
+func (s *Scope) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, release := range s.releases {
+		release()
+	}
+	s.releases = nil
+}
+
+// Error masks the registered values in err.
+func (s *Scope) Error(err error) error {
+	return s.registry.Error(err)
+}
@@ -0,0 +1,146 @@
+package scrub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/radiatus-ai/package-provisioner/internal/sensitive"
+)
+
+func TestRegistry_Scrub(t *testing.T) {
+	registry := NewRegistry()
+	secret := `p@ss"word/+?`
+	release := registry.Register(secret)
+
+	quoted, _ := json.Marshal(map[string]string{"password": secret})
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"raw", "connecting with " + secret},
+		{"json", string(quoted)},
+		{"base64", "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(secret))},
+		{"base64 url", base64.URLEncoding.EncodeToString([]byte(secret))},
+		{"base64 raw", base64.RawStdEncoding.EncodeToString([]byte(secret))},
+		{"base64 raw url", base64.RawURLEncoding.EncodeToString([]byte(secret))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scrubbed := registry.Scrub(tt.input)
+			if !strings.Contains(scrubbed, sensitive.Mask) {
+				t.Errorf("Scrub(%q) = %q, expected the secret to be masked", tt.input, scrubbed)
+			}
+			if strings.Contains(scrubbed, secret) {
+				t.Errorf("Scrub(%q) = %q, still contains the secret", tt.input, scrubbed)
+			}
+		})
+	}
+
+	release()
+	if got := registry.Scrub("connecting with " + secret); got != "connecting with "+secret {
+		t.Errorf("Scrub() after release = %q, expected the value to be left alone", got)
+	}
+}
+
+func TestRegistry_SharedValues(t *testing.T) {
+	registry := NewRegistry()
+	first := registry.Register("hunter2")
+	second := registry.Register("hunter2")
+
+	first()
+	first()
+	if got := registry.Scrub("hunter2"); got != sensitive.Mask {
+		t.Errorf("Scrub() = %q, expected the value to stay registered for the second run", got)
+	}
+	second()
+	if got := registry.Scrub("hunter2"); got != "hunter2" {
+		t.Errorf("Scrub() = %q, expected the value to be released", got)
+	}
+}
+
+func TestRegistry_IgnoresShortValues(t *testing.T) {
+	registry := NewRegistry()
+	defer registry.Register("on", "")()
+
+	if got := registry.Scrub("logging on"); got != "logging on" {
+		t.Errorf("Scrub() = %q, expected short values to be ignored", got)
+	}
+}
+
+func TestRegistry_RegisterValue(t *testing.T) {
+	registry := NewRegistry()
+	output := map[string]interface{}{
+		"username": "admin-user",
+		"tokens":   []interface{}{"token-one", "token-two"},
+	}
+	defer registry.RegisterValue(output)()
+
+	encoded, _ := json.Marshal(output)
+	for _, input := range []string{"admin-user", "token-two", string(encoded)} {
+		if got := registry.Scrub(input); strings.Contains(got, "admin-user") || strings.Contains(got, "token-") {
+			t.Errorf("Scrub(%q) = %q, expected the output to be masked", input, got)
+		}
+	}
+}
+
+func TestRegistry_Error(t *testing.T) {
+	registry := NewRegistry()
+	defer registry.Register("hunter2")()
+
+	err := registry.Error(fmt.Errorf("command failed: invalid password %q", "hunter2"))
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Error() = %v, still contains the secret", err)
+	}
+
+	original := errors.New("nothing to hide")
+	if got := registry.Error(original); got != original {
+		t.Errorf("Error() = %v, expected the original error", got)
+	}
+	if registry.Error(nil) != nil {
+		t.Error("Error(nil) should be nil")
+	}
+
+	var nilRegistry *Registry
+	defer nilRegistry.Register("hunter2")()
+	if got := nilRegistry.Scrub("hunter2"); got != "hunter2" {
+		t.Errorf("nil Registry Scrub() = %q", got)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	registry := NewRegistry()
+	defer registry.Register("hunter2")()
+
+	var buf bytes.Buffer
+	logger := log.New(NewWriter(registry, &buf), "", 0)
+	logger.Printf("JSON payload: %s", `{"output_data":{"password":"hunter2"}}`)
+
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("Log output contains the secret: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "JSON payload") {
+		t.Errorf("Log output lost the rest of the line: %s", buf.String())
+	}
+}
+
+func TestScope(t *testing.T) {
+	registry := NewRegistry()
+	scope := registry.NewScope()
+	scope.Register("hunter2")
+	scope.RegisterValue(map[string]interface{}{"key": "s3cr3t-key"})
+
+	if got := registry.Scrub("hunter2 s3cr3t-key"); strings.Contains(got, "hunter2") || strings.Contains(got, "s3cr3t-key") {
+		t.Errorf("Scrub() = %q, expected both values to be masked", got)
+	}
+	scope.Release()
+	if got := registry.Scrub("hunter2 s3cr3t-key"); got != "hunter2 s3cr3t-key" {
+		t.Errorf("Scrub() after Release() = %q", got)
+	}
+}
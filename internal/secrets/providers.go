@@ -0,0 +1,162 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// EnvProvider resolves env://NAME to the value of the environment variable.
+type EnvProvider struct{}
+
+func (EnvProvider) Resolve(ctx context.Context, ref *url.URL) (string, error) {
+	value, ok := os.LookupEnv(ref.Host)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref.Host)
+	}
+	return value, nil
+}
+
+// FileProvider resolves file:///path to the content of the file.
+type FileProvider struct{}
+
+func (FileProvider) Resolve(ctx context.Context, ref *url.URL) (string, error) {
+	data, err := os.ReadFile(ref.Path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// SecretManagerProvider resolves sm://name/version, or the full
+// sm://projects/p/secrets/name/versions/version form, against Google Cloud
+// Secret Manager. The version defaults to latest.
+type SecretManagerProvider struct {
+	projectID string
+	opts      []option.ClientOption
+
+	once    sync.Once
+	service *secretmanager.Service
+	err     error
+}
+
+func NewSecretManagerProvider(projectID string, opts ...option.ClientOption) *SecretManagerProvider {
+	return &SecretManagerProvider{projectID: projectID, opts: opts}
+}
+
+func (p *SecretManagerProvider) Resolve(ctx context.Context, ref *url.URL) (string, error) {
+	// the client needs credentials, only create it once a reference shows up
+	p.once.Do(func() {
+		p.service, p.err = secretmanager.NewService(context.Background(), p.opts...)
+	})
+	if p.err != nil {
+		return "", fmt.Errorf("failed to create secret manager client: %v", p.err)
+	}
+
+	name, err := p.versionName(ref)
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.service.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to access %s: %v", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret payload: %v", err)
+	}
+	return string(data), nil
+}
+
+func (p *SecretManagerProvider) versionName(ref *url.URL) (string, error) {
+	path := strings.Trim(ref.Host+ref.Path, "/")
+	if strings.HasPrefix(path, "projects/") {
+		return path, nil
+	}
+
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return fmt.Sprintf("projects/%s/secrets/%s/versions/latest", p.projectID, parts[0]), nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return fmt.Sprintf("projects/%s/secrets/%s/versions/%s", p.projectID, parts[0], parts[1]), nil
+	default:
+		return "", fmt.Errorf("invalid secret manager reference: %s", ref)
+	}
+}
+
+// VaultProvider resolves vault://path/to/secret#key against the HashiCorp
+// Vault HTTP API. Both KV v1 and v2 responses are understood; for v2 the
+// path must include the data/ segment, e.g. vault://secret/data/db#password.
+type VaultProvider struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func NewVaultProvider(addr, token string) *VaultProvider {
+	return &VaultProvider{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *VaultProvider) Resolve(ctx context.Context, ref *url.URL) (string, error) {
+	if p.addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	if ref.Fragment == "" {
+		return "", fmt.Errorf("vault reference %s has no #key", ref)
+	}
+
+	path := strings.Trim(ref.Host+ref.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/%s", p.addr, path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending vault request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault request failed with status code: %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("error decoding vault response: %v", err)
+	}
+
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[ref.Fragment]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no key %s", path, ref.Fragment)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
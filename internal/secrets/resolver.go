@@ -0,0 +1,105 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"github.com/radiatus-ai/package-provisioner/internal/logging"
+)
+
+// Provider resolves references of one scheme, e.g. sm://db-password/3, to the
+// secret value.
+type Provider interface {
+	Resolve(ctx context.Context, ref *url.URL) (string, error)
+}
+
+// Resolver replaces secret references in a deployment message with their
+// values just before execution, so plaintext secrets never travel through
+// Pub/Sub.
+type Resolver struct {
+	providers map[string]Provider
+	// reject plaintext values instead of passing them through
+	requireReferences bool
+}
+
+func NewResolver(requireReferences bool) *Resolver {
+	return &Resolver{
+		providers:         make(map[string]Provider),
+		requireReferences: requireReferences,
+	}
+}
+
+// NewResolverFromConfig registers sm:// and vault://. env:// and file:// read
+// the provisioner's own environment and files, its credentials included, so
+// they are only registered with LocalSecretProviders.
+func NewResolverFromConfig(cfg *config.Config) *Resolver {
+	r := NewResolver(cfg.RequireSecretReferences)
+	r.Register("sm", NewSecretManagerProvider(cfg.ProjectID))
+	r.Register("vault", NewVaultProvider(cfg.VaultAddr, cfg.VaultToken))
+	if cfg.LocalSecretProviders {
+		r.Register("env", EnvProvider{})
+		r.Register("file", FileProvider{})
+	}
+	return r
+}
+
+func (r *Resolver) Register(scheme string, provider Provider) {
+	r.providers[scheme] = provider
+}
+
+// reference returns the parsed reference and its provider, or nil if value
+// is not a reference to a registered scheme.
+func (r *Resolver) reference(value string) (*url.URL, Provider) {
+	scheme, _, ok := strings.Cut(value, "://")
+	if !ok {
+		return nil, nil
+	}
+	provider, ok := r.providers[scheme]
+	if !ok {
+		return nil, nil
+	}
+	ref, err := url.Parse(value)
+	if err != nil {
+		return nil, nil
+	}
+	return ref, provider
+}
+
+// ResolveAll returns a copy of secrets with every reference replaced by its
+// value. A nil Resolver returns secrets unchanged.
+func (r *Resolver) ResolveAll(ctx context.Context, secrets map[string]string) (map[string]string, error) {
+	if r == nil || len(secrets) == 0 {
+		return secrets, nil
+	}
+
+	keys := make([]string, 0, len(secrets))
+	for k := range secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	resolved := make(map[string]string, len(secrets))
+	for _, k := range keys {
+		ref, provider := r.reference(secrets[k])
+		if ref == nil {
+			if r.requireReferences {
+				return nil, fmt.Errorf("secret %s is not a secret reference", k)
+			}
+			resolved[k] = secrets[k]
+			continue
+		}
+
+		value, err := provider.Resolve(ctx, ref)
+		if err != nil {
+			// the reference itself is not sensitive, the value would be
+			return nil, fmt.Errorf("failed to resolve secret %s (%s): %v", k, ref.Redacted(), err)
+		}
+		logging.FromContext(ctx).Info("Resolved secret", "secret", k, "scheme", ref.Scheme)
+		resolved[k] = value
+	}
+	return resolved, nil
+}
@@ -0,0 +1,174 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"google.golang.org/api/option"
+)
+
+func TestResolver_ResolveAll(t *testing.T) {
+	t.Setenv("TEST_DB_PASSWORD", "from-env")
+	secretFile := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+
+	r := NewResolver(false)
+	r.Register("env", EnvProvider{})
+	r.Register("file", FileProvider{})
+
+	got, err := r.ResolveAll(context.Background(), map[string]string{
+		"db_password": "env://TEST_DB_PASSWORD",
+		"api_key":     "file://" + secretFile,
+		"legacy":      "plaintext",
+		"url":         "https://example.com",
+	})
+	if err != nil {
+		t.Fatalf("ResolveAll() error = %v", err)
+	}
+
+	want := map[string]string{
+		"db_password": "from-env",
+		"api_key":     "from-file",
+		"legacy":      "plaintext",
+		"url":         "https://example.com",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ResolveAll() = %v, want %v", got, want)
+	}
+}
+
+func TestResolver_RequireReferences(t *testing.T) {
+	r := NewResolver(true)
+	r.Register("env", EnvProvider{})
+
+	if _, err := r.ResolveAll(context.Background(), map[string]string{"password": "hunter2"}); err == nil {
+		t.Error("Expected plaintext secrets to be rejected")
+	}
+}
+
+func TestResolver_ErrorDoesNotLeakValue(t *testing.T) {
+	r := NewResolver(false)
+	r.Register("env", EnvProvider{})
+
+	_, err := r.ResolveAll(context.Background(), map[string]string{"password": "env://TEST_UNSET_VARIABLE"})
+	if err == nil || !strings.Contains(err.Error(), "password") {
+		t.Errorf("Expected an error naming the secret, got %v", err)
+	}
+}
+
+func TestNewResolverFromConfig_LocalProviders(t *testing.T) {
+	t.Setenv("TEST_CANVAS_TOKEN", "provisioner-credential")
+	secrets := map[string]string{"token": "env://TEST_CANVAS_TOKEN"}
+
+	got, err := NewResolverFromConfig(&config.Config{}).ResolveAll(context.Background(), secrets)
+	if err != nil || got["token"] == "provisioner-credential" {
+		t.Errorf("Expected env:// not to be resolved by default, got %v (err %v)", got, err)
+	}
+	if _, err := NewResolverFromConfig(&config.Config{RequireSecretReferences: true}).ResolveAll(context.Background(), secrets); err == nil {
+		t.Error("Expected env:// not to count as a secret reference by default")
+	}
+
+	got, err = NewResolverFromConfig(&config.Config{LocalSecretProviders: true}).ResolveAll(context.Background(), secrets)
+	if err != nil || got["token"] != "provisioner-credential" {
+		t.Errorf("Expected env:// to be resolved with local providers, got %v (err %v)", got, err)
+	}
+}
+
+func TestNilResolver(t *testing.T) {
+	var r *Resolver
+	secrets := map[string]string{"password": "hunter2"}
+	got, err := r.ResolveAll(context.Background(), secrets)
+	if err != nil || !reflect.DeepEqual(got, secrets) {
+		t.Errorf("Expected nil resolver to pass secrets through, got %v (err %v)", got, err)
+	}
+}
+
+func TestVaultProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/db":
+			fmt.Fprint(w, `{"data": {"data": {"password": "kv2-secret"}, "metadata": {"version": 3}}}`)
+		case "/v1/kv/db":
+			fmt.Fprint(w, `{"data": {"password": "kv1-secret"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	r := NewResolver(false)
+	r.Register("vault", NewVaultProvider(server.URL, "root"))
+
+	got, err := r.ResolveAll(context.Background(), map[string]string{
+		"v2": "vault://secret/data/db#password",
+		"v1": "vault://kv/db#password",
+	})
+	if err != nil {
+		t.Fatalf("ResolveAll() error = %v", err)
+	}
+	if got["v2"] != "kv2-secret" || got["v1"] != "kv1-secret" {
+		t.Errorf("Unexpected vault secrets: %v", got)
+	}
+
+	for _, ref := range []string{"vault://secret/data/db#missing", "vault://secret/data/db", "vault://missing#password"} {
+		if _, err := r.ResolveAll(context.Background(), map[string]string{"s": ref}); err == nil {
+			t.Errorf("Expected %s to fail", ref)
+		}
+	}
+}
+
+func TestSecretManagerProvider(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		data := base64.StdEncoding.EncodeToString([]byte("sm-secret"))
+		fmt.Fprintf(w, `{"name": %q, "payload": {"data": %q}}`, strings.TrimPrefix(r.URL.Path, "/v1/"), data)
+	}))
+	defer server.Close()
+
+	r := NewResolver(false)
+	r.Register("sm", NewSecretManagerProvider("test-project", option.WithEndpoint(server.URL), option.WithoutAuthentication()))
+
+	got, err := r.ResolveAll(context.Background(), map[string]string{
+		"a": "sm://db-password/3",
+		"b": "sm://api-key",
+		"c": "sm://projects/other/secrets/token/versions/1",
+	})
+	if err != nil {
+		t.Fatalf("ResolveAll() error = %v", err)
+	}
+	for k, v := range got {
+		if v != "sm-secret" {
+			t.Errorf("Unexpected value for %s: %s", k, v)
+		}
+	}
+
+	for _, want := range []string{
+		"/v1/projects/test-project/secrets/db-password/versions/3:access",
+		"/v1/projects/test-project/secrets/api-key/versions/latest:access",
+		"/v1/projects/other/secrets/token/versions/1:access",
+	} {
+		found := false
+		for _, p := range paths {
+			found = found || p == want
+		}
+		if !found {
+			t.Errorf("Expected a request to %s, got %v", want, paths)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package sensitive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+)
+
+// Mask replaces sensitive values wherever they would otherwise be shown.
+const Mask = "********"
+
+// Redact returns a copy of data with the values of keys masked.
+func Redact(data map[string]interface{}, keys []string) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	redacted := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		redacted[k] = v
+	}
+	for _, k := range keys {
+		if _, ok := redacted[k]; ok {
+			redacted[k] = Mask
+		}
+	}
+	return redacted
+}
+
+type Mode string
+
+const (
+	// sensitive outputs are sent as is, only masked in logs and marked in the payload
+	ModePlain Mode = "plain"
+	// sensitive outputs are sent encrypted with the configured key
+	ModeEncrypt Mode = "encrypt"
+)
+
+const encryptedPrefix = "enc:v1:"
+
+// Protector transforms sensitive outputs before they leave the provisioner.
+type Protector struct {
+	mode Mode
+	aead cipher.AEAD
+}
+
+func NewProtector(mode Mode, key []byte) (*Protector, error) {
+	p := &Protector{mode: mode}
+	switch mode {
+	case ModePlain:
+	case ModeEncrypt:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sensitive output key: %v", err)
+		}
+		if p.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported sensitive output mode: %s", mode)
+	}
+	return p, nil
+}
+
+func NewProtectorFromConfig(cfg *config.Config) (*Protector, error) {
+	var key []byte
+	if cfg.SensitiveOutputKey != "" {
+		var err error
+		if key, err = base64.StdEncoding.DecodeString(cfg.SensitiveOutputKey); err != nil {
+			return nil, fmt.Errorf("SENSITIVE_OUTPUT_KEY is not valid base64: %v", err)
+		}
+	}
+	return NewProtector(Mode(cfg.SensitiveOutputMode), key)
+}
+
+// Protect returns a copy of outputs with the values of keys encrypted in
+// encrypt mode. A nil Protector leaves outputs untouched.
+func (p *Protector) Protect(outputs map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	if p == nil || p.mode == ModePlain || len(keys) == 0 {
+		return outputs, nil
+	}
+
+	protected := make(map[string]interface{}, len(outputs))
+	for k, v := range outputs {
+		protected[k] = v
+	}
+	for _, k := range keys {
+		v, ok := outputs[k]
+		if !ok {
+			continue
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal output %s: %v", k, err)
+		}
+
+		nonce := make([]byte, p.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		sealed := p.aead.Seal(nonce, nonce, value, nil)
+		protected[k] = encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	}
+	return protected, nil
+}
+
+// Reveal decrypts a value produced by Protect in encrypt mode. Any other
+// value is returned unchanged.
+func (p *Protector) Reveal(value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if p == nil || p.aead == nil || !ok || !strings.HasPrefix(s, encryptedPrefix) {
+		return value, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, encryptedPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted value: %v", err)
+	}
+	nonceSize := p.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("invalid encrypted value: too short")
+	}
+	plaintext, err := p.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %v", err)
+	}
+
+	var revealed interface{}
+	if err := json.Unmarshal(plaintext, &revealed); err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted value: %v", err)
+	}
+	return revealed, nil
+}
@@ -0,0 +1,84 @@
+package sensitive
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	data := map[string]interface{}{"host": "10.0.0.1", "password": "hunter2"}
+	redacted := Redact(data, []string{"password", "missing"})
+
+	want := map[string]interface{}{"host": "10.0.0.1", "password": Mask}
+	if !reflect.DeepEqual(redacted, want) {
+		t.Errorf("Redact() = %v, want %v", redacted, want)
+	}
+	if data["password"] != "hunter2" {
+		t.Error("Redact() modified its input")
+	}
+}
+
+func TestProtector_Encrypt(t *testing.T) {
+	protector, err := NewProtector(ModeEncrypt, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("NewProtector() error = %v", err)
+	}
+
+	outputs := map[string]interface{}{
+		"host":     "10.0.0.1",
+		"password": "hunter2",
+		"creds":    map[string]interface{}{"user": "admin"},
+	}
+	protected, err := protector.Protect(outputs, []string{"password", "creds"})
+	if err != nil {
+		t.Fatalf("Protect() error = %v", err)
+	}
+
+	if protected["host"] != "10.0.0.1" {
+		t.Errorf("Expected non-sensitive output to be untouched, got %v", protected["host"])
+	}
+	for _, k := range []string{"password", "creds"} {
+		s, ok := protected[k].(string)
+		if !ok || !strings.HasPrefix(s, encryptedPrefix) || strings.Contains(s, "hunter2") {
+			t.Fatalf("Expected %s to be encrypted, got %v", k, protected[k])
+		}
+		revealed, err := protector.Reveal(protected[k])
+		if err != nil {
+			t.Fatalf("Reveal(%s) error = %v", k, err)
+		}
+		if !reflect.DeepEqual(revealed, outputs[k]) {
+			t.Errorf("Reveal(%s) = %v, want %v", k, revealed, outputs[k])
+		}
+	}
+
+	if revealed, err := protector.Reveal("plain"); err != nil || revealed != "plain" {
+		t.Errorf("Expected plain values to be revealed unchanged, got %v (err %v)", revealed, err)
+	}
+}
+
+func TestProtector_Plain(t *testing.T) {
+	var nilProtector *Protector
+	outputs := map[string]interface{}{"password": "hunter2"}
+	for _, p := range []*Protector{nilProtector, {mode: ModePlain}} {
+		protected, err := p.Protect(outputs, []string{"password"})
+		if err != nil {
+			t.Fatalf("Protect() error = %v", err)
+		}
+		if protected["password"] != "hunter2" {
+			t.Errorf("Expected plain mode to keep the value, got %v", protected["password"])
+		}
+	}
+}
+
+func TestNewProtector_Invalid(t *testing.T) {
+	if _, err := NewProtector(ModeEncrypt, []byte("short")); err == nil {
+		t.Error("Expected an error for an invalid key")
+	}
+	if _, err := NewProtector("secret_ref", nil); err == nil {
+		t.Error("Expected an error for the removed secret_ref mode")
+	}
+	if _, err := NewProtector("vault", nil); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/radiatus-ai/package-provisioner/internal/config"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStage(t *testing.T) {
+	exporter, restore := UseInMemory()
+	defer restore()
+
+	ctx, parent := Start(context.Background(), "parent")
+	err := Stage(ctx, "stage", func(ctx context.Context) error {
+		return errors.New("boom")
+	})
+	parent.End()
+	if err == nil || err.Error() != "boom" {
+		t.Fatalf("Stage() error = %v, want the error of fn", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	stage := spans[0]
+	if stage.Name != "stage" || stage.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Expected the stage to be a child of the parent span, got %+v", stage.Parent)
+	}
+	if stage.Status.Code != codes.Error || len(stage.Events) != 1 {
+		t.Errorf("Expected the error to be recorded, got status %+v", stage.Status)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	_, restore := UseInMemory()
+	defer restore()
+
+	if carrier := Carrier(context.Background()); carrier != nil {
+		t.Errorf("Carrier() without a span = %v, want nil", carrier)
+	}
+
+	ctx, span := Start(context.Background(), "publish")
+	defer span.End()
+	attributes := map[string]string{"type": "REDEPLOY_REQUEST"}
+	Inject(ctx, attributes)
+	if attributes["traceparent"] == "" {
+		t.Fatalf("Expected a traceparent attribute, got %v", attributes)
+	}
+
+	extracted := trace.SpanContextFromContext(Extract(context.Background(), attributes))
+	if extracted.TraceID() != span.SpanContext().TraceID() || !extracted.IsRemote() {
+		t.Errorf("Extract() = %+v, want the remote span context of the publisher", extracted)
+	}
+	if got := Extract(context.Background(), nil); trace.SpanContextFromContext(got).IsValid() {
+		t.Error("Extract() of no attributes should not add a span context")
+	}
+}
+
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), &config.Config{TracingExporter: ExporterNone})
+	if err != nil || shutdown(context.Background()) != nil {
+		t.Errorf("Setup() with tracing disabled error = %v", err)
+	}
+	if _, err := Setup(context.Background(), &config.Config{TracingExporter: "zipkin"}); err == nil {
+		t.Error("Expected an unknown exporter to be rejected")
+	}
+}
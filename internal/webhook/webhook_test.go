@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	secret := []byte("shared-secret")
+	body := []byte(`{"package_id":"test-package"}`)
+	now := time.Now()
+
+	header := http.Header{}
+	header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	header.Set(SignatureHeader, Sign(secret, now, body))
+	if err := Verify(secret, header, body, time.Minute); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	if err := Verify([]byte("other-secret"), header, body, time.Minute); err == nil {
+		t.Error("Expected a signature from another secret to be rejected")
+	}
+	if err := Verify(secret, header, []byte(`{"package_id":"other"}`), time.Minute); err == nil {
+		t.Error("Expected a modified body to be rejected")
+	}
+
+	old := now.Add(-time.Hour)
+	header.Set(TimestampHeader, strconv.FormatInt(old.Unix(), 10))
+	header.Set(SignatureHeader, Sign(secret, old, body))
+	if err := Verify(secret, header, body, time.Minute); err == nil {
+		t.Error("Expected an old webhook to be rejected")
+	}
+}
+
+func TestClient_Send(t *testing.T) {
+	secret := []byte("shared-secret")
+	var verifyErr error
+	var idempotencyKey string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		verifyErr = Verify(secret, r.Header, body, time.Minute)
+		idempotencyKey = r.Header.Get("Idempotency-Key")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, secret)
+	if err := client.Send(context.Background(), []byte(`{}`), http.Header{"Idempotency-Key": {"run-1:DEPLOYED"}}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if verifyErr != nil {
+		t.Errorf("Receiver failed to verify the signature: %v", verifyErr)
+	}
+	if idempotencyKey != "run-1:DEPLOYED" {
+		t.Errorf("Expected the extra headers to be sent, got %q", idempotencyKey)
+	}
+
+	status = http.StatusBadRequest
+	err := client.Send(context.Background(), []byte(`{}`), nil)
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Send() error = %v, want a 400 StatusError", err)
+	}
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// transitions is the package lifecycle: the statuses a package may move to
+// from each status. A package with no recorded status may start either action.
+var transitions = map[DeployStatus][]DeployStatus{
+	"":           {StartDeploy, StartDestroy},
+	Destroyed:    {StartDeploy, StartDestroy},
+	StartDeploy:  {Deployed, Failed},
+	Deployed:     {StartDeploy, StartDestroy},
+	StartDestroy: {Destroyed, Failed},
+	Failed:       {StartDeploy, StartDestroy},
+}
+
+// InProgress reports whether a run is still working towards a final status.
+func (s DeployStatus) InProgress() bool {
+	return s == StartDeploy || s == StartDestroy
+}
+
+func (s DeployStatus) CanTransitionTo(next DeployStatus) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError is returned for a status change the lifecycle doesn't allow.
+type TransitionError struct {
+	From DeployStatus
+	To   DeployStatus
+}
+
+func (e *TransitionError) Error() string {
+	from := e.From
+	if from == "" {
+		from = "unknown"
+	}
+	return fmt.Sprintf("illegal status transition from %s to %s", from, e.To)
+}
+
+func ValidateTransition(from, to DeployStatus) error {
+	if !from.CanTransitionTo(to) {
+		return &TransitionError{From: from, To: to}
+	}
+	return nil
+}
+
+// StatusTransition is a single status change of a package.
+type StatusTransition struct {
+	From DeployStatus `json:"from,omitempty"`
+	To   DeployStatus `json:"to"`
+	At   time.Time    `json:"at"`
+}
+
+// StartStatus is the status a package enters when a run of the action starts.
+func (a DeploymentAction) StartStatus() (DeployStatus, error) {
+	switch a {
+	case ActionDeploy:
+		return StartDeploy, nil
+	case ActionDestroy:
+		return StartDestroy, nil
+	default:
+		return "", fmt.Errorf("unsupported action: %s", a)
+	}
+}
+
+// EndStatus is the status a package ends in when a run of the action succeeds.
+func (a DeploymentAction) EndStatus() (DeployStatus, error) {
+	switch a {
+	case ActionDeploy:
+		return Deployed, nil
+	case ActionDestroy:
+		return Destroyed, nil
+	default:
+		return "", fmt.Errorf("unsupported action: %s", a)
+	}
+}
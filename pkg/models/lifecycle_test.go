@@ -0,0 +1,51 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateTransition(t *testing.T) {
+	tests := []struct {
+		from, to DeployStatus
+		allowed  bool
+	}{
+		{"", StartDeploy, true},
+		{"", Deployed, false},
+		{Destroyed, StartDeploy, true},
+		{StartDeploy, Deployed, true},
+		{StartDeploy, Failed, true},
+		{StartDeploy, StartDestroy, false},
+		{StartDeploy, StartDeploy, false},
+		{Deployed, StartDestroy, true},
+		{Deployed, StartDeploy, true},
+		{Deployed, Destroyed, false},
+		{StartDestroy, Destroyed, true},
+		{StartDestroy, StartDeploy, false},
+		{Failed, StartDeploy, true},
+		{Failed, Deployed, false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateTransition(tt.from, tt.to)
+		if (err == nil) != tt.allowed {
+			t.Errorf("ValidateTransition(%q, %q) error = %v, allowed %v", tt.from, tt.to, err, tt.allowed)
+		}
+		var transitionErr *TransitionError
+		if err != nil && !errors.As(err, &transitionErr) {
+			t.Errorf("Expected a TransitionError, got %T", err)
+		}
+	}
+}
+
+func TestDeploymentAction_Statuses(t *testing.T) {
+	if s, _ := ActionDestroy.StartStatus(); s != StartDestroy {
+		t.Errorf("StartStatus() = %s", s)
+	}
+	if s, _ := ActionDeploy.EndStatus(); s != Deployed {
+		t.Errorf("EndStatus() = %s", s)
+	}
+	if _, err := ActionDeployProject.StartStatus(); err == nil {
+		t.Error("Expected project actions to have no start status")
+	}
+}
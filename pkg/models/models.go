@@ -4,6 +4,11 @@ type Package struct {
 	Type          string                 `json:"type"`
 	ParameterData map[string]interface{} `json:"parameter_data"`
 	Outputs       map[string]interface{} `json:"outputs"`
+	// how to resolve keys present in both parameter_data and connected_input_data
+	MergePolicy MergePolicy `json:"merge_policy,omitempty"`
+	// nest connected inputs under ConnectionsInputKey, keyed by connection name,
+	// instead of flattening them next to the parameters
+	NamespaceConnections bool `json:"namespace_connections,omitempty"`
 }
 
 type DeploymentAction string
@@ -11,8 +16,16 @@ type DeploymentAction string
 const (
 	ActionDeploy  DeploymentAction = "DEPLOY"
 	ActionDestroy DeploymentAction = "DESTROY"
+	// deploy or destroy every package in DeploymentMessage.Packages in
+	// dependency order
+	ActionDeployProject  DeploymentAction = "DEPLOY_PROJECT"
+	ActionDestroyProject DeploymentAction = "DESTROY_PROJECT"
 )
 
+func (a DeploymentAction) IsProjectAction() bool {
+	return a == ActionDeployProject || a == ActionDestroyProject
+}
+
 type DeployStatus string
 
 const (
@@ -23,13 +36,69 @@ const (
 	Failed       DeployStatus = "FAILED"
 )
 
+type MergePolicy string
+
+const (
+	// connected inputs overwrite parameters with the same key (the default)
+	MergeConnectionWins MergePolicy = "CONNECTION_WINS"
+	// parameters set by the user are kept, the connected input is dropped
+	MergeParameterWins MergePolicy = "PARAMETER_WINS"
+	// any conflicting key fails the deployment
+	MergeError MergePolicy = "ERROR"
+)
+
+// Connection wires the outputs of an upstream package into the inputs of the
+// package being deployed.
+type Connection struct {
+	// name of the connection, used as the key when connections are namespaced
+	Name              string `json:"name"`
+	SourcePackageID   string `json:"source_package_id"`
+	SourcePackageType string `json:"source_package_type,omitempty"`
+	// upstream output key -> input key, when empty every upstream output is
+	// passed through under its own name
+	OutputMappings map[string]string `json:"output_mappings,omitempty"`
+}
+
+// ConnectionsInputKey is the variable connected inputs are nested under when
+// a package sets NamespaceConnections.
+const ConnectionsInputKey = "connections"
+
 type DeploymentMessage struct {
-	ProjectID string  `json:"project_id"`
-	PackageID string  `json:"package_id"`
-	Package   Package `json:"package"`
-	// i think this is actually the parameter data
-	// and we still need to add the connections
+	// the schema the message was published with, see CurrentSchemaVersion
+	SchemaVersion int     `json:"schema_version,omitempty"`
+	ProjectID     string  `json:"project_id"`
+	PackageID     string  `json:"package_id"`
+	Package       Package `json:"package"`
+	// pre-flattened inputs from connected packages, values resolved from
+	// Connections are merged over these
 	ConnectedInputData map[string]interface{} `json:"connected_input_data"`
+	Connections        []Connection           `json:"connections,omitempty"`
 	Action             DeploymentAction       `json:"action"`
 	Secrets            map[string]string      `json:"secrets"`
+	// identifies the request across publishes, so a message published again
+	// isn't processed again. Redeliveries are recognized by message id
+	// without it.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// increases with every message canvas-api publishes for the package, a
+	// message older than the last one processed is skipped. Zero messages
+	// are always processed.
+	Generation int64 `json:"generation,omitempty"`
+	// packages redeployed so far by output change propagation, set by
+	// canvas-api from RedeployRequest.PropagationChain
+	PropagationChain []string `json:"propagation_chain,omitempty"`
+	// the package graph of a project action, wired together by each
+	// package's Connections
+	Packages []DeploymentMessage `json:"packages,omitempty"`
+}
+
+// RedeployRequest asks for a package to be redeployed because outputs of a
+// package it is connected to changed.
+type RedeployRequest struct {
+	ProjectID       string   `json:"project_id"`
+	PackageID       string   `json:"package_id"`
+	SourcePackageID string   `json:"source_package_id"`
+	ChangedOutputs  []string `json:"changed_outputs"`
+	// every package redeployed in this propagation so far, including the
+	// source, so a cycle of connections can't redeploy forever
+	PropagationChain []string `json:"propagation_chain"`
 }
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CurrentSchemaVersion is the newest DeploymentMessage schema the provisioner
+// reads. Fields added without changing the meaning of existing ones don't need
+// a new version, publishers and the provisioner ignore what they don't know.
+const CurrentSchemaVersion = 1
+
+var (
+	// ErrUnsupportedSchemaVersion is returned for a message published with a
+	// schema newer than this provisioner reads. It can be replayed once the
+	// provisioner is upgraded.
+	ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+	// ErrInvalidMessage is returned for a message that fails validation.
+	ErrInvalidMessage = errors.New("invalid deployment message")
+)
+
+// decoders read each schema version into the current DeploymentMessage. A new
+// version adds its decoder here, and the decoders of older versions upgrade the
+// messages publishers still send.
+var decoders = map[int]func([]byte) (DeploymentMessage, error){
+	1: decodeV1,
+}
+
+// DecodeDeploymentMessage reads a message of any supported schema version.
+// Messages without a schema_version predate versioning and are read as version
+// 1. The message isn't validated, see Validate.
+func DecodeDeploymentMessage(data []byte) (DeploymentMessage, error) {
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return DeploymentMessage{}, fmt.Errorf("failed to parse deployment message: %v", err)
+	}
+	version := header.SchemaVersion
+	if version == 0 {
+		version = 1
+	}
+	decode, ok := decoders[version]
+	if !ok {
+		return DeploymentMessage{}, fmt.Errorf("%w %d, the newest supported is %d", ErrUnsupportedSchemaVersion, version, CurrentSchemaVersion)
+	}
+	msg, err := decode(data)
+	if err != nil {
+		return DeploymentMessage{}, fmt.Errorf("failed to parse deployment message: %v", err)
+	}
+	msg.SchemaVersion = version
+	return msg, nil
+}
+
+// version 1 is the schema DeploymentMessage has always had
+func decodeV1(data []byte) (DeploymentMessage, error) {
+	var msg DeploymentMessage
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidID reports whether id is a plain name. Ids and package types end up in
+// paths, e.g. the workspace of a package is WorkspacePath/<package_id>, so
+// they can't be empty or point outside of where they're joined.
+func ValidID(id string) bool {
+	return idPattern.MatchString(id) && !strings.Contains(id, "..")
+}
+
+// Validate checks a message can be run safely: the ids it is stored under,
+// the module it runs and what it asks for.
+func (m DeploymentMessage) Validate() error {
+	if !ValidID(m.ProjectID) {
+		return invalid("project_id", m.ProjectID)
+	}
+	switch m.Action {
+	case ActionDeploy, ActionDestroy:
+		return m.validatePackage()
+	case ActionDeployProject, ActionDestroyProject:
+		if len(m.Packages) == 0 {
+			return fmt.Errorf("%w: %s without packages", ErrInvalidMessage, m.Action)
+		}
+		for _, pkg := range m.Packages {
+			// packages take the project and action of the project message
+			if pkg.ProjectID != "" && pkg.ProjectID != m.ProjectID {
+				return fmt.Errorf("%w: package %s belongs to project %s, not %s", ErrInvalidMessage, pkg.PackageID, pkg.ProjectID, m.ProjectID)
+			}
+			if err := pkg.validatePackage(); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown action %q", ErrInvalidMessage, m.Action)
+	}
+}
+
+func (m DeploymentMessage) validatePackage() error {
+	if !ValidID(m.PackageID) {
+		return invalid("package_id", m.PackageID)
+	}
+	// a module under TerraformModulesPath, which may be nested
+	for _, part := range strings.Split(m.Package.Type, "/") {
+		if !ValidID(part) {
+			return invalid("package.type", m.Package.Type)
+		}
+	}
+	switch m.Package.MergePolicy {
+	case "", MergeConnectionWins, MergeParameterWins, MergeError:
+	default:
+		return fmt.Errorf("%w: unknown merge_policy %q", ErrInvalidMessage, m.Package.MergePolicy)
+	}
+	for _, c := range m.Connections {
+		if !ValidID(c.SourcePackageID) {
+			return invalid("connections.source_package_id", c.SourcePackageID)
+		}
+	}
+	if m.Generation < 0 {
+		return fmt.Errorf("%w: negative generation %d", ErrInvalidMessage, m.Generation)
+	}
+	return nil
+}
+
+func invalid(field, value string) error {
+	if value == "" {
+		return fmt.Errorf("%w: %s is required", ErrInvalidMessage, field)
+	}
+	return fmt.Errorf("%w: %s %q may only contain letters, digits, '.', '_' and '-'", ErrInvalidMessage, field, value)
+}
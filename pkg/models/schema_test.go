@@ -0,0 +1,88 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeDeploymentMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		version int
+		err     error
+	}{
+		{"unversioned", `{"project_id": "proj-123", "package_id": "pkg-456", "package": {"type": "deployment"}, "action": "DEPLOY"}`, 1, nil},
+		{"version 1", `{"schema_version": 1, "project_id": "proj-123", "package_id": "pkg-456", "package": {"type": "gcp/cloud-run"}, "action": "DESTROY"}`, 1, nil},
+		{"unknown fields", `{"schema_version": 1, "project_id": "proj-123", "package_id": "pkg-456", "package": {"type": "deployment"}, "action": "DEPLOY", "added_later": true}`, 1, nil},
+		{"newer version", `{"schema_version": 2, "project_id": "proj-123", "package_id": "pkg-456", "action": "DEPLOY"}`, 0, ErrUnsupportedSchemaVersion},
+		{"negative version", `{"schema_version": -1}`, 0, ErrUnsupportedSchemaVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := DecodeDeploymentMessage([]byte(tt.data))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("DecodeDeploymentMessage() error = %v, want %v", err, tt.err)
+			}
+			if msg.SchemaVersion != tt.version {
+				t.Errorf("SchemaVersion = %d, want %d", msg.SchemaVersion, tt.version)
+			}
+		})
+	}
+
+	if _, err := DecodeDeploymentMessage([]byte("not json")); err == nil {
+		t.Errorf("Expected a parse error, got %v", err)
+	}
+}
+
+func TestDeploymentMessage_Validate(t *testing.T) {
+	valid := func() DeploymentMessage {
+		return DeploymentMessage{
+			ProjectID:   "proj-123",
+			PackageID:   "pkg-456",
+			Package:     Package{Type: "deployment"},
+			Action:      ActionDeploy,
+			Connections: []Connection{{Name: "database", SourcePackageID: "db_1.0"}},
+		}
+	}
+	project := func() DeploymentMessage {
+		return DeploymentMessage{ProjectID: "proj-123", Action: ActionDeployProject, Packages: []DeploymentMessage{valid()}}
+	}
+
+	tests := []struct {
+		name  string
+		msg   func() DeploymentMessage
+		valid bool
+	}{
+		{"valid", valid, true},
+		{"valid project", project, true},
+		{"missing project", func() DeploymentMessage { m := valid(); m.ProjectID = ""; return m }, false},
+		{"missing package", func() DeploymentMessage { m := valid(); m.PackageID = ""; return m }, false},
+		{"package traversal", func() DeploymentMessage { m := valid(); m.PackageID = ".."; return m }, false},
+		{"package separator", func() DeploymentMessage { m := valid(); m.PackageID = "a/b"; return m }, false},
+		{"project traversal", func() DeploymentMessage { m := valid(); m.ProjectID = "../proj"; return m }, false},
+		{"missing type", func() DeploymentMessage { m := valid(); m.Package.Type = ""; return m }, false},
+		{"type traversal", func() DeploymentMessage { m := valid(); m.Package.Type = "gcp/../../secrets"; return m }, false},
+		{"absolute type", func() DeploymentMessage { m := valid(); m.Package.Type = "/etc"; return m }, false},
+		{"unknown action", func() DeploymentMessage { m := valid(); m.Action = "REDEPLOY"; return m }, false},
+		{"missing action", func() DeploymentMessage { m := valid(); m.Action = ""; return m }, false},
+		{"unknown merge policy", func() DeploymentMessage { m := valid(); m.Package.MergePolicy = "LAST_WINS"; return m }, false},
+		{"connection traversal", func() DeploymentMessage { m := valid(); m.Connections[0].SourcePackageID = "../db"; return m }, false},
+		{"negative generation", func() DeploymentMessage { m := valid(); m.Generation = -1; return m }, false},
+		{"empty project", func() DeploymentMessage { m := project(); m.Packages = nil; return m }, false},
+		{"project package without type", func() DeploymentMessage { m := project(); m.Packages[0].Package.Type = ""; return m }, false},
+		{"project package of another project", func() DeploymentMessage { m := project(); m.Packages[0].ProjectID = "other"; return m }, false},
+		{"project package without project", func() DeploymentMessage { m := project(); m.Packages[0].ProjectID = ""; return m }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.msg().Validate()
+			if tt.valid && err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidMessage) {
+				t.Errorf("Validate() error = %v, want ErrInvalidMessage", err)
+			}
+		})
+	}
+}